@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// absenceMu serialises absence checks from sites polled at the same time
+var absenceMu sync.Mutex
+
+// watchedDevice is a device whose absence is alerted
+type watchedDevice struct {
+	mac         string
+	name        string
+	lastSeen    sql.NullTime
+	absentSince sql.NullTime
+	threshold   time.Duration
+	groups      []*group
+}
+
+// readAbsence adds the devices' absence columns
+func readAbsence(app *wifiClientWatchApp) {
+	err := addMissingColumns(app.db, "devices", []string{
+		"absence_threshold integer not null default 0", "absent_since timestamp",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseSeconds parses a number of seconds or a duration like 15m
+func parseSeconds(value string) (int, error) {
+	if 0 == len(value) {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if nil != err {
+		var d time.Duration
+		if d, err = time.ParseDuration(value); nil != err {
+			return 0, fmt.Errorf("invalid duration %s", value)
+		}
+		seconds = int(d / time.Second)
+	}
+	if seconds < 0 {
+		return 0, fmt.Errorf("invalid duration %s", value)
+	}
+	return seconds, nil
+}
+
+// watchedDevices returns the devices with an absence threshold of their own,
+// or from the shortest of their groups'
+func watchedDevices() ([]watchedDevice, error) {
+	groups, err := loadGroups()
+	if nil != err {
+		return nil, err
+	}
+	subjects, err := deviceSubjects()
+	if nil != err {
+		return nil, err
+	}
+	bySubject := make(map[string]groupSubject)
+	for _, s := range subjects {
+		bySubject[s.mac] = s
+	}
+
+	rows, err := application.db.Query(`select mac, coalesce(name, hostname, ''), last_seen, absent_since,
+		absence_threshold from devices where alias_of is null`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	watched := make([]watchedDevice, 0)
+	for rows.Next() {
+		var d watchedDevice
+		var threshold int
+		if err = rows.Scan(&d.mac, &d.name, &d.lastSeen, &d.absentSince, &threshold); err != nil {
+			return nil, err
+		}
+		d.groups = memberOf(bySubject[d.mac], groups)
+		own := 0 != threshold
+		for _, g := range d.groups {
+			if !own && (0 == threshold || (0 != g.AbsenceThreshold && g.AbsenceThreshold < threshold)) {
+				threshold = g.AbsenceThreshold
+			}
+		}
+		if threshold > 0 {
+			d.threshold = time.Duration(threshold) * time.Second
+			watched = append(watched, d)
+		}
+	}
+	return watched, rows.Err()
+}
+
+// lastSite is the site the device was last connected to, or nil
+func lastSite(mac string) (*site, error) {
+	var name string
+	err := application.db.QueryRow("select site from sessions where mac = ? order by connected_at desc limit 1",
+		mac).Scan(&name)
+	if nil != err && sql.ErrNoRows != err {
+		return nil, err
+	}
+	return findSite(name), nil
+}
+
+// checkAbsence alerts watched devices that have been offline on every site
+// for longer than their threshold, and their return
+func checkAbsence() {
+	absenceMu.Lock()
+	defer absenceMu.Unlock()
+
+	states, err := deviceStates()
+	if nil != err {
+		log.Println("Cannot check absent devices:", err)
+		return
+	}
+	watched, err := watchedDevices()
+	if nil != err {
+		log.Println("Cannot check absent devices:", err)
+		return
+	}
+	online := onlineMACs()
+	// Random MACs correlated with a device count as it being online
+	for mac, state := range states {
+		if online[mac] && 0 != len(state.aliasOf) {
+			online[state.aliasOf] = true
+		}
+	}
+	now := historyTime(time.Now())
+	for _, d := range watched {
+		var alert string
+		var absentSince *time.Time
+		switch {
+		case online[d.mac] && d.absentSince.Valid:
+			lastSeen, err := d.lastSeenBefore(d.absentSince.Time)
+			if nil != err {
+				log.Printf("Cannot check whether %s is back: %v", d.mac, err)
+				continue
+			}
+			alert = fmt.Sprintf("Watched client %s is back after %s (MAC=%s)", d.name, now.Sub(lastSeen), d.mac)
+		case !online[d.mac] && !d.absentSince.Valid && d.lastSeen.Valid && now.Sub(d.lastSeen.Time) >= d.threshold:
+			alert = fmt.Sprintf("Watched client %s has been offline for %s (MAC=%s)", d.name,
+				now.Sub(d.lastSeen.Time), d.mac)
+			absentSince = &now
+		default:
+			continue
+		}
+
+		_, err := application.db.Exec("update devices set absent_since = ? where mac = ?", absentSince, d.mac)
+		if nil != err {
+			log.Printf("Cannot record the absence of %s: %v", d.mac, err)
+			continue
+		}
+		log.Println(alert)
+		s, err := lastSite(d.mac)
+		if nil != err {
+			log.Printf("Cannot read the last site of %s: %v", d.mac, err)
+		}
+		if nil != s {
+			sendGroupNotification(s, d.groups, alert)
+		} else {
+			notify(alert)
+		}
+	}
+}
+
+// lastSeenBefore is when the device was last seen before it was alerted as
+// absent. last_seen has moved on by the time it's back, so it's worked out
+// from its sessions.
+func (d watchedDevice) lastSeenBefore(absentSince time.Time) (time.Time, error) {
+	var disconnected sql.NullTime
+	err := application.db.QueryRow(`select disconnected_at from sessions where mac = ? and disconnected_at <= ?
+		order by disconnected_at desc limit 1`, d.mac, absentSince).Scan(&disconnected)
+	if nil != err && sql.ErrNoRows != err {
+		return time.Time{}, err
+	}
+	if !disconnected.Valid {
+		return absentSince, nil
+	}
+	return disconnected.Time, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/router/routertest"
+)
+
+// TestAbsenceDBError checks absence errors are returned for checkAbsence to
+// log instead of stopping the server
+func TestAbsenceDBError(t *testing.T) {
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+
+	// A device that never connected has no last site
+	if s, err := lastSite("00:11:22:33:44:01"); nil != err || nil != s {
+		t.Errorf("got %v, %v for a device without sessions", s, err)
+	}
+	absentSince := time.Now()
+	d := watchedDevice{mac: "00:11:22:33:44:01"}
+	if lastSeen, err := d.lastSeenBefore(absentSince); nil != err || !lastSeen.Equal(absentSince) {
+		t.Errorf("got %s, %v for a device without sessions, want %s", lastSeen, err, absentSince)
+	}
+
+	application.db.Close()
+	if _, err := lastSite(d.mac); nil == err {
+		t.Error("lastSite succeeded without a DB")
+	}
+	if _, err := d.lastSeenBefore(absentSince); nil == err {
+		t.Error("lastSeenBefore succeeded without a DB")
+	}
+	checkAbsence()
+}
@@ -0,0 +1,106 @@
+// Package actions runs actions on clients, such as waking them or probing
+// whether they're reachable. Router drivers can contribute actions of their
+// own by implementing router.ActionRunner.
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// ErrUnknownAction is returned when there's no action with the given name
+var ErrUnknownAction = errors.New("unknown action")
+
+// Sources of an action
+const (
+	SourceServer = "server"
+	SourceRouter = "router"
+)
+
+// Action is something that can be done to a client
+type Action struct {
+	Name        string                                                               `json:"name"`
+	Description string                                                               `json:"description"`
+	Source      string                                                               `json:"source"`
+	Run         func(ctx context.Context, c router.Client, params url.Values) Result `json:"-"`
+}
+
+// Result is what happened when an action ran
+type Result struct {
+	Action  string  `json:"action"`
+	MAC     string  `json:"mac"`
+	Source  string  `json:"source"`
+	OK      bool    `json:"ok"`
+	Message string  `json:"message"`
+	RTT     float64 `json:"rtt_ms,omitempty"` // round trip in milliseconds, for probes
+}
+
+var actions map[string]Action = make(map[string]Action)
+
+// AddAction adds an action the server can run on any client
+func AddAction(action Action) {
+	action.Source = SourceServer
+	actions[action.Name] = action
+}
+
+// List returns the actions that can be run on the router's clients, which
+// are the server's along with any the router contributes. The router may be
+// nil.
+func List(r router.Router) []Action {
+	byName := make(map[string]Action)
+	for name, action := range actions {
+		byName[name] = action
+	}
+	if runner, ok := r.(router.ActionRunner); ok {
+		for _, a := range runner.ClientActions() {
+			byName[a.Name] = Action{Name: a.Name, Description: a.Description, Source: SourceRouter}
+		}
+	}
+	list := make([]Action, 0, len(byName))
+	for _, action := range byName {
+		list = append(list, action)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// FromRouter is whether the router contributes the named action, so Run
+// uses the router for it. The router may be nil.
+func FromRouter(r router.Router, name string) bool {
+	if runner, ok := r.(router.ActionRunner); ok {
+		for _, a := range runner.ClientActions() {
+			if a.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run the named action on the client, preferring the router's action over
+// the server's if it has one. The router may be nil.
+func Run(ctx context.Context, name string, r router.Router, c router.Client, params url.Values) (Result, error) {
+	if FromRouter(r, name) {
+		result := Result{Action: name, MAC: c.MAC, Source: SourceRouter}
+		message, err := r.(router.ActionRunner).RunClientAction(ctx, name, c)
+		if nil != err {
+			result.Message = err.Error()
+		} else {
+			result.OK, result.Message = true, message
+		}
+		return result, nil
+	}
+
+	action, prs := actions[name]
+	if !prs {
+		return Result{}, fmt.Errorf("%w: %s", ErrUnknownAction, name)
+	}
+	result := action.Run(ctx, c, params)
+	result.Action, result.MAC, result.Source = name, c.MAC, SourceServer
+	return result, nil
+}
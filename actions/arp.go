@@ -0,0 +1,103 @@
+package actions
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// ARP operations
+const (
+	arpRequest = 1
+	arpReply   = 2
+)
+
+func init() {
+	log.Println("Registering 'arp' action")
+	AddAction(Action{
+		Name: "arp",
+		Description: "Check the client answers an ARP request on the server's local network, which needs Linux " +
+			"and root or CAP_NET_RAW",
+		Run: func(ctx context.Context, c router.Client, params url.Values) Result {
+			return probe(ctx, c, params, func(ctx context.Context) (time.Duration, error) {
+				return ARPPing(ctx, c.IP, c.MAC)
+			})
+		},
+	})
+}
+
+// ARPPing broadcasts an ARP request for the IPv4 address on the server's
+// interface for its network and waits for the MAC to answer. Any other MAC
+// answering is a different device, so counts as unreachable.
+func ARPPing(ctx context.Context, ip string, mac string) (time.Duration, error) {
+	dst := net.ParseIP(ip).To4()
+	if nil == dst {
+		return 0, fmt.Errorf("%s isn't an IPv4 address", ip)
+	}
+	hw, err := net.ParseMAC(mac)
+	if nil != err {
+		return 0, fmt.Errorf("invalid MAC %s", mac)
+	}
+	ifi, src, err := localInterface(dst)
+	if nil != err {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultProbeTimeout)
+	}
+	return arpPing(deadline, ifi, src, dst, hw)
+}
+
+// localInterface finds the interface whose network the address is on, and
+// the interface's own address on it
+func localInterface(ip net.IP) (*net.Interface, net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if nil != err {
+		return nil, nil, err
+	}
+	for i := range interfaces {
+		ifi := &interfaces[i]
+		if 0 == ifi.Flags&net.FlagUp || 0 != ifi.Flags&net.FlagLoopback || 6 != len(ifi.HardwareAddr) {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if nil != err {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && nil != ipNet.IP.To4() && ipNet.Contains(ip) {
+				return ifi, ipNet.IP.To4(), nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("%s isn't on any of the server's local networks", ip)
+}
+
+// arpPacket builds an Ethernet/IPv4 ARP request from the interface for the
+// address
+func arpPacket(ifi *net.Interface, src net.IP, dst net.IP) []byte {
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint16(b[0:], 1)      // Ethernet
+	binary.BigEndian.PutUint16(b[2:], 0x0800) // IPv4
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:], arpRequest)
+	copy(b[8:], ifi.HardwareAddr)
+	copy(b[14:], src)
+	copy(b[24:], dst)
+	return b
+}
+
+// parseARPReply returns the sender of an ARP reply, or nil if it isn't one
+func parseARPReply(b []byte) (net.HardwareAddr, net.IP) {
+	if len(b) < 28 || 6 != b[4] || 4 != b[5] || arpReply != binary.BigEndian.Uint16(b[6:]) {
+		return nil, nil
+	}
+	return net.HardwareAddr(b[8:14]), net.IP(b[14:18])
+}
@@ -0,0 +1,66 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// arpPing sends the request on a packet socket bound to the interface and
+// reads replies until the deadline
+func arpPing(deadline time.Time, ifi *net.Interface, src net.IP, dst net.IP, hw net.HardwareAddr) (time.Duration, error) {
+	protocol := htons(syscall.ETH_P_ARP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(protocol))
+	if nil != err {
+		return 0, fmt.Errorf("cannot open a packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: ifi.Index}); nil != err {
+		return 0, err
+	}
+	broadcast := &syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: ifi.Index, Halen: 6}
+	copy(broadcast.Addr[:], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+
+	start := time.Now()
+	if err = syscall.Sendto(fd, arpPacket(ifi, src, dst), 0, broadcast); nil != err {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		// A zero receive timeout would block forever
+		remaining := time.Until(deadline)
+		if remaining < time.Millisecond {
+			return 0, ErrUnreachable
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); nil != err {
+			return 0, err
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if syscall.EAGAIN == err || syscall.EINTR == err {
+			continue
+		} else if nil != err {
+			return 0, err
+		}
+		sender, ip := parseARPReply(buf[:n])
+		if nil == sender || !ip.Equal(dst) {
+			continue
+		}
+		if !bytes.Equal(sender, hw) {
+			return 0, fmt.Errorf("%w: %s is %s", ErrUnreachable, dst, sender)
+		}
+		return time.Since(start), nil
+	}
+}
+
+// htons converts to network byte order, returning the value whose bytes in
+// memory are big endian whatever the host's byte order
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
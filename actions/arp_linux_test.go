@@ -0,0 +1,15 @@
+package actions
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestHtons(t *testing.T) {
+	v := htons(syscall.ETH_P_ARP)
+	b := (*[2]byte)(unsafe.Pointer(&v))
+	if 0x08 != b[0] || 0x06 != b[1] {
+		t.Errorf("got bytes % x in memory, want 08 06", b[:])
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package actions
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// arpPing needs Linux packet sockets
+func arpPing(deadline time.Time, ifi *net.Interface, src net.IP, dst net.IP, hw net.HardwareAddr) (time.Duration, error) {
+	return 0, errors.New("ARP probes are only supported on Linux")
+}
@@ -0,0 +1,42 @@
+package actions
+
+import (
+	"net"
+	"testing"
+)
+
+func TestARPPacket(t *testing.T) {
+	hw, _ := net.ParseMAC("00:11:22:33:44:55")
+	ifi := &net.Interface{HardwareAddr: hw}
+	b := arpPacket(ifi, net.IPv4(192, 168, 1, 2).To4(), net.IPv4(192, 168, 1, 3).To4())
+	want := []byte{
+		0, 1, 8, 0, 6, 4, 0, arpRequest,
+		0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 192, 168, 1, 2,
+		0, 0, 0, 0, 0, 0, 192, 168, 1, 3,
+	}
+	if string(b) != string(want) {
+		t.Errorf("got % x, want % x", b, want)
+	}
+
+	// The request isn't a reply
+	if mac, ip := parseARPReply(b); nil != mac || nil != ip {
+		t.Errorf("parsed the request as a reply from %s at %s", mac, ip)
+	}
+}
+
+func TestParseARPReply(t *testing.T) {
+	reply := []byte{
+		0, 1, 8, 0, 6, 4, 0, arpReply,
+		0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF, 192, 168, 1, 3,
+		0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 192, 168, 1, 2,
+	}
+	mac, ip := parseARPReply(reply)
+	if "aa:bb:cc:dd:ee:ff" != mac.String() || "192.168.1.3" != ip.String() {
+		t.Errorf("got %s at %s, want aa:bb:cc:dd:ee:ff at 192.168.1.3", mac, ip)
+	}
+	for _, bad := range [][]byte{reply[:27], append([]byte{0, 1, 8, 0, 8, 4}, reply[6:]...)} {
+		if mac, ip := parseARPReply(bad); nil != mac || nil != ip {
+			t.Errorf("parsed % x as a reply", bad)
+		}
+	}
+}
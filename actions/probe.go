@@ -0,0 +1,203 @@
+package actions
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// DefaultProbeTimeout bounds a probe when the context has no deadline
+const DefaultProbeTimeout = 2 * time.Second
+
+// DefaultTCPPorts are the ports probed when none are given
+var DefaultTCPPorts = []int{80, 443, 22}
+
+// ErrUnreachable is returned when a probe gets no answer
+var ErrUnreachable = errors.New("no answer")
+
+// icmpSequence numbers echo requests so replies can be told apart
+var icmpSequence uint32
+
+func init() {
+	log.Println("Registering 'ping' and 'tcp' actions")
+	AddAction(Action{
+		Name:        "ping",
+		Description: "Check the client answers an ICMP echo request, which needs root or CAP_NET_RAW",
+		Run: func(ctx context.Context, c router.Client, params url.Values) Result {
+			return probe(ctx, c, params, func(ctx context.Context) (time.Duration, error) {
+				return Ping(ctx, c.IP)
+			})
+		},
+	})
+	AddAction(Action{
+		Name:        "tcp",
+		Description: "Check the client answers a TCP connection on any of the comma separated ports",
+		Run: func(ctx context.Context, c router.Client, params url.Values) Result {
+			ports, err := ParsePorts(params.Get("ports"))
+			if nil != err {
+				return Result{Message: err.Error()}
+			}
+			return probe(ctx, c, params, func(ctx context.Context) (time.Duration, error) {
+				return ProbeTCP(ctx, c.IP, ports)
+			})
+		},
+	})
+}
+
+// probe runs a reachability check within the timeout parameter, in seconds
+func probe(ctx context.Context, c router.Client, params url.Values, check func(context.Context) (time.Duration, error)) Result {
+	if 0 == len(c.IP) {
+		return Result{Message: "The client has no IP address"}
+	}
+	timeout := DefaultProbeTimeout
+	if seconds, err := strconv.ParseFloat(params.Get("timeout"), 64); nil == err && seconds > 0 {
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rtt, err := check(ctx)
+	if nil != err {
+		return Result{Message: fmt.Sprintf("%s is unreachable: %v", c.IP, err)}
+	}
+	return Result{OK: true, Message: fmt.Sprintf("%s answered in %s", c.IP, rtt.Round(time.Microsecond)),
+		RTT: float64(rtt) / float64(time.Millisecond)}
+}
+
+// ParsePorts parses a comma separated list of ports, defaulting to
+// DefaultTCPPorts
+func ParsePorts(raw string) ([]int, error) {
+	if 0 == len(strings.TrimSpace(raw)) {
+		return DefaultTCPPorts, nil
+	}
+	ports := make([]int, 0)
+	for _, p := range strings.Split(raw, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if nil != err || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %s", p)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// ProbeTCP connects to each port in turn, returning how long the first
+// answer took. A refused connection is an answer.
+func ProbeTCP(ctx context.Context, ip string, ports []int) (time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultProbeTimeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	for _, port := range ports {
+		start := time.Now()
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+		if nil == err {
+			conn.Close()
+			return time.Since(start), nil
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return time.Since(start), nil
+		}
+		if nil != ctx.Err() {
+			break
+		}
+	}
+	return 0, ErrUnreachable
+}
+
+// Ping sends an ICMP echo request to the IPv4 address and waits for the
+// reply. Raw sockets need root or CAP_NET_RAW.
+func Ping(ctx context.Context, ip string) (time.Duration, error) {
+	dst := net.ParseIP(ip).To4()
+	if nil == dst {
+		return 0, fmt.Errorf("%s isn't an IPv4 address", ip)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultProbeTimeout)
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if nil != err {
+		return 0, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+	conn.SetDeadline(deadline)
+
+	id := uint16(os.Getpid())
+	seq := uint16(atomic.AddUint32(&icmpSequence, 1))
+	start := time.Now()
+	if _, err = conn.WriteTo(echoRequest(id, seq), &net.IPAddr{IP: dst}); nil != err {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if nil != err {
+			if nil != ctx.Err() || isTimeout(err) {
+				return 0, ErrUnreachable
+			}
+			return 0, err
+		}
+		addr, ok := from.(*net.IPAddr)
+		if !ok || !addr.IP.Equal(dst) || n < 8 {
+			continue
+		}
+		// An echo reply is type 0, with our identifier and sequence number
+		if 0 == buf[0] && id == binary.BigEndian.Uint16(buf[4:]) && seq == binary.BigEndian.Uint16(buf[6:]) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// echoRequest builds an ICMP echo request
+func echoRequest(id uint16, seq uint16) []byte {
+	b := make([]byte, 16)
+	b[0] = 8 // echo request
+	binary.BigEndian.PutUint16(b[4:], id)
+	binary.BigEndian.PutUint16(b[6:], seq)
+	copy(b[8:], "wcwprobe")
+	binary.BigEndian.PutUint16(b[2:], checksum(b))
+	return b
+}
+
+// checksum is the internet checksum of the message
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if 1 == len(b)%2 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,66 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// Where magic packets are sent unless the broadcast and port parameters say
+// otherwise
+const (
+	defaultWakeBroadcast = "255.255.255.255"
+	defaultWakePort      = "9"
+)
+
+func init() {
+	log.Println("Registering 'wol' action")
+	AddAction(Action{
+		Name:        "wol",
+		Description: "Wake the client by broadcasting a magic packet from the server",
+		Run:         wake,
+	})
+}
+
+// MagicPacket returns the wake on LAN packet for the MAC: six 0xFF bytes
+// followed by the MAC sixteen times
+func MagicPacket(mac string) ([]byte, error) {
+	hw, err := net.ParseMAC(mac)
+	if nil != err || 6 != len(hw) {
+		return nil, fmt.Errorf("invalid MAC %s", mac)
+	}
+	packet := bytes.Repeat([]byte{0xFF}, 6)
+	return append(packet, bytes.Repeat(hw, 16)...), nil
+}
+
+func wake(ctx context.Context, c router.Client, params url.Values) Result {
+	packet, err := MagicPacket(c.MAC)
+	if nil != err {
+		return Result{Message: err.Error()}
+	}
+	broadcast, port := params.Get("broadcast"), params.Get("port")
+	if 0 == len(broadcast) {
+		broadcast = defaultWakeBroadcast
+	}
+	if 0 == len(port) {
+		port = defaultWakePort
+	}
+	address := net.JoinHostPort(strings.TrimSpace(broadcast), strings.TrimSpace(port))
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp4", address)
+	if nil != err {
+		return Result{Message: fmt.Sprintf("Cannot send a magic packet to %s: %v", address, err)}
+	}
+	defer conn.Close()
+	if _, err = conn.Write(packet); nil != err {
+		return Result{Message: fmt.Sprintf("Cannot send a magic packet to %s: %v", address, err)}
+	}
+	return Result{OK: true, Message: fmt.Sprintf("Sent a magic packet for %s to %s", c.MAC, address)}
+}
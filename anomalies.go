@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/events"
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// anomalyType is the kind of suspicious change the detector found
+type anomalyType string
+
+// Anomaly types. Each is notified unless its notify_<type> preference is
+// false.
+const (
+	// anomalyIPConflict is two MACs claiming the same IP
+	anomalyIPConflict anomalyType = "ip_conflict"
+	// anomalyHostnameChange is a known MAC reporting a different hostname
+	anomalyHostnameChange anomalyType = "hostname_change"
+	// anomalyVendorMismatch is a known MAC reporting a different vendor
+	anomalyVendorMismatch anomalyType = "vendor_mismatch"
+	// anomalyNameReuse is a trusted device's hostname on a MAC that isn't
+	// trusted
+	anomalyNameReuse anomalyType = "name_reuse"
+)
+
+var anomalyTypes = []anomalyType{anomalyIPConflict, anomalyHostnameChange, anomalyVendorMismatch, anomalyNameReuse}
+
+// anomaly is a suspicious change seen on a site
+type anomaly struct {
+	Type    anomalyType `json:"type"`
+	Site    string      `json:"site"`
+	MAC     string      `json:"mac"`
+	At      time.Time   `json:"at"`
+	Message string      `json:"message"`
+	// key identifies an ongoing anomaly so it's only raised once
+	key string
+}
+
+// knownDevice is what the inventory last recorded about a MAC
+type knownDevice struct {
+	status   string
+	hostname string
+	vendor   string
+}
+
+// readAnomalies creates the anomalies table and corrects the stored vendors
+// from the OUI registry, so the vendors clients are now reported with aren't
+// mistaken for vendor mismatches
+func readAnomalies(app *wifiClientWatchApp) {
+	sqlStmt := `
+	create table IF NOT EXISTS anomalies (id integer primary key autoincrement, at timestamp not null,
+		type text not null, site text not null, mac text not null, message text);
+	create index IF NOT EXISTS anomalies_at on anomalies (at);
+	`
+	_, err := app.db.Exec(sqlStmt)
+	if err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+		return
+	}
+
+	rows, err := app.db.Query("select mac, vendor from devices where vendor is not null and vendor != ''")
+	if err != nil {
+		log.Fatal(err)
+	}
+	clients := make([]router.Client, 0)
+	for rows.Next() {
+		var c router.Client
+		if err = rows.Scan(&c.MAC, &c.Vendor); err != nil {
+			log.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	rows.Close()
+	stored := make(map[string]string)
+	for _, c := range clients {
+		stored[c.MAC] = c.Vendor
+	}
+	router.LookupVendors(clients)
+	for _, c := range clients {
+		if stored[c.MAC] == c.Vendor {
+			continue
+		}
+		_, err = app.db.Exec("update devices set vendor = nullif(?, '') where mac = ?", c.Vendor, c.MAC)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// knownDevices reads the inventory's last hostname, vendor and status of
+// every device
+func knownDevices() (map[string]knownDevice, error) {
+	known := make(map[string]knownDevice)
+	rows, err := application.db.Query(`select d.mac, coalesce(p.status, d.status), d.hostname, d.vendor from devices d
+		left join devices p on p.mac = d.alias_of`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mac string
+		var d knownDevice
+		var hostname, vendor sql.NullString
+		if err = rows.Scan(&mac, &d.status, &hostname, &vendor); err != nil {
+			return nil, err
+		}
+		d.hostname, d.vendor = hostname.String, vendor.String
+		known[mac] = d
+	}
+	return known, rows.Err()
+}
+
+// detectAnomalies compares a poll's clients to the inventory
+func detectAnomalies(s *site, clients []router.Client, known map[string]knownDevice) []anomaly {
+	now := historyTime(time.Now())
+	anomalies := make([]anomaly, 0)
+	add := func(t anomalyType, mac string, key string, format string, args ...interface{}) {
+		anomalies = append(anomalies, anomaly{
+			Type: t, Site: s.Name, MAC: mac, At: now, Message: fmt.Sprintf(format, args...),
+			key: fmt.Sprintf("%s|%s", t, key),
+		})
+	}
+
+	// Trusted hostnames and the MACs they belong to
+	trustedNames := make(map[string]string)
+	for mac, d := range known {
+		if deviceTrusted == d.status && 0 != len(d.hostname) {
+			trustedNames[d.hostname] = mac
+		}
+	}
+
+	ips := make(map[string]router.Client)
+	for _, c := range clients {
+		d, isKnown := known[c.MAC]
+
+		if c.Online && 0 != len(c.IP) {
+			if other, prs := ips[c.IP]; prs {
+				add(anomalyIPConflict, c.MAC, c.IP, "%s (MAC=%s) and %s (MAC=%s) both claim IP %s",
+					other.Name, other.MAC, c.Name, c.MAC, c.IP)
+			} else {
+				ips[c.IP] = c
+			}
+		}
+
+		if isKnown && 0 != len(d.hostname) && 0 != len(c.Name) && d.hostname != c.Name {
+			add(anomalyHostnameChange, c.MAC, c.MAC+"|"+c.Name, "%s (MAC=%s) changed its hostname from %s",
+				c.Name, c.MAC, d.hostname)
+		}
+
+		if isKnown && 0 != len(d.vendor) && 0 != len(c.Vendor) && d.vendor != c.Vendor {
+			add(anomalyVendorMismatch, c.MAC, c.MAC+"|"+c.Vendor, "%s (MAC=%s) reports vendor %s instead of %s",
+				c.Name, c.MAC, c.Vendor, d.vendor)
+		}
+
+		if owner, prs := trustedNames[c.Name]; prs && owner != c.MAC && deviceTrusted != d.status {
+			add(anomalyNameReuse, c.MAC, c.MAC+"|"+c.Name, "%s (MAC=%s) uses the name of trusted device %s",
+				c.Name, c.MAC, owner)
+		}
+	}
+	return anomalies
+}
+
+// raiseAnomalies records and notifies the anomalies that weren't already
+// raised on the site, and forgets the ones that have cleared up
+func raiseAnomalies(s *site, anomalies []anomaly, known map[string]knownDevice) {
+	active := make(map[string]bool)
+	for _, a := range anomalies {
+		active[a.key] = true
+		if s.anomalies[a.key] {
+			continue
+		}
+
+		log.Printf("Anomaly %s on site %s: %s", a.Type, s.Name, a.Message)
+		_, err := application.db.Exec("insert into anomalies (at, type, site, mac, message) values (?,?,?,?,?)",
+			a.At, a.Type, a.Site, a.MAC, a.Message)
+		if err != nil {
+			log.Printf("Cannot record anomaly %s: %v", a.Type, err)
+		}
+		publishEvent(s, events.TypeAnomaly, a.MAC, a.Message, a)
+		if deviceIgnored != known[a.MAC].status && notifyAnomaly(s, a.Type) {
+			sendNotification(s, a.Message)
+		}
+	}
+	s.anomalies = active
+}
+
+// notifyAnomaly is whether the site notifies about the anomaly type
+func notifyAnomaly(s *site, t anomalyType) bool {
+	raw, prs := s.preference(fmt.Sprintf("notify_%s", t))
+	if !prs {
+		return true
+	}
+	notify, err := strconv.ParseBool(*raw)
+	return nil != err || notify
+}
+
+// anomaliesHandler returns the most recent anomalies, optionally filtered by
+// the type, site and mac query parameters
+func anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling anomalies request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	query := r.URL.Query()
+	mac := canonicalMAC(query.Get("mac"))
+	rows, err := application.db.Query(`select type, site, mac, at, message from anomalies
+		where (? = '' or type = ?) and (? = '' or site = ?) and (? = '' or mac = ?) order by at desc, id desc limit 500`,
+		query.Get("type"), query.Get("type"), query.Get("site"), query.Get("site"), mac, mac)
+	if nil != err {
+		log.Println("Cannot read anomalies:", err)
+		http.Error(w, "Cannot read anomalies", 500)
+		return
+	}
+	defer rows.Close()
+	anomalies := make([]anomaly, 0)
+	for rows.Next() {
+		var a anomaly
+		var message sql.NullString
+		if err = rows.Scan(&a.Type, &a.Site, &a.MAC, &a.At, &message); nil != err {
+			log.Println("Cannot read anomaly:", err)
+			http.Error(w, "Cannot read anomalies", 500)
+			return
+		}
+		a.Message = message.String
+		anomalies = append(anomalies, a)
+	}
+
+	b, err := json.Marshal(anomalies)
+	if err != nil {
+		http.Error(w, "Cannot read anomalies", 500)
+	} else {
+		w.Write(b)
+	}
+}
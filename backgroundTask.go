@@ -1,77 +1,163 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"strconv"
-	"sync"
 	"time"
+
+	"github.com/disrvptor/wifi_client_watch/events"
+	"github.com/disrvptor/wifi_client_watch/scheduler"
 )
 
-var _backgroundFunc func()
-var _backgroundTask sync.WaitGroup
+// pollJobName is the name of the job that polls a site
+func pollJobName(s *site) string {
+	return fmt.Sprintf("poll:%s", s.Name)
+}
 
-func restartBackgroundTask(oldValue *string, newValue *string) {
-	log.Println("Restart background task")
-	if nil == _backgroundFunc {
+// scheduleAllSites (re)schedules polling on every site
+func scheduleAllSites(oldValue *string, newValue *string) {
+	for _, s := range application.allSites() {
+		scheduleSite(s)
+	}
+}
+
+// scheduleSite (re)schedules polling of the site using its poll_time,
+// cancelling any poll in progress
+func scheduleSite(s *site) {
+	rawPt, prs := s.preference("poll_time")
+	if !prs {
+		log.Printf("No poll_time preference defined for site %s", s.Name)
+		return
+	}
+	pollTime, err := strconv.Atoi(*rawPt)
+	if nil != err || pollTime <= 0 {
+		log.Printf("Invalid poll_time %s for site %s", *rawPt, s.Name)
 		return
 	}
 
-	log.Println("Stopping background task")
-	// wg := sync.WaitGroup{}
-	// wg.Add(1)
-	// go func() {
-	// 	stopBackgroundTask()
-	// 	wg.Done()
-	// }()
-	go stopBackgroundTask()
+	interval := time.Duration(pollTime) * time.Second
+	err = application.scheduler.Add(scheduler.Job{
+		Name:     pollJobName(s),
+		Interval: interval,
+		// Spread out sites sharing a poll_time
+		Jitter:     interval / 10,
+		MaxBackoff: time.Duration(sitePreferenceInt(s, "max_backoff", 0)) * time.Second,
+		Override: func() time.Duration {
+			return fastPollInterval(s)
+		},
+		Run: func(ctx context.Context) error {
+			return pollSite(ctx, s)
+		},
+	})
+	if nil != err {
+		log.Printf("Cannot schedule site %s: %v", s.Name, err)
+	}
+}
 
-	log.Println("Waiting for background task to stop")
+// pollSite checks the site's clients, tracking consecutive failures so the
+// router is reported unreachable after unreachable_after of them and
+// recovered once a poll succeeds again
+func pollSite(ctx context.Context, s *site) error {
+	err := checkClients(ctx, s)
+	if errors.Is(err, context.Canceled) {
+		// Polling was stopped or rescheduled, which says nothing about the
+		// router
+		return err
+	}
 
-	// wg.Wait()
-	_backgroundTask.Wait()
-	log.Println("Restarting background task")
-	startBackgroundTask(_backgroundFunc)
-}
+	if nil != err {
+		s.failures++
+		threshold := sitePreferenceInt(s, "unreachable_after", 3)
+		if !s.unreachable && threshold > 0 && s.failures >= threshold {
+			s.unreachable = true
+			log.Printf("Router for site %s is unreachable after %d failed polls", s.Name, s.failures)
+			sendNotification(s, fmt.Sprintf("Router is unreachable after %d failed polls: %v", s.failures, err))
+		}
+		publishEvent(s, events.TypeRouterError, "", err.Error(),
+			routerErrorData{Failures: s.failures, Unreachable: s.unreachable})
+		return err
+	}
 
-func stopBackgroundTask() {
-	application.ticker.Stop()
-	application.stopPoller <- true
+	if s.unreachable {
+		log.Printf("Router for site %s recovered after %d failed polls", s.Name, s.failures)
+		sendNotification(s, fmt.Sprintf("Router recovered after %d failed polls", s.failures))
+	}
+	s.failures = 0
+	s.unreachable = false
+	return nil
 }
 
-func startBackgroundTask(f func()) {
-	// rawPt, prs := getPreference("poll_time")
-	rawPt, prs := application.preferences.Get("poll_time")
-	if !prs {
-		log.Fatalf("No poll_time preference defined (%s)", *rawPt)
-	} else {
-		pollTime, _ := strconv.Atoi(*rawPt)
-		log.Printf("Starting background process, polling every %d seconds", pollTime)
-		application.ticker = time.NewTicker(time.Duration(pollTime) * time.Second)
-		application.stopPoller = make(chan bool)
+// fastPollInterval is the site's fast_poll_time while it's fast polling after
+// a new client, or 0 otherwise
+func fastPollInterval(s *site) time.Duration {
+	if time.Now().After(s.fastUntil) {
+		return 0
+	}
+	return time.Duration(sitePreferenceInt(s, "fast_poll_time", 0)) * time.Second
+}
 
-		_backgroundFunc = f
-		_backgroundTask = sync.WaitGroup{}
-		_backgroundTask.Add(1)
+// startFastPolling polls the site every fast_poll_time for
+// fast_poll_duration, if fast_poll_time is set
+func startFastPolling(s *site) {
+	if sitePreferenceInt(s, "fast_poll_time", 0) <= 0 {
+		return
+	}
+	duration := time.Duration(sitePreferenceInt(s, "fast_poll_duration", 300)) * time.Second
+	s.fastUntil = time.Now().Add(duration)
+	log.Printf("Fast polling site %s until %s", s.Name, s.fastUntil.Format(time.RFC3339))
+}
 
-		stopLoop := false
+// sitePreferenceInt returns the site's integer preference, or def if it's
+// missing or invalid
+func sitePreferenceInt(s *site, name string, def int) int {
+	raw, prs := s.preference(name)
+	if !prs {
+		return def
+	}
+	value, err := strconv.Atoi(*raw)
+	if nil != err {
+		return def
+	}
+	return value
+}
 
-		go func() {
-			log.Println("Entering background task loop")
-			for {
-				select {
-				case <-application.stopPoller:
-					stopLoop = true
-					break
-				case <-application.ticker.C:
-					f()
-				}
+// unscheduleSite stops polling the site, cancelling any poll in progress
+func unscheduleSite(s *site) {
+	application.scheduler.Remove(pollJobName(s))
+}
 
-				if stopLoop {
-					break
-				}
-			}
-			log.Println("Exiting background task loop")
-			_backgroundTask.Done()
-		}()
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling jobs request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	switch r.URL.Query().Get("action") {
+	case "run":
+		name := r.URL.Query().Get("name")
+		err := application.scheduler.RunNow(name)
+		if errors.Is(err, scheduler.ErrUnknownJob) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, scheduler.ErrRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		b, err := json.Marshal(message{Message: "ok"})
+		if err != nil {
+			http.Error(w, "Cannot create ok message", 500)
+		} else {
+			w.Write(b)
+		}
+	default:
+		b, err := json.Marshal(application.scheduler.Jobs())
+		if err != nil {
+			http.Error(w, "Cannot read jobs", 500)
+		} else {
+			w.Write(b)
+		}
 	}
 }
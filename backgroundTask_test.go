@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/disrvptor/wifi_client_watch/router/routertest"
+)
+
+// TestPollSiteUnreachable fails more polls than unreachable_after and then
+// recovers, checking the router is reported unreachable and recovered once
+// each
+func TestPollSiteUnreachable(t *testing.T) {
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+	application.preferences.Set("unreachable_after", "3")
+	s := findSite(defaultSite)
+
+	fake.SetMalformed(true)
+	for i := 1; i <= 5; i++ {
+		if err := pollSite(context.Background(), s); nil == err {
+			t.Fatalf("poll %d succeeded against a malformed response", i)
+		}
+		if want := i >= 3; s.unreachable != want {
+			t.Errorf("poll %d: unreachable is %t, want %t", i, s.unreachable, want)
+		}
+	}
+	fake.SetMalformed(false)
+	for i := 1; i <= 2; i++ {
+		if err := pollSite(context.Background(), s); nil != err {
+			t.Fatalf("poll %d after recovering: %v", i, err)
+		}
+	}
+	if s.unreachable || 0 != s.failures {
+		t.Errorf("got unreachable %t after %d failures, want the site reset", s.unreachable, s.failures)
+	}
+
+	application.outbox.Flush(context.Background())
+	var unreachable, recovered int
+	for _, message := range testNotification.Messages() {
+		if strings.Contains(message, "Router is unreachable after 3 failed polls") {
+			unreachable++
+		}
+		if strings.Contains(message, "Router recovered after 5 failed polls") {
+			recovered++
+		}
+	}
+	if 1 != unreachable || 1 != recovered {
+		t.Errorf("got notifications %q, want one unreachable and one recovered", testNotification.Messages())
+	}
+}
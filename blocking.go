@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// blockTimeout bounds blocking or unblocking a client on a router
+const blockTimeout = 60 * time.Second
+
+// blockResult is how blocking or unblocking went on a site
+type blockResult struct {
+	Site  string `json:"site"`
+	Error string `json:"error,omitempty"`
+	err   error
+}
+
+// readBlocking adds the devices' blocked column
+func readBlocking(app *wifiClientWatchApp) {
+	if err := addMissingColumns(app.db, "devices", []string{"blocked bool not null default 0"}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setBlocked blocks or unblocks the client on the site's router. The caller
+// must hold the site's routerMu.
+func (s *site) setBlocked(ctx context.Context, mac string, block bool) error {
+	rtr, err := s.currentRouter()
+	if nil != err {
+		return err
+	}
+	blocker, ok := rtr.(router.Blocker)
+	if !ok {
+		return fmt.Errorf("%w: %s can't block clients", router.ErrNotSupported, s.driver)
+	}
+	if err = blocker.Connect(ctx); nil != err {
+		return err
+	}
+	if block {
+		return blocker.Block(ctx, mac)
+	}
+	return blocker.Unblock(ctx, mac)
+}
+
+// blockSites returns the named site, or the sites the client is on, or every
+// site if it isn't on any
+func blockSites(mac string, name string) []*site {
+	if 0 != len(name) {
+		if s := findSite(name); nil != s {
+			return []*site{s}
+		}
+		return []*site{}
+	}
+	sites := make([]*site, 0)
+	for _, s := range application.allSites() {
+		s.mu.Lock()
+		if nil != findClient(mac, s.clients) {
+			sites = append(sites, s)
+		}
+		s.mu.Unlock()
+	}
+	if 0 == len(sites) {
+		return application.allSites()
+	}
+	return sites
+}
+
+// blockClient blocks or unblocks the client on the sites, recording it in
+// the inventory if any of them succeeded. The error is from recording it.
+func blockClient(mac string, sites []*site, block bool, by string, reason string) ([]blockResult, bool, error) {
+	results := make([]blockResult, 0, len(sites))
+	succeeded := false
+	for _, s := range sites {
+		ctx, cancel := context.WithTimeout(context.Background(), blockTimeout)
+		s.routerMu.Lock()
+		err := s.setBlocked(ctx, mac, block)
+		s.routerMu.Unlock()
+		cancel()
+
+		result := blockResult{Site: s.Name}
+		if nil != err {
+			log.Printf("Cannot block %s on site %s: %v", mac, s.Name, err)
+			result.Error, result.err = err.Error(), err
+		} else {
+			succeeded = true
+		}
+		results = append(results, result)
+	}
+	if succeeded {
+		blocked := "0"
+		if block {
+			blocked = "1"
+		}
+		if err := updateDevice(mac, map[string]string{"blocked": blocked}, by, reason); nil != err {
+			return results, succeeded, err
+		}
+	}
+	return results, succeeded, nil
+}
+
+// autoBlockWindow is how long a new device has to be approved before it's
+// blocked, or 0 if the site doesn't block new devices
+func autoBlockWindow(s *site) time.Duration {
+	if enabled, prs := s.preference("auto_block"); !prs || "true" != *enabled {
+		return 0
+	}
+	return time.Duration(sitePreferenceInt(s, "auto_block_after", 300)) * time.Second
+}
+
+// announceAutoBlock warns that a client seen for the first time will be
+// blocked unless it's approved
+func announceAutoBlock(s *site, c router.Client) {
+	window := autoBlockWindow(s)
+	if 0 == window {
+		return
+	}
+	if status, err := deviceStatus(c.MAC); nil != err {
+		log.Printf("Cannot read the status of %s: %v", c.MAC, err)
+		return
+	} else if deviceNew != status {
+		return
+	}
+	sendNotification(s, fmt.Sprintf("New client %s (MAC=%s, IP=%s) will be blocked in %s unless it's approved",
+		c.Name, c.MAC, c.IP, window))
+}
+
+// autoBlock blocks the site's online clients that are still new once the
+// approval window is up. Clients that have been unblocked aren't blocked
+// again. The caller must hold the site's routerMu.
+func autoBlock(ctx context.Context, s *site, clients []router.Client) {
+	window := autoBlockWindow(s)
+	if 0 == window {
+		return
+	}
+	online := make(map[string]router.Client)
+	for _, c := range clients {
+		if c.Online {
+			online[c.MAC] = c
+		}
+	}
+	rows, err := application.db.Query(`select mac from devices d where status = ? and alias_of is null
+		and first_seen <= ? and not exists (select 1 from device_audit a where a.mac = d.mac and a.field = 'blocked')`,
+		deviceNew, historyTime(time.Now().Add(-window)))
+	if nil != err {
+		log.Printf("Cannot read the new devices to block on site %s: %v", s.Name, err)
+		return
+	}
+	macs := make([]string, 0)
+	for rows.Next() {
+		var mac string
+		if err = rows.Scan(&mac); nil != err {
+			log.Printf("Cannot read a new device to block on site %s: %v", s.Name, err)
+			continue
+		}
+		if _, prs := online[mac]; prs {
+			macs = append(macs, mac)
+		}
+	}
+	if err = rows.Err(); nil != err {
+		log.Printf("Cannot read the new devices to block on site %s: %v", s.Name, err)
+	}
+	rows.Close()
+
+	for _, mac := range macs {
+		c := online[mac]
+		if err = s.setBlocked(ctx, mac, true); nil != err {
+			log.Printf("Cannot block %s on site %s: %v", mac, s.Name, err)
+			continue
+		}
+		if err = updateDevice(mac, map[string]string{"blocked": "1"}, "auto_block", "not approved in time"); nil != err {
+			log.Printf("Cannot record that %s was blocked: %v", mac, err)
+			continue
+		}
+		sendNotification(s, fmt.Sprintf("Blocked new client %s (MAC=%s, IP=%s) that wasn't approved within %s",
+			c.Name, c.MAC, c.IP, window))
+	}
+}
+
+// clientBlockHandler serves POST /clients/{mac}/block and unblock, on the
+// site query parameter or every site the client is on
+func clientBlockHandler(w http.ResponseWriter, r *http.Request, rawMAC string, block bool) {
+	log.Printf("Handling client block request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	if http.MethodPost != r.Method {
+		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mac := canonicalMAC(rawMAC)
+	sites := blockSites(mac, r.URL.Query().Get("site"))
+	if 0 == len(sites) {
+		http.Error(w, "Unknown site", http.StatusNotFound)
+		return
+	}
+	results, succeeded, err := blockClient(mac, sites, block, r.RemoteAddr, r.URL.Query().Get("reason"))
+	if nil != err {
+		log.Printf("Cannot record blocking %s: %v", mac, err)
+		http.Error(w, "Cannot record blocking the client", http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if !succeeded {
+		status = http.StatusNotImplemented
+		for _, result := range results {
+			if !errors.Is(result.err, router.ErrNotSupported) {
+				status = http.StatusBadGateway
+			}
+		}
+	}
+	b, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, "Cannot block client", 500)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
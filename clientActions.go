@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/actions"
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// actionTimeout bounds running an action on a client
+const actionTimeout = 30 * time.Second
+
+// actionTarget finds the client an action is for, on the named site or the
+// first site it's on. Clients that aren't on any site are looked up in the
+// inventory and have no site. It returns errUnknownDevice if the client
+// can't be found.
+func actionTarget(mac string, name string) (router.Client, *site, error) {
+	for _, s := range application.allSites() {
+		if 0 != len(name) && name != s.Name {
+			continue
+		}
+		s.mu.Lock()
+		c := findClient(mac, s.clients)
+		s.mu.Unlock()
+		if nil != c {
+			return *c, s, nil
+		}
+	}
+	var s *site
+	if 0 != len(name) {
+		if s = findSite(name); nil == s {
+			return router.Client{}, nil, fmt.Errorf("%w: %s isn't on site %s", errUnknownDevice, mac, name)
+		}
+	}
+
+	var hostname, ip, vendor sql.NullString
+	err := application.db.QueryRow("select hostname, ip, vendor from devices where mac = ?", mac).
+		Scan(&hostname, &ip, &vendor)
+	if sql.ErrNoRows == err {
+		return router.Client{}, nil, fmt.Errorf("%w: %s", errUnknownDevice, mac)
+	} else if nil != err {
+		return router.Client{}, nil, err
+	}
+	return router.Client{MAC: mac, Name: hostname.String, IP: ip.String, Vendor: vendor.String}, s, nil
+}
+
+// siteRouter returns the site's router, or nil if it can't be created. The
+// caller must hold the site's routerMu.
+func siteRouter(s *site) router.Router {
+	if nil == s {
+		return nil
+	}
+	rtr, err := s.currentRouter()
+	if nil != err {
+		log.Printf("Cannot create the router for site %s: %v", s.Name, err)
+		return nil
+	}
+	return rtr
+}
+
+// actionRouter returns the router whose actions the site's clients have,
+// creating it if the site hasn't been polled yet. It's only for listing the
+// actions, since a poll can replace it at any time.
+func actionRouter(s *site) router.Router {
+	if nil == s {
+		return nil
+	}
+	s.mu.Lock()
+	rtr := s.actionRouter
+	s.mu.Unlock()
+	if nil != rtr {
+		return rtr
+	}
+	s.routerMu.Lock()
+	defer s.routerMu.Unlock()
+	return siteRouter(s)
+}
+
+// runClientAction runs the action on the client. Only actions the router
+// provides hold the site's routerMu, while they use the router, so probing
+// or waking a client doesn't hold up polling the site.
+func runClientAction(ctx context.Context, s *site, rtr router.Router, name string, c router.Client,
+	params url.Values) (actions.Result, error) {
+	if !actions.FromRouter(rtr, name) {
+		return actions.Run(ctx, name, nil, c, params)
+	}
+
+	s.routerMu.Lock()
+	defer s.routerMu.Unlock()
+	// A poll may have replaced the router since it was looked up
+	if rtr = siteRouter(s); nil == rtr {
+		return actions.Run(ctx, name, nil, c, params)
+	}
+	if err := rtr.Connect(ctx); nil != err {
+		log.Printf("Cannot connect to the router for site %s: %v", s.Name, err)
+	}
+	return actions.Run(ctx, name, rtr, c, params)
+}
+
+// clientActionsHandler serves GET /clients/{mac}/actions, listing the actions
+// that can be run on the client, and POST /clients/{mac}/actions/{name},
+// running one. The site query parameter picks the site whose router
+// contributes actions; the rest are passed to the action.
+func clientActionsHandler(w http.ResponseWriter, r *http.Request, rawMAC string, name string) {
+	log.Printf("Handling client actions request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	if 0 != len(name) && http.MethodPost != r.Method {
+		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mac := canonicalMAC(rawMAC)
+	c, s, err := actionTarget(mac, r.URL.Query().Get("site"))
+	if errors.Is(err, errUnknownDevice) {
+		http.Error(w, "Unknown client", http.StatusNotFound)
+		return
+	} else if nil != err {
+		log.Printf("Cannot look up client %s: %v", mac, err)
+		http.Error(w, "Cannot run client action", http.StatusInternalServerError)
+		return
+	}
+	rtr := actionRouter(s)
+
+	var result interface{}
+	if 0 == len(name) {
+		result = actions.List(rtr)
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), actionTimeout)
+		defer cancel()
+		var res actions.Result
+		res, err = runClientAction(ctx, s, rtr, name, c, r.URL.Query())
+		if nil == err {
+			log.Printf("Ran %s on %s: %s", name, mac, res.Message)
+		}
+		result = res
+	}
+
+	if errors.Is(err, actions.ErrUnknownAction) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Cannot run client action", 500)
+	} else {
+		w.Write(b)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/actions"
+	"github.com/disrvptor/wifi_client_watch/router"
+	"github.com/disrvptor/wifi_client_watch/router/routertest"
+)
+
+// runAction posts the action for the MAC, returning its result
+func runAction(t *testing.T, mac string, action string, query string) actions.Result {
+	w := httptest.NewRecorder()
+	clientPathHandler(w, httptest.NewRequest(http.MethodPost,
+		fmt.Sprintf("/clients/%s/actions/%s?%s", mac, action, query), nil))
+	if http.StatusOK != w.Code {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var result actions.Result
+	if err := json.Unmarshal(w.Body.Bytes(), &result); nil != err {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestClientActionsRouterLock(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	mac := "00:11:22:33:44:01"
+	fake.SetClients(router.Client{MAC: mac, Name: "laptop", IP: "127.0.0.1", Online: true})
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+	s := findSite(defaultSite)
+	if err = checkClients(context.Background(), s); nil != err {
+		t.Fatal(err)
+	}
+
+	// Server actions don't wait for a poll holding the router
+	s.routerMu.Lock()
+	done := make(chan actions.Result)
+	go func() {
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		done <- runAction(t, mac, "tcp", "ports="+port)
+	}()
+	select {
+	case result := <-done:
+		if !result.OK || actions.SourceServer != result.Source {
+			t.Errorf("got %+v, want the server's tcp probe to succeed", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the server action waited for the router")
+	}
+	s.routerMu.Unlock()
+
+	// Router actions do
+	s.routerMu.Lock()
+	go func() {
+		done <- runAction(t, mac, "wol", "")
+	}()
+	select {
+	case <-done:
+		t.Error("the router action didn't wait for the router")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.routerMu.Unlock()
+	result := <-done
+	if !result.OK || actions.SourceRouter != result.Source {
+		t.Errorf("got %+v, want the router's wol to succeed", result)
+	}
+	if woken := fake.Woken(); 1 != len(woken) {
+		t.Errorf("the router woke %v, want %s", woken, mac)
+	}
+}
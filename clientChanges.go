@@ -0,0 +1,53 @@
+package main
+
+import "github.com/disrvptor/wifi_client_watch/router"
+
+// changeKind is how a client changed between two polls
+type changeKind string
+
+// Kinds of client changes
+const (
+	clientNew     changeKind = "new"
+	clientOnline  changeKind = "online"
+	clientOffline changeKind = "offline"
+	clientDropped changeKind = "dropped"
+	clientRoamed  changeKind = "roamed"
+)
+
+// clientChange is a difference between two polls of a site's clients.
+// Client is the client from the latest poll, except for dropped clients
+// where it's the last one seen.
+type clientChange struct {
+	Kind     changeKind
+	Client   router.Client
+	Previous *router.Client
+}
+
+// diffClients compares the clients from the previous poll to the current
+// ones
+func diffClients(previous []router.Client, current []router.Client) []clientChange {
+	changes := make([]clientChange, 0)
+
+	for _, c := range previous {
+		c2 := findClient(c.MAC, current)
+		prev := c
+		if nil == c2 {
+			changes = append(changes, clientChange{Kind: clientDropped, Client: c, Previous: &prev})
+		} else if c.Online && !c2.Online {
+			changes = append(changes, clientChange{Kind: clientOffline, Client: *c2, Previous: &prev})
+		} else if c2.Online && 0 != len(c.Node) && 0 != len(c2.Node) && c.Node != c2.Node {
+			changes = append(changes, clientChange{Kind: clientRoamed, Client: *c2, Previous: &prev})
+		}
+	}
+
+	for _, c := range current {
+		c2 := findClient(c.MAC, previous)
+		if nil == c2 {
+			changes = append(changes, clientChange{Kind: clientNew, Client: c})
+		} else if !c2.Online && c.Online {
+			changes = append(changes, clientChange{Kind: clientOnline, Client: c, Previous: c2})
+		}
+	}
+
+	return changes
+}
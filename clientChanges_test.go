@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+func TestDiffClients(t *testing.T) {
+	phone := router.Client{MAC: "00:11:22:33:44:01", Name: "phone", Online: true, Node: "a"}
+	laptop := router.Client{MAC: "00:11:22:33:44:02", Name: "laptop", Online: true}
+	offline := func(c router.Client) router.Client {
+		c.Online = false
+		return c
+	}
+	roamed := func(c router.Client, node string) router.Client {
+		c.Node = node
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		previous []router.Client
+		current  []router.Client
+		want     []changeKind
+	}{
+		{"first poll", nil, []router.Client{phone, laptop}, []changeKind{clientNew, clientNew}},
+		{"unchanged", []router.Client{phone}, []router.Client{phone}, []changeKind{}},
+		{"offline", []router.Client{phone}, []router.Client{offline(phone)}, []changeKind{clientOffline}},
+		{"still offline", []router.Client{offline(phone)}, []router.Client{offline(phone)}, []changeKind{}},
+		{"online", []router.Client{offline(phone)}, []router.Client{phone}, []changeKind{clientOnline}},
+		{"dropped", []router.Client{phone, laptop}, []router.Client{laptop}, []changeKind{clientDropped}},
+		{"dropped while offline", []router.Client{offline(phone)}, nil, []changeKind{clientDropped}},
+		{"roamed", []router.Client{phone}, []router.Client{roamed(phone, "b")}, []changeKind{clientRoamed}},
+		{"new node reported", []router.Client{roamed(phone, "")}, []router.Client{phone}, []changeKind{}},
+		{"roamed while offline", []router.Client{offline(phone)}, []router.Client{offline(roamed(phone, "b"))}, []changeKind{}},
+		{"joined and left", []router.Client{phone}, []router.Client{offline(phone), laptop},
+			[]changeKind{clientOffline, clientNew}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := diffClients(test.previous, test.current)
+			kinds := make([]changeKind, len(changes))
+			for i, change := range changes {
+				kinds[i] = change.Kind
+			}
+			if len(kinds) != len(test.want) {
+				t.Fatalf("got changes %v, want %v", kinds, test.want)
+			}
+			for i := range kinds {
+				if kinds[i] != test.want[i] {
+					t.Fatalf("got changes %v, want %v", kinds, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffClientsPrevious(t *testing.T) {
+	previous := []router.Client{{MAC: "00:11:22:33:44:01", Online: true, Node: "a"}}
+	current := []router.Client{{MAC: "00:11:22:33:44:01", Online: true, Node: "b"}}
+
+	changes := diffClients(previous, current)
+	if 1 != len(changes) || nil == changes[0].Previous {
+		t.Fatalf("got %+v, want one change with the previous client", changes)
+	}
+	if "a" != changes[0].Previous.Node || "b" != changes[0].Client.Node {
+		t.Errorf("roamed from %s to %s, want a to b", changes[0].Previous.Node, changes[0].Client.Node)
+	}
+}
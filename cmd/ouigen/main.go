@@ -0,0 +1,141 @@
+// Command ouigen generates the oui package's registry from the IEEE MA-L,
+// MA-M and MA-S CSV files (oui.csv, mam.csv and oui36.csv from
+// https://regauth.standards.ieee.org). go generate ./oui downloads them and
+// runs it, or they can be downloaded first:
+//
+//	go run ./cmd/ouigen -o oui/registry.go oui.csv mam.csv oui36.csv
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func main() {
+	output := flag.String("o", "oui/registry.go", "Go file to write")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-o registry.go] registry.csv...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if 0 == flag.NArg() {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	prefixes := make(map[string]string)
+	for _, name := range flag.Args() {
+		count, err := readRegistry(name, prefixes)
+		if nil != err {
+			log.Fatalf("Cannot read %s: %v", name, err)
+		}
+		log.Printf("Read %d prefixes from %s", count, name)
+	}
+
+	source, err := generate(prefixes, flag.Args())
+	if nil != err {
+		log.Fatal(err)
+	}
+	if err = ioutil.WriteFile(*output, source, 0644); nil != err {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %d prefixes to %s", len(prefixes), *output)
+}
+
+// readRegistry adds the prefixes in an IEEE registry CSV file, which has
+// Registry, Assignment and Organization Name columns
+func readRegistry(name string, prefixes map[string]string) (int, error) {
+	f, err := os.Open(name)
+	if nil != err {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if nil != err {
+		return 0, err
+	}
+	assignment, organization := -1, -1
+	for i, column := range header {
+		switch strings.TrimSpace(column) {
+		case "Assignment":
+			assignment = i
+		case "Organization Name":
+			organization = i
+		}
+	}
+	if assignment < 0 || organization < 0 {
+		return 0, fmt.Errorf("no Assignment and Organization Name columns")
+	}
+
+	count := 0
+	for {
+		record, err := r.Read()
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			return count, err
+		}
+		if len(record) <= assignment || len(record) <= organization {
+			continue
+		}
+		prefix := strings.ToUpper(strings.TrimSpace(record[assignment]))
+		org := strings.Join(strings.Fields(record[organization]), " ")
+		if 0 == len(prefix) || 0 == len(org) {
+			continue
+		}
+		prefixes[prefix] = org
+		count++
+	}
+	return count, nil
+}
+
+// generate returns the registry.go source for the prefixes, noting the files
+// they were read from
+func generate(prefixes map[string]string, sources []string) ([]byte, error) {
+	sorted := make([]string, 0, len(prefixes))
+	for prefix := range prefixes {
+		sorted = append(sorted, prefix)
+	}
+	sort.Strings(sorted)
+
+	var compressed bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	if nil != err {
+		return nil, err
+	}
+	for _, prefix := range sorted {
+		fmt.Fprintf(gz, "%s\t%s\n", prefix, prefixes[prefix])
+	}
+	if err = gz.Close(); nil != err {
+		return nil, err
+	}
+
+	var source bytes.Buffer
+	fmt.Fprintln(&source, "// Code generated by ouigen. DO NOT EDIT.")
+	fmt.Fprintln(&source)
+	fmt.Fprintln(&source, "package oui")
+	fmt.Fprintln(&source)
+	names := make([]string, len(sources))
+	for i, name := range sources {
+		names[i] = filepath.Base(name)
+	}
+	fmt.Fprintf(&source, "// registry holds %d prefixes from %s, gzipped and base64 encoded\n", len(sorted),
+		strings.Join(names, ", "))
+	fmt.Fprintf(&source, "const registry = %q\n", base64.StdEncoding.EncodeToString(compressed.Bytes()))
+	return format.Source(source.Bytes())
+}
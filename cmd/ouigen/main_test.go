@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const maL = `Registry,Assignment,Organization Name,Organization Address
+MA-L,70B3D5,IEEE Registration Authority,445 Hoes Lane Piscataway NJ US 08554
+MA-L,b827eb,"Raspberry   Pi Foundation",Mitchell Wood House Caldecote Cambridgeshire GB CB23 7NU
+MA-L,,Missing Assignment,
+`
+
+const maS = `Registry,Assignment,Organization Name,Organization Address
+MA-S,70B3D5ABC,"Example, Ltd.",
+`
+
+func writeCSV(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); nil != err {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ouigen")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prefixes := make(map[string]string)
+	count, err := readRegistry(writeCSV(t, dir, "oui.csv", maL), prefixes)
+	if nil != err || 2 != count {
+		t.Fatalf("got %d prefixes, %v, want 2", count, err)
+	}
+	if count, err = readRegistry(writeCSV(t, dir, "oui36.csv", maS), prefixes); nil != err || 1 != count {
+		t.Fatalf("got %d prefixes, %v, want 1", count, err)
+	}
+	want := map[string]string{
+		"70B3D5":    "IEEE Registration Authority",
+		"B827EB":    "Raspberry Pi Foundation",
+		"70B3D5ABC": "Example, Ltd.",
+	}
+	for prefix, org := range want {
+		if prefixes[prefix] != org {
+			t.Errorf("got %q for %s, want %q", prefixes[prefix], prefix, org)
+		}
+	}
+
+	if _, err = readRegistry(writeCSV(t, dir, "bad.csv", "a,b\n1,2\n"), prefixes); nil == err {
+		t.Error("read a file without the registry columns")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	prefixes := map[string]string{"B827EB": "Raspberry Pi Foundation", "70B3D5ABC": "Example, Ltd."}
+	source, err := generate(prefixes, []string{"/tmp/x/oui.csv", "oui36.csv"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(source, []byte("// Code generated by ouigen. DO NOT EDIT.\n")) {
+		t.Error("missing the generated code header")
+	}
+	if !bytes.Contains(source, []byte("holds 2 prefixes from oui.csv, oui36.csv,")) {
+		t.Errorf("the source doesn't name the files it was read from:\n%s", source)
+	}
+
+	encoded := regexp.MustCompile(`const registry = "([^"]+)"`).FindSubmatch(source)
+	if nil == encoded {
+		t.Fatalf("no registry constant in:\n%s", source)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(encoded[1]))
+	if nil != err {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if nil != err {
+		t.Fatal(err)
+	}
+	lines, err := ioutil.ReadAll(gz)
+	if nil != err {
+		t.Fatal(err)
+	}
+	want := "70B3D5ABC\tExample, Ltd.\nB827EB\tRaspberry Pi Foundation\n"
+	if string(lines) != want {
+		t.Errorf("got registry %q, want %q", strings.TrimSpace(string(lines)), want)
+	}
+}
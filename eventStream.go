@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/events"
+	"github.com/disrvptor/wifi_client_watch/websocket"
+)
+
+// keepaliveInterval is how often idle event streams are kept alive, so
+// proxies don't time them out
+const keepaliveInterval = 30 * time.Second
+
+var errInvalidEventRequest = errors.New("invalid event request")
+
+// routerErrorData is what a router_error event adds to its message
+type routerErrorData struct {
+	Failures    int  `json:"failures"` // consecutive
+	Unreachable bool `json:"unreachable"`
+}
+
+// readEvents starts the event bus, creating the event log if needed, and
+// keeps max_events of the latest events
+func readEvents(app *wifiClientWatchApp) {
+	var err error
+	if app.events, err = events.NewBus(app.db, 100); nil != err {
+		log.Fatal(err)
+	}
+	setMaxEvents(nil, nil)
+	app.preferences.AddWatcher("max_events", setMaxEvents)
+}
+
+// setMaxEvents applies the max_events preference to the event bus
+func setMaxEvents(oldValue *string, newValue *string) {
+	raw, prs := application.preferences.Get("max_events")
+	if !prs {
+		return
+	}
+	max, err := strconv.ParseInt(*raw, 10, 64)
+	if nil != err || max < 0 {
+		log.Printf("Invalid max_events %s", *raw)
+		return
+	}
+	application.events.SetMaxEvents(max)
+}
+
+// publishEvent publishes an event on the site, with the data as JSON
+func publishEvent(s *site, eventType string, mac string, message string, data interface{}) {
+	e := events.Event{Type: eventType, Site: s.Name, MAC: mac, Message: message}
+	if nil != data {
+		b, err := json.Marshal(data)
+		if nil != err {
+			log.Printf("Cannot encode the %s event: %v", eventType, err)
+			return
+		}
+		e.Data = b
+	}
+	if _, err := application.events.Publish(e); nil != err {
+		log.Printf("Cannot publish the %s event: %v", eventType, err)
+	}
+}
+
+// changeMessage describes the client change
+func changeMessage(change clientChange) string {
+	c := change.Client
+	switch change.Kind {
+	case clientNew:
+		return fmt.Sprintf("New client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+	case clientOnline:
+		return fmt.Sprintf("Client %s (MAC=%s, IP=%s) is online", c.Name, c.MAC, c.IP)
+	case clientOffline:
+		return fmt.Sprintf("Client %s (MAC=%s, IP=%s) is offline", c.Name, c.MAC, c.IP)
+	case clientDropped:
+		return fmt.Sprintf("Client %s (MAC=%s, IP=%s) dropped off", c.Name, c.MAC, c.IP)
+	case clientRoamed:
+		return fmt.Sprintf("Client %s (MAC=%s, IP=%s) roamed from node %s to %s", c.Name, c.MAC, c.IP,
+			change.Previous.Node, c.Node)
+	}
+	return string(change.Kind)
+}
+
+// eventRequest reads the type, site and mac filters and where to resume
+// from, which is the Last-Event-ID header or last_event_id parameter, or -1
+// not to replay any events
+func eventRequest(r *http.Request) (events.Filter, int64, error) {
+	query := r.URL.Query()
+	filter := events.Filter{Types: splitTags(query.Get("type")), Site: query.Get("site"),
+		MAC: canonicalMAC(query.Get("mac"))}
+	for _, t := range filter.Types {
+		if !contains(events.Types, t) {
+			return filter, 0, fmt.Errorf("%w: unknown type %s", errInvalidEventRequest, t)
+		}
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if 0 == len(lastID) {
+		lastID = query.Get("last_event_id")
+	}
+	if 0 == len(lastID) {
+		return filter, -1, nil
+	}
+	after, err := strconv.ParseInt(strings.TrimSpace(lastID), 10, 64)
+	if nil != err || after < 0 {
+		return filter, 0, fmt.Errorf("%w: invalid last event ID %s", errInvalidEventRequest, lastID)
+	}
+	return filter, after, nil
+}
+
+// subscribeEvents resumes the request's event stream, answering it with an
+// error if it can't be
+func subscribeEvents(w http.ResponseWriter, r *http.Request) (*events.Subscription, []events.Event, bool) {
+	filter, after, err := eventRequest(r)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	sub, replay, err := application.events.Resume(after, filter)
+	if errors.Is(err, events.ErrClosed) {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return nil, nil, false
+	} else if nil != err {
+		log.Println("Cannot subscribe to events:", err)
+		http.Error(w, "Cannot read events", 500)
+		return nil, nil, false
+	}
+	return sub, replay, true
+}
+
+// eventsHandler streams events as server-sent events, optionally filtered by
+// the comma separated type parameter, site and mac, and resuming after the
+// Last-Event-ID header or last_event_id parameter
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling events request")
+	enableCors(&w)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming isn't supported", 500)
+		return
+	}
+	sub, replay, ok := subscribeEvents(w, r)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range replay {
+		if nil != writeServerSentEvent(w, e) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if nil != writeServerSentEvent(w, e) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); nil != err {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeServerSentEvent writes the event with its ID and type, and itself as
+// JSON for data
+func writeServerSentEvent(w http.ResponseWriter, e events.Event) error {
+	b, err := json.Marshal(e)
+	if nil != err {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+	return err
+}
+
+// eventsSocketHandler streams events as JSON text messages over a websocket,
+// with the same parameters as eventsHandler. Messages from the client are
+// ignored.
+func eventsSocketHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling events websocket request")
+	sub, replay, ok := subscribeEvents(w, r)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+	conn, err := websocket.Upgrade(w, r)
+	if nil != err {
+		log.Println("Cannot upgrade to a websocket:", err)
+		return
+	}
+	// Clients can drop without a close frame, which ends the reader below
+	// without closing the connection
+	defer conn.Close(websocket.CloseGoingAway, "")
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); nil != err {
+				return
+			}
+		}
+	}()
+
+	for _, e := range replay {
+		if nil != writeSocketEvent(conn, e) {
+			return
+		}
+	}
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			err = writeSocketEvent(conn, e)
+		case <-keepalive.C:
+			err = conn.Ping()
+		}
+		if nil != err {
+			return
+		}
+	}
+}
+
+func writeSocketEvent(conn *websocket.Conn, e events.Event) error {
+	b, err := json.Marshal(e)
+	if nil != err {
+		return err
+	}
+	return conn.WriteText(b)
+}
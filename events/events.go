@@ -0,0 +1,235 @@
+// Package events publishes what happens on the sites to subscribers in the
+// same process, keeping a log of the events so subscribers can resume where
+// they left off
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events
+const (
+	TypeNew         = "new"
+	TypeOnline      = "online"
+	TypeOffline     = "offline"
+	TypeDropped     = "dropped"
+	TypeRoamed      = "roamed"
+	TypeAnomaly     = "anomaly"
+	TypeRouterError = "router_error"
+)
+
+// Types are every type of event
+var Types = []string{TypeNew, TypeOnline, TypeOffline, TypeDropped, TypeRoamed, TypeAnomaly, TypeRouterError}
+
+// ErrClosed is returned when subscribing after the bus was closed
+var ErrClosed = errors.New("event bus is closed")
+
+// MaxReplay is the most events replayed when resuming
+const MaxReplay = 1000
+
+// DefaultMaxEvents is how many of the latest events are kept unless
+// SetMaxEvents says otherwise
+const DefaultMaxEvents = 10000
+
+// Event is something that happened on a site. IDs increase in the order
+// events were published.
+type Event struct {
+	ID      int64           `json:"id"`
+	At      time.Time       `json:"at"`
+	Type    string          `json:"type"`
+	Site    string          `json:"site"`
+	MAC     string          `json:"mac,omitempty"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Filter selects events by type, site and MAC. Empty fields match every
+// event.
+type Filter struct {
+	Types []string
+	Site  string
+	MAC   string
+}
+
+// Matches is whether the event passes the filter
+func (f Filter) Matches(e Event) bool {
+	if 0 != len(f.Types) && !contains(f.Types, e.Type) {
+		return false
+	}
+	if 0 != len(f.Site) && f.Site != e.Site {
+		return false
+	}
+	return 0 == len(f.MAC) || strings.EqualFold(f.MAC, e.MAC)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the events matching its filter on C, which is
+// closed when the subscription ends. A subscriber that falls more than its
+// buffer behind is ended, and can resume from the last event it got.
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	filter Filter
+	bus    *Bus
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.remove(s)
+}
+
+// Bus stores published events in the DB and passes them on to subscribers
+type Bus struct {
+	db          *sql.DB
+	buffer      int
+	mu          sync.Mutex // guards subscribers, closed and maxEvents, and orders publishing
+	subscribers map[*Subscription]bool
+	closed      bool
+	maxEvents   int64
+}
+
+// NewBus creates the events table if needed and returns a bus whose
+// subscribers can fall up to buffer events behind
+func NewBus(db *sql.DB, buffer int) (*Bus, error) {
+	_, err := db.Exec(`create table IF NOT EXISTS events (id integer primary key autoincrement, at timestamp not null,
+		type text not null, site text not null, mac text, message text, data text)`)
+	if nil != err {
+		return nil, err
+	}
+	return &Bus{db: db, buffer: buffer, subscribers: make(map[*Subscription]bool), maxEvents: DefaultMaxEvents}, nil
+}
+
+// SetMaxEvents sets how many of the latest events are kept, older ones
+// being deleted as new ones are published. 0 keeps every event.
+func (b *Bus) SetMaxEvents(max int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxEvents = max
+}
+
+// Publish stores the event and sends it to the matching subscribers,
+// returning it with its ID
+func (b *Bus) Publish(e Event) (Event, error) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC().Truncate(time.Second)
+	}
+	var data interface{}
+	if 0 != len(e.Data) {
+		data = string(e.Data)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result, err := b.db.Exec("insert into events (at, type, site, mac, message, data) values (?,?,?,?,?,?)",
+		e.At, e.Type, e.Site, e.MAC, e.Message, data)
+	if nil != err {
+		return e, err
+	}
+	if e.ID, err = result.LastInsertId(); nil != err {
+		return e, err
+	}
+	if b.maxEvents > 0 && e.ID > b.maxEvents {
+		if _, err = b.db.Exec("delete from events where id <= ?", e.ID-b.maxEvents); nil != err {
+			log.Printf("Cannot delete old events: %v", err)
+		}
+	}
+	for s := range b.subscribers {
+		if !s.filter.Matches(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			log.Printf("Ending an event subscription that fell %d events behind", b.buffer)
+			b.remove(s)
+		}
+	}
+	return e, nil
+}
+
+// Resume returns the stored events after the ID that match the filter, up to
+// MaxReplay of the latest, and a subscription to the ones published from
+// then on, so none are missed or repeated. An ID below 0 replays nothing.
+func (b *Bus) Resume(after int64, filter Filter) (*Subscription, []Event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nil, ErrClosed
+	}
+	replay := make([]Event, 0)
+	if after >= 0 {
+		var err error
+		if replay, err = b.since(after, filter); nil != err {
+			return nil, nil, err
+		}
+	}
+	c := make(chan Event, b.buffer)
+	s := &Subscription{C: c, c: c, filter: filter, bus: b}
+	b.subscribers[s] = true
+	return s, replay, nil
+}
+
+// since reads the latest stored events after the ID that match the filter,
+// oldest first
+func (b *Bus) since(after int64, filter Filter) ([]Event, error) {
+	types := strings.Join(filter.Types, ",")
+	rows, err := b.db.Query(`select id, at, type, site, coalesce(mac, ''), coalesce(message, ''), data from events
+		where id > ? and (? = '' or instr(',' || ? || ',', ',' || type || ',') > 0) and (? = '' or site = ?)
+		and (? = '' or mac = ? collate nocase) order by id desc limit ?`,
+		after, types, types, filter.Site, filter.Site, filter.MAC, filter.MAC, MaxReplay)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make([]Event, 0)
+	for rows.Next() {
+		var e Event
+		var data sql.NullString
+		if err = rows.Scan(&e.ID, &e.At, &e.Type, &e.Site, &e.MAC, &e.Message, &data); nil != err {
+			return nil, err
+		}
+		if data.Valid {
+			e.Data = json.RawMessage(data.String)
+		}
+		events = append(events, e)
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, rows.Err()
+}
+
+// Close ends every subscription and refuses new ones. Events published
+// afterwards are still stored.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subscribers {
+		b.remove(s)
+	}
+}
+
+// remove ends the subscription. The caller must hold mu.
+func (b *Bus) remove(s *Subscription) {
+	if b.subscribers[s] {
+		delete(b.subscribers, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,227 @@
+package events
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestBus returns a bus on a scratch DB and a function that removes it
+func newTestBus(t *testing.T, buffer int) (*Bus, func()) {
+	dir, err := ioutil.TempDir("", "events")
+	if nil != err {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "events.db"))
+	if nil != err {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	bus, err := NewBus(db, buffer)
+	if nil != err {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return bus, func() {
+		bus.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func publish(t *testing.T, bus *Bus, events ...Event) []Event {
+	published := make([]Event, len(events))
+	for i, e := range events {
+		var err error
+		if published[i], err = bus.Publish(e); nil != err {
+			t.Fatal(err)
+		}
+	}
+	return published
+}
+
+func ids(events []Event) []int64 {
+	ids := make([]int64, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+func equalIDs(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFilterMatches(t *testing.T) {
+	e := Event{Type: TypeNew, Site: "home", MAC: "AA:BB:CC:DD:EE:FF"}
+	tests := []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{Types: []string{TypeOffline, TypeNew}}, true},
+		{Filter{Types: []string{TypeOffline}}, false},
+		{Filter{Site: "home"}, true},
+		{Filter{Site: "lab"}, false},
+		{Filter{MAC: "aa:bb:cc:dd:ee:ff"}, true},
+		{Filter{MAC: "AA:BB:CC:DD:EE:00"}, false},
+		{Filter{Types: []string{TypeNew}, Site: "home", MAC: "AA:BB:CC:DD:EE:FF"}, true},
+		{Filter{Types: []string{TypeNew}, Site: "lab", MAC: "AA:BB:CC:DD:EE:FF"}, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.Matches(e); got != test.want {
+			t.Errorf("%+v matched %t, want %t", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	bus, stop := newTestBus(t, 10)
+	defer stop()
+	published := publish(t, bus,
+		Event{Type: TypeNew, Site: "home", MAC: "AA:BB:CC:DD:EE:01", Data: []byte(`{"name":"phone"}`)},
+		Event{Type: TypeOffline, Site: "home", MAC: "AA:BB:CC:DD:EE:01"},
+		Event{Type: TypeNew, Site: "lab", MAC: "AA:BB:CC:DD:EE:02"},
+		Event{Type: TypeRouterError, Site: "lab"},
+	)
+
+	tests := []struct {
+		name   string
+		after  int64
+		filter Filter
+		want   []int64
+	}{
+		{"everything", 0, Filter{}, ids(published)},
+		{"after an event", published[1].ID, Filter{}, ids(published[2:])},
+		{"after the last", published[3].ID, Filter{}, []int64{}},
+		{"nothing", -1, Filter{}, []int64{}},
+		{"by type", 0, Filter{Types: []string{TypeNew}}, []int64{published[0].ID, published[2].ID}},
+		{"by types", 0, Filter{Types: []string{TypeOffline, TypeRouterError}}, []int64{published[1].ID, published[3].ID}},
+		{"by site", 0, Filter{Site: "lab"}, ids(published[2:])},
+		{"by MAC", 0, Filter{MAC: "aa:bb:cc:dd:ee:01"}, ids(published[:2])},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sub, replay, err := bus.Resume(test.after, test.filter)
+			if nil != err {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			if got := ids(replay); !equalIDs(got, test.want) {
+				t.Errorf("replayed %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	_, replay, err := bus.Resume(0, Filter{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if `{"name":"phone"}` != string(replay[0].Data) || nil != replay[1].Data || replay[0].At.IsZero() {
+		t.Errorf("got %+v, want the data and time stored", replay[:2])
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	bus, stop := newTestBus(t, 10)
+	defer stop()
+	publish(t, bus, Event{Type: TypeNew, Site: "home"})
+
+	sub, replay, err := bus.Resume(0, Filter{Site: "home"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	published := publish(t, bus, Event{Type: TypeNew, Site: "lab"}, Event{Type: TypeOffline, Site: "home"})
+	// Nothing is missed or repeated between the replay and the live events
+	if 1 != len(replay) {
+		t.Fatalf("replayed %d events, want 1", len(replay))
+	}
+	if e := <-sub.C; e.ID != published[1].ID {
+		t.Errorf("got event %d, want %d", e.ID, published[1].ID)
+	}
+	select {
+	case e := <-sub.C:
+		t.Errorf("got unexpected event %+v", e)
+	default:
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("the subscription is still open after closing it")
+	}
+	// Closing twice is harmless
+	sub.Close()
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	bus, stop := newTestBus(t, 2)
+	defer stop()
+	sub, _, err := bus.Resume(-1, Filter{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	publish(t, bus, Event{Type: TypeNew, Site: "home"}, Event{Type: TypeNew, Site: "home"},
+		Event{Type: TypeNew, Site: "home"})
+
+	received := 0
+	for range sub.C {
+		received++
+	}
+	if 2 != received {
+		t.Errorf("got %d events before the subscription ended, want 2", received)
+	}
+}
+
+func TestClose(t *testing.T) {
+	bus, stop := newTestBus(t, 10)
+	defer stop()
+	sub, _, err := bus.Resume(-1, Filter{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	bus.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("the subscription is still open after closing the bus")
+	}
+	if _, _, err = bus.Resume(0, Filter{}); ErrClosed != err {
+		t.Errorf("got %v resuming a closed bus, want ErrClosed", err)
+	}
+	// Events are still stored
+	publish(t, bus, Event{Type: TypeNew, Site: "home"})
+}
+
+func TestMaxEvents(t *testing.T) {
+	bus, stop := newTestBus(t, 10)
+	defer stop()
+	bus.SetMaxEvents(3)
+	published := make([]Event, 0)
+	for i := 0; i < 5; i++ {
+		published = append(published, publish(t, bus, Event{Type: TypeNew, Site: "home"})...)
+	}
+	_, replay, err := bus.Resume(0, Filter{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if got := ids(replay); !equalIDs(got, ids(published[2:])) {
+		t.Errorf("kept %v, want %v", got, ids(published[2:]))
+	}
+
+	bus.SetMaxEvents(0)
+	publish(t, bus, Event{Type: TypeNew, Site: "home"}, Event{Type: TypeNew, Site: "home"})
+	if _, replay, err = bus.Resume(0, Filter{}); nil != err || 5 != len(replay) {
+		t.Errorf("kept %d events, %v, want every event from then on", len(replay), err)
+	}
+}
@@ -0,0 +1,148 @@
+package fingerprint
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// DNS record types the parser understands
+const (
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+)
+
+var errDNSMalformed = errors.New("malformed DNS message")
+
+// dnsRecord is a resource record. Data is the target name of PTR and SRV
+// records; TXT holds the strings of TXT records.
+type dnsRecord struct {
+	Name string
+	Type uint16
+	Data string
+	TXT  []string
+}
+
+// dnsMessage is the parts of a DNS message mDNS fingerprinting needs
+type dnsMessage struct {
+	Response  bool
+	Questions []string
+	Records   []dnsRecord // answers, authorities and additionals
+}
+
+// parseDNS parses a DNS message, as sent in mDNS announcements
+func parseDNS(b []byte) (dnsMessage, error) {
+	var m dnsMessage
+	if len(b) < 12 {
+		return m, errDNSMalformed
+	}
+	m.Response = 0 != b[2]&0x80
+	questions := int(binary.BigEndian.Uint16(b[4:]))
+	records := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) +
+		int(binary.BigEndian.Uint16(b[10:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readDNSName(b, off)
+		if nil != err {
+			return m, err
+		}
+		// Type and class
+		if next+4 > len(b) {
+			return m, errDNSMalformed
+		}
+		m.Questions = append(m.Questions, name)
+		off = next + 4
+	}
+
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(b, off)
+		if nil != err {
+			return m, err
+		}
+		// Type, class, TTL and data length
+		if next+10 > len(b) {
+			return m, errDNSMalformed
+		}
+		r := dnsRecord{Name: name, Type: binary.BigEndian.Uint16(b[next:])}
+		length := int(binary.BigEndian.Uint16(b[next+8:]))
+		start := next + 10
+		end := start + length
+		if end > len(b) {
+			return m, errDNSMalformed
+		}
+
+		switch r.Type {
+		case dnsTypePTR:
+			r.Data, _, err = readDNSName(b, start)
+		case dnsTypeSRV:
+			// Priority, weight and port come before the target
+			if length < 6 {
+				return m, errDNSMalformed
+			}
+			r.Data, _, err = readDNSName(b, start+6)
+		case dnsTypeTXT:
+			r.TXT, err = readTXT(b[start:end])
+		}
+		if nil != err {
+			return m, err
+		}
+		m.Records = append(m.Records, r)
+		off = end
+	}
+	return m, nil
+}
+
+// readDNSName reads a possibly compressed name at off, returning it without
+// the trailing dot and the offset just past it
+func readDNSName(b []byte, off int) (string, int, error) {
+	labels := make([]string, 0, 4)
+	next := -1
+	// Bound the pointers followed so a loop can't hang us
+	for jumps := 0; jumps < 32; {
+		if off >= len(b) {
+			return "", 0, errDNSMalformed
+		}
+		length := int(b[off])
+		switch {
+		case 0 == length:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case 0xC0 == length&0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			jumps++
+		case 0 != length&0xC0:
+			return "", 0, errDNSMalformed
+		default:
+			if off+1+length > len(b) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(b[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+	return "", 0, errDNSMalformed
+}
+
+// readTXT splits TXT record data into its strings
+func readTXT(b []byte) ([]string, error) {
+	txt := make([]string, 0)
+	for off := 0; off < len(b); {
+		length := int(b[off])
+		if off+1+length > len(b) {
+			return nil, errDNSMalformed
+		}
+		txt = append(txt, string(b[off+1:off+1+length]))
+		off += 1 + length
+	}
+	return txt, nil
+}
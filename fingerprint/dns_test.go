@@ -0,0 +1,172 @@
+package fingerprint
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// dnsHeader is a response header with the section counts
+func dnsHeader(questions, answers, authorities, additionals uint16) []byte {
+	b := make([]byte, 12)
+	b[2] = 0x84 // response, authoritative
+	binary.BigEndian.PutUint16(b[4:], questions)
+	binary.BigEndian.PutUint16(b[6:], answers)
+	binary.BigEndian.PutUint16(b[8:], authorities)
+	binary.BigEndian.PutUint16(b[10:], additionals)
+	return b
+}
+
+// dnsName encodes the labels without compression
+func dnsName(labels ...string) []byte {
+	b := make([]byte, 0)
+	for _, l := range labels {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// dnsRR encodes a resource record with the type and data
+func dnsRR(name []byte, rrType uint16, data []byte) []byte {
+	b := append([]byte{}, name...)
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed[0:], rrType)
+	binary.BigEndian.PutUint16(fixed[2:], 1)
+	binary.BigEndian.PutUint32(fixed[4:], 120)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(data)))
+	return append(append(b, fixed...), data...)
+}
+
+func concat(parts ...[]byte) []byte {
+	b := make([]byte, 0)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// announcement is an mDNS response for a printer, with a PTR, SRV and TXT
+// record whose names point back at earlier ones
+func announcement() []byte {
+	header := dnsHeader(0, 2, 0, 1)
+	// _ipp._tcp.local starts at 12
+	ptrName := dnsName("_ipp", "_tcp", "local")
+	// Office._ipp._tcp.local in the PTR data, pointing at the service type
+	instance := append(dnsName("Office")[:7], 0xC0, 12)
+	ptr := dnsRR(ptrName, dnsTypePTR, instance)
+	instanceOff := byte(12 + len(ptrName) + 10)
+	srv := dnsRR([]byte{0xC0, instanceOff}, dnsTypeSRV, concat([]byte{0, 0, 0, 0, 0x02, 0x77}, dnsName("printer", "local")))
+	txt := dnsRR([]byte{0xC0, instanceOff}, dnsTypeTXT, concat([]byte{9}, []byte("ty=Laser1"), []byte{4}, []byte("rp=x")))
+	return concat(header, ptr, srv, txt)
+}
+
+func TestParseDNS(t *testing.T) {
+	m, err := parseDNS(announcement())
+	if nil != err {
+		t.Fatal(err)
+	}
+	want := dnsMessage{
+		Response: true,
+		Records: []dnsRecord{
+			{Name: "_ipp._tcp.local", Type: dnsTypePTR, Data: "Office._ipp._tcp.local"},
+			{Name: "Office._ipp._tcp.local", Type: dnsTypeSRV, Data: "printer.local"},
+			{Name: "Office._ipp._tcp.local", Type: dnsTypeTXT, TXT: []string{"ty=Laser1", "rp=x"}},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+}
+
+func TestParseDNSQuestions(t *testing.T) {
+	b := concat(dnsHeader(2, 0, 0, 0), dnsName("_ipp", "_tcp", "local"), []byte{0, 12, 0, 1},
+		[]byte{0xC0, 17}, []byte{0, 12, 0, 1})
+	b[2] = 0
+	m, err := parseDNS(b)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if m.Response || !reflect.DeepEqual(m.Questions, []string{"_ipp._tcp.local", "_tcp.local"}) {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestParseDNSMalformed(t *testing.T) {
+	valid := announcement()
+	tests := []struct {
+		name    string
+		message []byte
+	}{
+		{"empty", nil},
+		{"short header", valid[:11]},
+		{"missing question", dnsHeader(1, 0, 0, 0)},
+		{"question without type", concat(dnsHeader(1, 0, 0, 0), dnsName("local"), []byte{0, 12})},
+		{"missing record", dnsHeader(0, 1, 0, 0)},
+		{"truncated name", concat(dnsHeader(0, 1, 0, 0), []byte{5, 'l', 'o'})},
+		{"unterminated name", concat(dnsHeader(0, 1, 0, 0), []byte{5}, []byte("local"))},
+		{"truncated record", valid[:len(valid)-1]},
+		{"record without fixed fields", concat(dnsHeader(0, 1, 0, 0), dnsName("local"), []byte{0, 12, 0, 1, 0})},
+		{"data past the end", concat(dnsHeader(0, 1, 0, 0), dnsName("local"), []byte{0, 16, 0, 1, 0, 0, 0, 1, 0, 9, 1})},
+		{"self pointer", concat(dnsHeader(0, 1, 0, 0), []byte{0xC0, 12})},
+		{"pointer loop", concat(dnsHeader(0, 1, 0, 0), []byte{1, 'a', 0xC0, 16, 1, 'b', 0xC0, 12})},
+		{"pointer past the end", concat(dnsHeader(0, 1, 0, 0), []byte{0xC0, 0xFF})},
+		{"pointer cut short", concat(dnsHeader(0, 1, 0, 0), []byte{0xC0})},
+		{"reserved label type", concat(dnsHeader(0, 1, 0, 0), []byte{0x80, 'a', 0})},
+		{"short SRV", concat(dnsHeader(0, 1, 0, 0), dnsRR(dnsName("local"), dnsTypeSRV, []byte{0, 0, 0, 0, 0}))},
+		{"PTR pointing past the end", concat(dnsHeader(0, 1, 0, 0), dnsRR(dnsName("local"), dnsTypePTR, []byte{0xC0, 0xF0}))},
+		{"TXT string past the data", concat(dnsHeader(0, 1, 0, 0), dnsRR(dnsName("local"), dnsTypeTXT, []byte{5, 'a'}))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if m, err := parseDNS(test.message); errDNSMalformed != err {
+				t.Errorf("got %+v, %v, want errDNSMalformed", m, err)
+			}
+		})
+	}
+}
+
+func TestReadDNSNameOffsets(t *testing.T) {
+	b := concat(dnsName("a", "local"), []byte{1, 'b', 0xC0, 0})
+	tests := []struct {
+		off  int
+		name string
+		next int
+	}{
+		{0, "a.local", 9},
+		{2, "local", 9},
+		{9, "b.a.local", 13},
+	}
+	for _, test := range tests {
+		name, next, err := readDNSName(b, test.off)
+		if nil != err || name != test.name || next != test.next {
+			t.Errorf("readDNSName at %d = %q, %d, %v, want %q, %d", test.off, name, next, err, test.name, test.next)
+		}
+	}
+	for _, off := range []int{len(b), len(b) + 1, 1000} {
+		if _, _, err := readDNSName(b, off); errDNSMalformed != err {
+			t.Errorf("readDNSName at %d = %v, want errDNSMalformed", off, err)
+		}
+	}
+}
+
+// TestParseDNSRandom feeds random and corrupted messages to the parser,
+// which mustn't panic or hang on them
+func TestParseDNSRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	valid := announcement()
+	for i := 0; i < 20000; i++ {
+		var b []byte
+		if 0 == i%2 {
+			b = make([]byte, r.Intn(512))
+			r.Read(b)
+		} else {
+			b = append([]byte{}, valid[:r.Intn(len(valid)+1)]...)
+			for j := r.Intn(4); j >= 0 && 0 != len(b); j-- {
+				b[r.Intn(len(b))] = byte(r.Intn(256))
+			}
+		}
+		parseDNS(b)
+	}
+}
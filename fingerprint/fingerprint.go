@@ -0,0 +1,77 @@
+// Package fingerprint guesses what kind of device a client is, and the OS
+// family it runs, from its hostname, vendor, DHCP parameter request list and
+// what it announces over mDNS and SSDP
+package fingerprint
+
+import (
+	"strings"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// Hints are what a client has announced about itself on the network
+type Hints struct {
+	Services []string `json:"services,omitempty"` // mDNS service types, e.g. _googlecast._tcp
+	Models   []string `json:"models,omitempty"`   // models from mDNS TXT records
+	SSDP     []string `json:"ssdp,omitempty"`     // SSDP SERVER and NT headers
+}
+
+// announcements are the hints matched against announcementRules
+func (h Hints) announcements() []string {
+	all := make([]string, 0, len(h.Services)+len(h.Models)+len(h.SSDP))
+	all = append(all, h.Services...)
+	all = append(all, h.Models...)
+	return append(all, h.SSDP...)
+}
+
+// Classify guesses the client's device type and OS family. Announcements are
+// trusted most for the device type and the DHCP fingerprint for the OS, then
+// the hostname and then the vendor.
+func Classify(c router.Client, hints Hints) (router.DeviceType, router.OSFamily) {
+	var deviceType router.DeviceType
+	var os router.OSFamily
+	apply := func(r rule) {
+		if router.DeviceTypeUnknown == deviceType {
+			deviceType = r.deviceType
+		}
+		if router.OSUnknown == os {
+			os = r.os
+		}
+	}
+
+	if 0 != len(c.DHCPFingerprint) {
+		fingerprint := strings.Replace(c.DHCPFingerprint, " ", "", -1)
+		for _, r := range dhcpRules {
+			if r.pattern.MatchString(fingerprint) {
+				apply(r)
+				break
+			}
+		}
+	}
+	// Rules are tried in order across every announcement, so the earlier
+	// ones win whichever announcement was heard first
+	announcements := hints.announcements()
+	for _, r := range announcementRules {
+		for _, announcement := range announcements {
+			if r.pattern.MatchString(announcement) {
+				apply(r)
+				break
+			}
+		}
+	}
+	if 0 != len(c.Name) {
+		for _, r := range hostnameRules {
+			if r.pattern.MatchString(c.Name) {
+				apply(r)
+			}
+		}
+	}
+	if 0 != len(c.Vendor) {
+		for _, r := range vendorRules {
+			if r.pattern.MatchString(c.Vendor) {
+				apply(r)
+			}
+		}
+	}
+	return deviceType, os
+}
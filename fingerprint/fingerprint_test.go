@@ -0,0 +1,105 @@
+package fingerprint
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     router.Client
+		hints      Hints
+		deviceType router.DeviceType
+		os         router.OSFamily
+	}{
+		{"nothing known", router.Client{}, Hints{}, router.DeviceTypeUnknown, router.OSUnknown},
+		{"iphone hostname", router.Client{Name: "Janes-iPhone"}, Hints{}, router.DeviceTypePhone, router.OSApple},
+		{"windows hostname", router.Client{Name: "DESKTOP-AB12CD3"}, Hints{}, router.DeviceTypeComputer, router.OSWindows},
+		{"vendor only", router.Client{Vendor: "Espressif Inc."}, Hints{}, router.DeviceTypeIoT, router.OSUnknown},
+		{"apple vendor", router.Client{Vendor: "Apple, Inc."}, Hints{}, router.DeviceTypeUnknown, router.OSApple},
+		{"vendor fills in the os", router.Client{Name: "tv-lounge", Vendor: "Apple, Inc."}, Hints{},
+			router.DeviceTypeTV, router.OSApple},
+		{"announcement wins over hostname", router.Client{Name: "Janes-iPhone"},
+			Hints{Services: []string{"_googlecast._tcp"}}, router.DeviceTypeTV, router.OSApple},
+		{"sonos before media renderer", router.Client{},
+			Hints{SSDP: []string{"urn:schemas-upnp-org:device:MediaRenderer:1", "Linux UPnP/1.0 Sonos/70.3"}},
+			router.DeviceTypeIoT, router.OSLinux},
+		{"printer model", router.Client{}, Hints{Models: []string{"HP LaserJet Pro"}}, router.DeviceTypePrinter,
+			router.OSUnknown},
+		{"macbook model", router.Client{}, Hints{Models: []string{"MacBookPro18,1"}}, router.DeviceTypeLaptop,
+			router.OSApple},
+		{"windows DHCP fingerprint", router.Client{DHCPFingerprint: "1,3,6,15,31,33,43,44,46,47,119,121,249,252"},
+			Hints{}, router.DeviceTypeUnknown, router.OSWindows},
+		{"apple DHCP fingerprint", router.Client{DHCPFingerprint: "1, 121, 3, 6, 15, 119, 252, 95, 44, 46"},
+			Hints{}, router.DeviceTypeUnknown, router.OSApple},
+		{"DHCP fingerprint wins the os", router.Client{Name: "DESKTOP-AB12CD3", DHCPFingerprint: "1,28,2,3,15,6,119,12"},
+			Hints{}, router.DeviceTypeComputer, router.OSLinux},
+		{"unknown DHCP fingerprint", router.Client{Name: "Janes-iPhone", DHCPFingerprint: "1,3,6"},
+			Hints{}, router.DeviceTypePhone, router.OSApple},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deviceType, os := Classify(test.client, test.hints)
+			if deviceType != test.deviceType || os != test.os {
+				t.Errorf("got %q, %q, want %q, %q", deviceType, os, test.deviceType, test.os)
+			}
+		})
+	}
+}
+
+func TestServiceType(t *testing.T) {
+	tests := map[string]string{
+		"Office Printer._ipp._tcp.local": "_ipp._tcp",
+		"_googlecast._tcp.local":         "_googlecast._tcp",
+		"_services._dns-sd._udp.local":   "",
+		"printer.local":                  "",
+	}
+	for name, want := range tests {
+		if got := serviceType(name); got != want {
+			t.Errorf("serviceType(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestListenerMDNS(t *testing.T) {
+	l := NewListener()
+	l.mdns("192.168.1.20", announcement())
+	want := Hints{Services: []string{"_ipp._tcp"}, Models: []string{"Laser1"}, SSDP: []string{}}
+	if got := l.Hints("192.168.1.20"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Queries and malformed packets are ignored
+	query := announcement()
+	query[2] = 0
+	l.mdns("192.168.1.21", query)
+	l.mdns("192.168.1.21", query[:20])
+	if got := l.Hints("192.168.1.21"); 0 != len(got.Services) || 0 != len(got.Models) {
+		t.Errorf("got hints %+v from a query", got)
+	}
+}
+
+func TestListenerStartStop(t *testing.T) {
+	l := NewListener()
+	l.Start(context.Background())
+	l.Start(context.Background())
+	if nil == l.stop {
+		t.Fatal("not listening after Start")
+	}
+	l.Stop()
+	if nil != l.stop {
+		t.Error("still listening after Stop")
+	}
+	l.Stop()
+
+	// Listening can start again after stopping
+	l.Start(context.Background())
+	defer l.Stop()
+	if nil == l.stop {
+		t.Error("not listening after starting again")
+	}
+}
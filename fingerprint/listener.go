@@ -0,0 +1,199 @@
+package fingerprint
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multicast groups announcements are heard on
+var (
+	mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+)
+
+// hintsTTL is how long an address's announcements are remembered
+const hintsTTL = 24 * time.Hour
+
+// maxHintValues bounds how many of each kind of hint are kept per address
+const maxHintValues = 16
+
+// Listener passively collects the mDNS and SSDP announcements made on the
+// local network, by the IP address they came from
+type Listener struct {
+	mu    sync.Mutex
+	hints map[string]*heard
+	stop  context.CancelFunc // nil when not listening
+}
+
+type heard struct {
+	Hints
+	at time.Time
+}
+
+// NewListener returns a listener that hasn't heard anything yet
+func NewListener() *Listener {
+	return &Listener{hints: make(map[string]*heard)}
+}
+
+// Start listening until the context is cancelled or Stop is called. Groups
+// that can't be joined are logged and skipped.
+func (l *Listener) Start(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if nil != l.stop {
+		return
+	}
+	ctx, l.stop = context.WithCancel(ctx)
+	l.listen(ctx, "mDNS", mdnsAddr, l.mdns)
+	l.listen(ctx, "SSDP", ssdpAddr, l.ssdp)
+}
+
+// Stop listening. What was already heard is kept until it expires.
+func (l *Listener) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if nil != l.stop {
+		l.stop()
+		l.stop = nil
+	}
+}
+
+// Hints returns what was announced from the IP address
+func (l *Listener) Hints(ip string) Hints {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, prs := l.hints[ip]
+	if !prs || time.Since(h.at) > hintsTTL {
+		return Hints{}
+	}
+	return Hints{
+		Services: append([]string{}, h.Services...),
+		Models:   append([]string{}, h.Models...),
+		SSDP:     append([]string{}, h.SSDP...),
+	}
+}
+
+func (l *Listener) listen(ctx context.Context, name string, group *net.UDPAddr, handle func(ip string, packet []byte)) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if nil != err {
+		log.Printf("Cannot listen for %s announcements: %v", name, err)
+		return
+	}
+	log.Printf("Listening for %s announcements on %s", name, group)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if nil != err {
+				if nil == ctx.Err() {
+					log.Printf("Stopped listening for %s announcements: %v", name, err)
+				}
+				return
+			}
+			handle(from.IP.String(), buf[:n])
+		}
+	}()
+}
+
+// mdns records the service types and models announced in an mDNS response
+func (l *Listener) mdns(ip string, packet []byte) {
+	m, err := parseDNS(packet)
+	if nil != err || !m.Response {
+		// Queries say what a device is looking for, not what it is
+		return
+	}
+	l.update(ip, func(h *Hints) {
+		for _, r := range m.Records {
+			if service := serviceType(r.Name); 0 != len(service) {
+				h.Services = addHint(h.Services, service)
+			}
+			for _, txt := range r.TXT {
+				kv := strings.SplitN(txt, "=", 2)
+				if 2 != len(kv) || 0 == len(kv[1]) {
+					continue
+				}
+				switch strings.ToLower(kv[0]) {
+				case "md", "model", "ty", "usb_mdl":
+					h.Models = addHint(h.Models, kv[1])
+				}
+			}
+		}
+	})
+}
+
+// ssdp records the SERVER and NT headers of an SSDP NOTIFY
+func (l *Listener) ssdp(ip string, packet []byte) {
+	if !bytes.HasPrefix(packet, []byte("NOTIFY ")) {
+		return
+	}
+	// NOTIFY is formatted like an HTTP request
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if nil != err {
+		return
+	}
+	l.update(ip, func(h *Hints) {
+		for _, header := range []string{"Server", "Nt"} {
+			if value := req.Header.Get(header); 0 != len(value) {
+				h.SSDP = addHint(h.SSDP, value)
+			}
+		}
+	})
+}
+
+func (l *Listener) update(ip string, change func(h *Hints)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	h, prs := l.hints[ip]
+	if !prs || now.Sub(h.at) > hintsTTL {
+		h = &heard{}
+		l.hints[ip] = h
+	}
+	h.at = now
+	change(&h.Hints)
+
+	for addr, old := range l.hints {
+		if now.Sub(old.at) > hintsTTL {
+			delete(l.hints, addr)
+		}
+	}
+}
+
+// serviceType returns the service type, e.g. _ipp._tcp, in a DNS-SD name
+// like "Office Printer._ipp._tcp.local"
+func serviceType(name string) string {
+	labels := strings.Split(name, ".")
+	for i := 0; i+1 < len(labels); i++ {
+		proto := labels[i+1]
+		if strings.HasPrefix(labels[i], "_") && ("_tcp" == proto || "_udp" == proto) {
+			if "_dns-sd" == labels[i] {
+				return ""
+			}
+			return labels[i] + "." + proto
+		}
+	}
+	return ""
+}
+
+func addHint(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	if len(values) >= maxHintValues {
+		return values
+	}
+	return append(values, value)
+}
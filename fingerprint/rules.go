@@ -0,0 +1,77 @@
+package fingerprint
+
+import (
+	"regexp"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// rule sets the device type and OS family, when they're known, of clients
+// matching the pattern. Patterns are case insensitive.
+type rule struct {
+	pattern    *regexp.Regexp
+	deviceType router.DeviceType
+	os         router.OSFamily
+}
+
+func newRule(pattern string, deviceType router.DeviceType, os router.OSFamily) rule {
+	return rule{pattern: regexp.MustCompile("(?i)" + pattern), deviceType: deviceType, os: os}
+}
+
+// dhcpRules match the DHCP parameter request list as comma separated option
+// numbers. The first match wins.
+var dhcpRules = []rule{
+	// Only Windows asks for the Microsoft classless static route option
+	newRule(`(^|,)249(,|$)`, router.DeviceTypeUnknown, router.OSWindows),
+	newRule(`^1,121,3,6,15,(114,)?119,252`, router.DeviceTypeUnknown, router.OSApple),
+	newRule(`^1,3,6,15,26,28,51,58,59`, router.DeviceTypeUnknown, router.OSAndroid),
+	newRule(`^1,(121,)?33,3,6,(15,)?28,51,58,59`, router.DeviceTypeUnknown, router.OSAndroid),
+	// dhclient
+	newRule(`^1,28,2,3,15,6,119,12`, router.DeviceTypeUnknown, router.OSLinux),
+}
+
+// announcementRules match mDNS service types, models and SSDP headers
+var announcementRules = []rule{
+	// Sonos announce themselves as media renderers, so they come first
+	newRule(`sonos|_spotify-connect\._tcp|_hap\._tcp|_matter\._tcp|google home|google nest`, router.DeviceTypeIoT, router.OSUnknown),
+	newRule(`_googlecast\._tcp|chromecast|_androidtvremote|_amzn-wplay\._tcp|roku|dial-multiscreen|mediarenderer|appletv`, router.DeviceTypeTV, router.OSUnknown),
+	newRule(`_ipps?\._tcp|_printer\._tcp|_pdl-datastream\._tcp|_uscan\._tcp|device:printer|laserjet|officejet|deskjet`, router.DeviceTypePrinter, router.OSUnknown),
+	newRule(`xbox`, router.DeviceTypeConsole, router.OSWindows),
+	newRule(`macbook`, router.DeviceTypeLaptop, router.OSApple),
+	newRule(`imac|macmini|macpro|mac1[0-9],`, router.DeviceTypeComputer, router.OSApple),
+	newRule(`iphone`, router.DeviceTypePhone, router.OSApple),
+	newRule(`ipad`, router.DeviceTypeTablet, router.OSApple),
+	newRule(`_companion-link\._tcp`, router.DeviceTypeUnknown, router.OSApple),
+	newRule(`windows`, router.DeviceTypeUnknown, router.OSWindows),
+	newRule(`linux`, router.DeviceTypeUnknown, router.OSLinux),
+}
+
+// hostnameRules match the client's hostname
+var hostnameRules = []rule{
+	newRule(`iphone`, router.DeviceTypePhone, router.OSApple),
+	newRule(`ipad`, router.DeviceTypeTablet, router.OSApple),
+	newRule(`macbook|^mbp`, router.DeviceTypeLaptop, router.OSApple),
+	newRule(`imac|mac-?mini|mac-?pro|mac-?studio`, router.DeviceTypeComputer, router.OSApple),
+	newRule(`apple-?tv`, router.DeviceTypeTV, router.OSApple),
+	newRule(`^(android|galaxy|pixel|oneplus|redmi|xiaomi|moto|sm-[a-z][0-9])`, router.DeviceTypePhone, router.OSAndroid),
+	// Windows names new installs DESKTOP-XXXXXXX or LAPTOP-XXXXXXX
+	newRule(`^desktop-[a-z0-9]{7}$`, router.DeviceTypeComputer, router.OSWindows),
+	newRule(`^laptop-[a-z0-9]{7}$`, router.DeviceTypeLaptop, router.OSWindows),
+	newRule(`chromecast|roku|fire-?tv|bravia|webos|samsung-?tv|-tv$|^tv-`, router.DeviceTypeTV, router.OSUnknown),
+	// Brother printers are named BRN and their MAC
+	newRule(`printer|^brn[0-9a-f]{12}$|^npi[0-9a-f]{6}|^epson|^canon|^hp[0-9a-f]{6}`, router.DeviceTypePrinter, router.OSUnknown),
+	newRule(`xbox|playstation|^ps[345]|nintendo|^switch`, router.DeviceTypeConsole, router.OSUnknown),
+	newRule(`^esp[-_]|tasmota|shelly|sonoff|^nest|^ring-|wemo|tuya|philips-hue|hue-bridge|^echo|thermostat|^wled`, router.DeviceTypeIoT, router.OSUnknown),
+	newRule(`raspberrypi|ubuntu|debian|fedora`, router.DeviceTypeComputer, router.OSLinux),
+	newRule(`android`, router.DeviceTypeUnknown, router.OSAndroid),
+}
+
+// vendorRules match the client's vendor
+var vendorRules = []rule{
+	newRule(`espressif|tuya|philips lighting|signify|nest labs|sonos|ecobee|belkin`, router.DeviceTypeIoT, router.OSUnknown),
+	newRule(`roku`, router.DeviceTypeTV, router.OSUnknown),
+	newRule(`nintendo|sony interactive`, router.DeviceTypeConsole, router.OSUnknown),
+	newRule(`brother|canon|seiko epson|lexmark|xerox`, router.DeviceTypePrinter, router.OSUnknown),
+	newRule(`raspberry pi`, router.DeviceTypeComputer, router.OSLinux),
+	newRule(`apple`, router.DeviceTypeUnknown, router.OSApple),
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/disrvptor/wifi_client_watch/fingerprint"
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// fingerprintClients guesses the device type and OS of clients the driver
+// didn't classify itself
+func fingerprintClients(clients []router.Client) {
+	for i := range clients {
+		c := &clients[i]
+		deviceType, os := fingerprint.Classify(*c, application.discovery.Hints(c.IP))
+		if router.DeviceTypeUnknown == c.DeviceType {
+			c.DeviceType = deviceType
+		}
+		if router.OSUnknown == c.OS {
+			c.OS = os
+		}
+	}
+}
+
+// setDiscovery starts or stops listening for announcements as
+// passive_discovery changes
+func setDiscovery(oldValue *string, newValue *string) {
+	if discover, _ := application.preferences.Get("passive_discovery"); nil != discover && "true" == *discover {
+		application.discovery.Start(context.Background())
+	} else {
+		application.discovery.Stop()
+	}
+}
+
+// alertsDeviceType is whether the site alerts about clients of the device
+// type. alert_device_types is a comma separated list of the types to alert
+// about, where unknown matches unclassified clients, or empty for all.
+func alertsDeviceType(s *site, deviceType router.DeviceType) bool {
+	raw, prs := s.preference("alert_device_types")
+	if !prs || 0 == len(strings.TrimSpace(*raw)) {
+		return true
+	}
+	name := string(deviceType)
+	if router.DeviceTypeUnknown == deviceType {
+		name = "unknown"
+	}
+	for _, t := range strings.Split(*raw, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), name) {
+			return true
+		}
+	}
+	return false
+}
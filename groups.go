@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// Group alert policies. A group's alert_policy is a comma separated list of
+// the events to notify, or never. Members of groups without one alert by
+// their device status.
+const (
+	// groupAlertNew notifies when a member is first seen
+	groupAlertNew = "new"
+	// groupAlertOffline notifies when a member goes offline or drops off
+	groupAlertOffline = "offline"
+	// groupAlertNever never notifies
+	groupAlertNever = "never"
+)
+
+var groupAlerts = []string{groupAlertNew, groupAlertOffline, groupAlertNever}
+
+var (
+	errUnknownGroup = errors.New("unknown group")
+	errInvalidGroup = errors.New("invalid group")
+)
+
+// group is a named set of devices. Devices are members when they match any
+// of its rules: a vendor containing Vendor, a hostname or device name
+// matching NamePattern, a MAC starting with MACPrefix or having Tag.
+type group struct {
+	Name           string `json:"name"`
+	Vendor         string `json:"vendor,omitempty"`
+	NamePattern    string `json:"name_pattern,omitempty"`
+	MACPrefix      string `json:"mac_prefix,omitempty"`
+	Tag            string `json:"tag,omitempty"`
+	AlertPolicy    string `json:"alert_policy,omitempty"`
+	NotificationTo string `json:"notification_to,omitempty"` // comma separated, instead of notification_to
+	Template       string `json:"template,omitempty"`        // text/template for the group's alerts
+	// AbsenceThreshold is how many seconds members can be offline before
+	// they're alerted as absent, 0 not to watch them
+	AbsenceThreshold int `json:"absence_threshold,omitempty"`
+	// Probe is how members' reported state is verified, instead of the
+	// site's verify_probe preference
+	Probe   string   `json:"probe,omitempty"`
+	Members []string `json:"members"`
+
+	namePattern *regexp.Regexp
+	template    *template.Template
+}
+
+// groupFields are the fields that can be set with action=add and update
+var groupFields = []string{"vendor", "name_pattern", "mac_prefix", "tag", "alert_policy", "notification_to", "template",
+	"absence_threshold", "probe"}
+
+// groupSubject is what group rules are matched against
+type groupSubject struct {
+	mac      string
+	hostname string
+	name     string
+	vendor   string
+	tags     []string
+}
+
+// alertPolicy is the combined alert policy of a device's groups. A device in
+// any group that never notifies isn't notified.
+type alertPolicy struct {
+	set     bool
+	new     bool
+	offline bool
+	never   bool
+}
+
+// alertData is what notification templates are executed with
+type alertData struct {
+	Site    string
+	Message string
+	Kind    string
+	Status  string
+	Client  router.Client
+	Name    string
+	Owner   string
+	Groups  []string
+	Tags    []string
+}
+
+// readGroups creates the device_groups table
+func readGroups(app *wifiClientWatchApp) {
+	sqlStmt := `
+	create table IF NOT EXISTS device_groups (name text not null primary key, vendor text, name_pattern text,
+		mac_prefix text, tag text, alert_policy text, notification_to text, template text);
+	`
+	_, err := app.db.Exec(sqlStmt)
+	if err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+		return
+	}
+	err = addMissingColumns(app.db, "device_groups", []string{"absence_threshold integer not null default 0",
+		"probe text"})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// compile checks the group's rules and prepares its pattern and template
+func (g *group) compile() error {
+	var err error
+	g.namePattern, g.template = nil, nil
+	if 0 != len(g.NamePattern) {
+		if g.namePattern, err = regexp.Compile("(?i)" + g.NamePattern); nil != err {
+			return fmt.Errorf("%w: name_pattern: %v", errInvalidGroup, err)
+		}
+	}
+	if 0 != len(g.Template) {
+		if g.template, err = template.New(g.Name).Parse(g.Template); nil != err {
+			return fmt.Errorf("%w: template: %v", errInvalidGroup, err)
+		}
+	}
+	policies := splitTags(g.AlertPolicy)
+	for _, p := range policies {
+		if !contains(groupAlerts, p) {
+			return fmt.Errorf("%w: unknown alert_policy %s", errInvalidGroup, p)
+		}
+	}
+	if contains(policies, groupAlertNever) && 1 != len(policies) {
+		return fmt.Errorf("%w: alert_policy never can't be combined", errInvalidGroup)
+	}
+	g.AlertPolicy = strings.Join(policies, ",")
+	probes, err := parseProbes(g.Probe)
+	if nil != err {
+		return fmt.Errorf("%w: %v", errInvalidGroup, err)
+	}
+	g.Probe = strings.Join(probes, ",")
+	g.MACPrefix = canonicalMAC(g.MACPrefix)
+	return nil
+}
+
+// matches is whether the subject is a member of the group
+func (g *group) matches(s groupSubject) bool {
+	switch {
+	case 0 != len(g.Vendor) && strings.Contains(strings.ToLower(s.vendor), strings.ToLower(g.Vendor)):
+	case nil != g.namePattern && 0 != len(s.hostname) && g.namePattern.MatchString(s.hostname):
+	case nil != g.namePattern && 0 != len(s.name) && g.namePattern.MatchString(s.name):
+	case 0 != len(g.MACPrefix) && strings.HasPrefix(s.mac, g.MACPrefix):
+	case 0 != len(g.Tag) && contains(s.tags, g.Tag):
+	default:
+		return false
+	}
+	return true
+}
+
+// loadGroups returns every group, compiled. Groups that no longer compile
+// are logged and left out.
+func loadGroups() ([]*group, error) {
+	rows, err := application.db.Query(`select name, coalesce(vendor, ''), coalesce(name_pattern, ''),
+		coalesce(mac_prefix, ''), coalesce(tag, ''), coalesce(alert_policy, ''), coalesce(notification_to, ''),
+		coalesce(template, ''), absence_threshold, coalesce(probe, '') from device_groups order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make([]*group, 0)
+	for rows.Next() {
+		g := &group{}
+		err = rows.Scan(&g.Name, &g.Vendor, &g.NamePattern, &g.MACPrefix, &g.Tag, &g.AlertPolicy, &g.NotificationTo,
+			&g.Template, &g.AbsenceThreshold, &g.Probe)
+		if err != nil {
+			return nil, err
+		}
+		if err = g.compile(); nil != err {
+			log.Printf("Skipping group %s: %v", g.Name, err)
+			continue
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// memberOf returns the groups the subject is a member of
+func memberOf(s groupSubject, groups []*group) []*group {
+	member := make([]*group, 0)
+	for _, g := range groups {
+		if g.matches(s) {
+			member = append(member, g)
+		}
+	}
+	return member
+}
+
+func groupNames(groups []*group) []string {
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+// groupsAlertPolicy combines the alert policies of the groups
+func groupsAlertPolicy(groups []*group) alertPolicy {
+	var policy alertPolicy
+	for _, g := range groups {
+		for _, p := range splitTags(g.AlertPolicy) {
+			policy.set = true
+			switch p {
+			case groupAlertNew:
+				policy.new = true
+			case groupAlertOffline:
+				policy.offline = true
+			case groupAlertNever:
+				policy.never = true
+			}
+		}
+	}
+	return policy
+}
+
+// groupAlert is the notification for a client change under its groups'
+// alert policy, or "" if there shouldn't be one
+func groupAlert(policy alertPolicy, change clientChange) string {
+	c := change.Client
+	switch {
+	case policy.never:
+		return ""
+	case policy.new && clientNew == change.Kind:
+		return fmt.Sprintf("New client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+	case policy.offline && (clientOffline == change.Kind || clientDropped == change.Kind):
+		return fmt.Sprintf("Disconnected client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+	}
+	return ""
+}
+
+// clientSubject is what's known about a client for matching it to groups.
+// Random MACs correlated with a device take its name and tags.
+func clientSubject(c router.Client) (groupSubject, error) {
+	s := groupSubject{mac: c.MAC, hostname: c.Name, vendor: c.Vendor, tags: []string{}}
+	var name, tags sql.NullString
+	err := application.db.QueryRow(`select coalesce(p.name, d.name), coalesce(p.tags, d.tags) from devices d
+		left join devices p on p.mac = d.alias_of where d.mac = ?`, c.MAC).Scan(&name, &tags)
+	if nil != err && sql.ErrNoRows != err {
+		return s, err
+	}
+	s.name, s.tags = name.String, splitTags(tags.String)
+	return s, nil
+}
+
+// sendClientAlert notifies the alert to the client's groups, formatted with
+// the first of their templates or the notification_template preference
+func sendClientAlert(s *site, alert string, change clientChange, status string, subject groupSubject, groups []*group) {
+	data := alertData{Site: s.Name, Message: alert, Kind: string(change.Kind), Status: status, Client: change.Client,
+		Name: subject.name, Groups: groupNames(groups), Tags: subject.tags}
+	var owner sql.NullString
+	err := application.db.QueryRow("select owner from devices where mac = ?", change.Client.MAC).Scan(&owner)
+	if nil != err && sql.ErrNoRows != err {
+		log.Printf("Cannot read the owner of %s: %v", change.Client.MAC, err)
+	}
+	data.Owner = owner.String
+
+	var tmpl *template.Template
+	for _, g := range groups {
+		if nil == tmpl {
+			tmpl = g.template
+		}
+	}
+	if raw, prs := s.preference("notification_template"); nil == tmpl && prs && 0 != len(*raw) {
+		if tmpl, err = template.New("notification_template").Parse(*raw); nil != err {
+			log.Printf("Cannot parse notification_template: %v", err)
+			tmpl = nil
+		}
+	}
+	message := alert
+	if nil != tmpl {
+		var b bytes.Buffer
+		if err = tmpl.Execute(&b, data); nil != err {
+			log.Printf("Cannot format alert with template %s: %v", tmpl.Name(), err)
+		} else {
+			message = b.String()
+		}
+	}
+
+	sendGroupNotification(s, groups, message)
+}
+
+// sendGroupNotification notifies the recipients of the groups, or
+// notification_to if none of them have any
+func sendGroupNotification(s *site, groups []*group, message string) {
+	recipients := make([]string, 0)
+	for _, g := range groups {
+		for _, to := range splitTags(g.NotificationTo) {
+			if !contains(recipients, to) {
+				recipients = append(recipients, to)
+			}
+		}
+	}
+	if 0 == len(recipients) {
+		sendNotification(s, message)
+		return
+	}
+	for _, to := range recipients {
+		sendNotificationTo(s, to, message)
+	}
+}
+
+// getGroup returns the group with its members, or errUnknownGroup
+func getGroup(name string) (*group, error) {
+	groups, err := loadGroups()
+	if nil != err {
+		return nil, err
+	}
+	for _, g := range groups {
+		if g.Name == name {
+			return g, addMembers([]*group{g})
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownGroup, name)
+}
+
+// listGroups returns every group with its members
+func listGroups() ([]*group, error) {
+	groups, err := loadGroups()
+	if nil != err {
+		return nil, err
+	}
+	return groups, addMembers(groups)
+}
+
+// addMembers sets the MACs in the inventory that are members of the groups
+func addMembers(groups []*group) error {
+	for _, g := range groups {
+		g.Members = make([]string, 0)
+	}
+	subjects, err := deviceSubjects()
+	if nil != err {
+		return err
+	}
+	for _, s := range subjects {
+		for _, g := range memberOf(s, groups) {
+			g.Members = append(g.Members, s.mac)
+		}
+	}
+	return nil
+}
+
+// deviceSubjects returns every device in the inventory for matching to
+// groups
+func deviceSubjects() ([]groupSubject, error) {
+	rows, err := application.db.Query(`select mac, coalesce(hostname, ''), coalesce(name, ''), coalesce(vendor, ''),
+		coalesce(tags, '') from devices order by mac`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subjects := make([]groupSubject, 0)
+	for rows.Next() {
+		var s groupSubject
+		var tags string
+		if err = rows.Scan(&s.mac, &s.hostname, &s.name, &s.vendor, &tags); err != nil {
+			return nil, err
+		}
+		s.tags = splitTags(tags)
+		subjects = append(subjects, s)
+	}
+	return subjects, rows.Err()
+}
+
+// filterDevices returns the devices in the group and with the tag, when
+// they're given
+func filterDevices(devices []device, name string, tag string) ([]device, error) {
+	if 0 == len(name) && 0 == len(tag) {
+		return devices, nil
+	}
+	members := make(map[string]bool)
+	if 0 != len(name) {
+		g, err := getGroup(name)
+		if nil != err {
+			return nil, err
+		}
+		for _, mac := range g.Members {
+			members[mac] = true
+		}
+	}
+	filtered := make([]device, 0)
+	for _, d := range devices {
+		if (0 == len(name) || members[d.MAC]) && (0 == len(tag) || contains(d.Tags, tag)) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered, nil
+}
+
+// saveGroup adds or replaces the group
+func saveGroup(g *group) error {
+	if err := g.compile(); nil != err {
+		return err
+	}
+	_, err := application.db.Exec(`insert into device_groups (name, vendor, name_pattern, mac_prefix, tag,
+		alert_policy, notification_to, template, absence_threshold, probe) values (?,?,?,?,?,?,?,?,?,?)
+		on conflict(name) do update set vendor = excluded.vendor, name_pattern = excluded.name_pattern,
+			mac_prefix = excluded.mac_prefix, tag = excluded.tag, alert_policy = excluded.alert_policy,
+			notification_to = excluded.notification_to, template = excluded.template,
+			absence_threshold = excluded.absence_threshold, probe = excluded.probe`,
+		g.Name, g.Vendor, g.NamePattern, g.MACPrefix, g.Tag, g.AlertPolicy, g.NotificationTo, g.Template,
+		g.AbsenceThreshold, g.Probe)
+	return err
+}
+
+// removeGroup removes the group
+func removeGroup(name string) error {
+	result, err := application.db.Exec("delete from device_groups where name = ?", name)
+	if nil != err {
+		return err
+	}
+	if n, _ := result.RowsAffected(); 0 == n {
+		return fmt.Errorf("%w: %s", errUnknownGroup, name)
+	}
+	return nil
+}
+
+// setField sets one of groupFields
+func (g *group) setField(field string, value string) error {
+	switch field {
+	case "vendor":
+		g.Vendor = value
+	case "name_pattern":
+		g.NamePattern = value
+	case "mac_prefix":
+		g.MACPrefix = value
+	case "tag":
+		g.Tag = strings.TrimSpace(value)
+	case "alert_policy":
+		g.AlertPolicy = value
+	case "notification_to":
+		g.NotificationTo = value
+	case "template":
+		g.Template = value
+	case "absence_threshold":
+		seconds, err := parseSeconds(value)
+		if nil != err {
+			return fmt.Errorf("%w: %v", errInvalidGroup, err)
+		}
+		g.AbsenceThreshold = seconds
+	case "probe":
+		g.Probe = value
+	}
+	return nil
+}
+
+// groupsHandler lists the groups and their members, and edits them with
+// action=add or action=update (name and any of groupFields), action=remove
+// (name) or reads one with action=get
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling groups request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	query := r.URL.Query()
+	name := strings.TrimSpace(query.Get("name"))
+	action := query.Get("action")
+	if 0 != len(action) && 0 == len(name) {
+		http.Error(w, "A name is required", http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	var err error
+	switch action {
+	case "add", "update":
+		g := &group{Name: name}
+		if "update" == action {
+			if g, err = getGroup(name); nil != err {
+				break
+			}
+		}
+		for _, field := range groupFields {
+			if values, prs := query[field]; prs && nil == err {
+				err = g.setField(field, values[0])
+			}
+		}
+		if nil == err {
+			err = saveGroup(g)
+		}
+		result = message{Message: "ok"}
+	case "remove":
+		err = removeGroup(name)
+		result = message{Message: "ok"}
+	case "get":
+		result, err = getGroup(name)
+	default:
+		result, err = listGroups()
+	}
+
+	if errors.Is(err, errUnknownGroup) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, errInvalidGroup) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if nil != err {
+		log.Println("Cannot handle groups request:", err)
+		http.Error(w, "Cannot read groups", 500)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Cannot read groups", 500)
+	} else {
+		w.Write(b)
+	}
+}
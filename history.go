@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// defaultHistoryRange is how far back /clients/{mac}/history looks when no
+// from time is given
+const defaultHistoryRange = 7 * 24 * time.Hour
+
+// session is a period a client was connected to a site. DisconnectedAt is
+// nil while the client is still connected.
+type session struct {
+	MAC            string     `json:"mac"`
+	Site           string     `json:"site"`
+	ConnectedAt    time.Time  `json:"connected_at"`
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
+	IP             string     `json:"ip,omitempty"`
+	Band           string     `json:"band,omitempty"`
+	Node           string     `json:"node,omitempty"`
+}
+
+// clientHistory is what /clients/{mac}/history reports
+type clientHistory struct {
+	MAC       string     `json:"mac"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Sessions  []session  `json:"sessions"`
+}
+
+// readHistory creates the sessions and devices tables, and opens sessions for
+// clients that were online before sessions were recorded
+func readHistory(app *wifiClientWatchApp) {
+	db := app.db
+	sqlStmt := `
+	create table IF NOT EXISTS sessions (id integer primary key autoincrement, mac text not null, site text not null,
+		connected_at timestamp not null, disconnected_at timestamp, ip text, band text, node text);
+	create index IF NOT EXISTS sessions_mac on sessions (mac, connected_at);
+	create table IF NOT EXISTS devices (mac text primary key, first_seen timestamp not null, last_seen timestamp);
+	`
+	_, err := db.Exec(sqlStmt)
+	if err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+		return
+	}
+
+	now := historyTime(time.Now())
+	_, err = db.Exec(`
+	insert into sessions (mac, site, connected_at, ip, band, node)
+		select mac, site, ?, ip, band, node from clients c where online and not exists
+			(select 1 from sessions s where s.mac = c.mac and s.site = c.site and s.disconnected_at is null);
+	insert or ignore into devices (mac, first_seen, last_seen)
+		select mac, ?, case when max(online) then ? end from clients group by mac;
+	`, now, now, now)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// recordHistory opens and closes the site's sessions for the changes from
+// the last poll and updates when each device was seen
+func recordHistory(s *site, changes []clientChange, clients []router.Client) {
+	now := historyTime(time.Now())
+	tx, err := application.db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	open := func(c router.Client) {
+		_, err := tx.Exec(`insert into sessions (mac, site, connected_at, ip, band, node) values (?,?,?,?,?,?);`,
+			c.MAC, s.Name, now, c.IP, c.Band, c.Node)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	closeSession := func(c router.Client) {
+		_, err := tx.Exec(`update sessions set disconnected_at = ?
+			where mac = ? and site = ? and disconnected_at is null;`, now, c.MAC, s.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, change := range changes {
+		switch change.Kind {
+		case clientNew:
+			if change.Client.Online {
+				open(change.Client)
+			}
+		case clientOnline:
+			open(change.Client)
+		case clientOffline, clientDropped:
+			closeSession(change.Client)
+		case clientRoamed:
+			// A session is spent on a single node
+			closeSession(change.Client)
+			open(change.Client)
+		}
+	}
+
+	for _, c := range clients {
+		var lastSeen *time.Time
+		if c.Online {
+			lastSeen = &now
+		}
+		// The hostname, vendor and IP last reported are what anomalies are
+		// detected against
+		_, err = tx.Exec(`insert into devices (mac, first_seen, last_seen, hostname, vendor, ip, random, client_id)
+			values (?,?,?,?,?,?,?,?)
+			on conflict(mac) do update set last_seen = coalesce(excluded.last_seen, last_seen),
+				hostname = coalesce(nullif(excluded.hostname, ''), hostname),
+				vendor = coalesce(nullif(excluded.vendor, ''), vendor), ip = coalesce(nullif(excluded.ip, ''), ip),
+				random = excluded.random, client_id = coalesce(nullif(excluded.client_id, ''), client_id);`,
+			c.MAC, now, lastSeen, c.Name, c.Vendor, c.IP, router.IsRandomMAC(c.MAC), c.ClientID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// historyTime is how times are stored so they compare correctly in SQL
+func historyTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// clientPathHandler serves /clients/{mac}/... The ServeMux in go 1.13 can't
+// match path variables, so the path is split here.
+func clientPathHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/clients/"), "/"), "/")
+	switch {
+	case 2 == len(parts) && "history" == parts[1]:
+		clientHistoryHandler(w, r, parts[0])
+		return
+	case 2 == len(parts) && ("block" == parts[1] || "unblock" == parts[1]):
+		clientBlockHandler(w, r, parts[0], "block" == parts[1])
+		return
+	case 2 == len(parts) && "actions" == parts[1]:
+		clientActionsHandler(w, r, parts[0], "")
+		return
+	case 3 == len(parts) && "actions" == parts[1] && 0 != len(parts[2]):
+		clientActionsHandler(w, r, parts[0], parts[2])
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// clientHistoryHandler returns the sessions of a client overlapping the from
+// and to query parameters, which are RFC 3339 times defaulting to the last
+// week. The site query parameter limits them to one site.
+func clientHistoryHandler(w http.ResponseWriter, r *http.Request, rawMAC string) {
+	log.Printf("Handling client history request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+
+	to := time.Now()
+	if raw := r.URL.Query().Get("to"); 0 != len(raw) {
+		t, err := time.Parse(time.RFC3339, raw)
+		if nil != err {
+			http.Error(w, "Invalid to time", http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-defaultHistoryRange)
+	if raw := r.URL.Query().Get("from"); 0 != len(raw) {
+		t, err := time.Parse(time.RFC3339, raw)
+		if nil != err {
+			http.Error(w, "Invalid from time", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+
+	history := clientHistory{MAC: canonicalMAC(rawMAC), Sessions: make([]session, 0)}
+	var lastSeen sql.NullTime
+	err := application.db.QueryRow("select first_seen, last_seen from devices where mac = ?", history.MAC).
+		Scan(&history.FirstSeen, &lastSeen)
+	if sql.ErrNoRows == err {
+		http.Error(w, "Unknown client", http.StatusNotFound)
+		return
+	} else if nil != err {
+		log.Println("Cannot read device:", err)
+		http.Error(w, "Cannot read client history", 500)
+		return
+	}
+	if lastSeen.Valid {
+		history.LastSeen = &lastSeen.Time
+	}
+
+	siteName := r.URL.Query().Get("site")
+	rows, err := application.db.Query(`select mac, site, connected_at, disconnected_at, ip, band, node from sessions
+		where mac = ? and (? = '' or site = ?) and connected_at < ? and (disconnected_at is null or disconnected_at >= ?)
+		order by connected_at`, history.MAC, siteName, siteName, historyTime(to), historyTime(from))
+	if nil != err {
+		log.Println("Cannot read sessions:", err)
+		http.Error(w, "Cannot read client history", 500)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ss session
+		var disconnectedAt sql.NullTime
+		var ip, band, node sql.NullString
+		err = rows.Scan(&ss.MAC, &ss.Site, &ss.ConnectedAt, &disconnectedAt, &ip, &band, &node)
+		if nil != err {
+			log.Println("Cannot read session:", err)
+			http.Error(w, "Cannot read client history", 500)
+			return
+		}
+		if disconnectedAt.Valid {
+			ss.DisconnectedAt = &disconnectedAt.Time
+		}
+		ss.IP, ss.Band, ss.Node = ip.String, band.String, node.String
+		history.Sessions = append(history.Sessions, ss)
+	}
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		http.Error(w, "Cannot read client history", 500)
+	} else {
+		w.Write(b)
+	}
+}
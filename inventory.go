@@ -0,0 +1,415 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device statuses
+const (
+	// deviceNew hasn't been reviewed yet. It alerts when first seen and
+	// whenever it connects.
+	deviceNew = "new"
+	// deviceTrusted alerts when it connects
+	deviceTrusted = "trusted"
+	// deviceIgnored never alerts
+	deviceIgnored = "ignored"
+	// deviceSuspicious alerts when it connects and disconnects
+	deviceSuspicious = "suspicious"
+)
+
+var deviceStatuses = []string{deviceNew, deviceTrusted, deviceIgnored, deviceSuspicious}
+
+var (
+	errUnknownStatus      = errors.New("unknown device status")
+	errUnknownDevice      = errors.New("unknown device")
+	errUnknownCorrelation = errors.New("unknown correlation")
+	errInvalidPresence    = errors.New("presence must be true or false")
+	errInvalidThreshold   = errors.New("absence_threshold must be seconds or a duration")
+)
+
+// device is a MAC in the inventory
+type device struct {
+	MAC       string     `json:"mac"`
+	Status    string     `json:"status"`
+	Name      string     `json:"name,omitempty"`
+	Owner     string     `json:"owner,omitempty"`
+	Notes     string     `json:"notes,omitempty"`
+	Tags      []string   `json:"tags"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Random    bool       `json:"random"`
+	ClientID  string     `json:"client_id,omitempty"`
+	Correlate string     `json:"correlate,omitempty"`
+	AliasOf   string     `json:"alias_of,omitempty"`
+	Presence  bool       `json:"presence"`
+	// AbsenceThreshold is how many seconds the device can be offline before
+	// it's alerted as absent, 0 not to watch it
+	AbsenceThreshold int        `json:"absence_threshold,omitempty"`
+	AbsentSince      *time.Time `json:"absent_since,omitempty"`
+	Blocked          bool       `json:"blocked"`
+}
+
+// deviceState is the status a client alerts with, which for a random MAC
+// correlated with another device is that device's status
+type deviceState struct {
+	status  string
+	aliasOf string
+	name    string
+	tags    []string
+}
+
+// auditEntry is a change made to a device
+type auditEntry struct {
+	MAC      string    `json:"mac"`
+	At       time.Time `json:"at"`
+	Field    string    `json:"field"`
+	OldValue string    `json:"old_value"`
+	NewValue string    `json:"new_value"`
+	By       string    `json:"by,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// deviceFields are the fields that can be edited with action=update
+var deviceFields = []string{"name", "owner", "notes", "tags", "correlate", "presence", "absence_threshold"}
+
+// readInventory adds the inventory columns to the devices table and moves
+// the old ignored MACs into it
+func readInventory(app *wifiClientWatchApp) {
+	db := app.db
+	err := addMissingColumns(db, "devices", []string{
+		"status text not null default 'new'", "name text", "owner text", "notes text", "tags text",
+		"hostname text", "vendor text", "ip text", "random bool", "client_id text", "correlate text", "alias_of text",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sqlStmt := `
+	create table IF NOT EXISTS device_audit (id integer primary key autoincrement, mac text not null,
+		at timestamp not null, field text not null, old_value text, new_value text, by text, reason text);
+	create index IF NOT EXISTS device_audit_mac on device_audit (mac, at);
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+		return
+	}
+	if err = migrateIgnoredMacs(db); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateIgnoredMacs marks the MACs in the old ignored_macs table as ignored
+// devices and drops it
+func migrateIgnoredMacs(db *sql.DB) error {
+	var count int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'ignored_macs'").Scan(&count)
+	if err != nil || 0 == count {
+		return err
+	}
+
+	log.Println("Moving ignored MACs to the device inventory")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := historyTime(time.Now())
+	_, err = tx.Exec(`
+	insert into device_audit (mac, at, field, old_value, new_value, by, reason)
+		select i.mac, ?, 'status', coalesce(d.status, 'new'), 'ignored', 'migration', 'ignored_macs'
+		from ignored_macs i left join devices d on d.mac = i.mac where i.ignore;
+	insert into devices (mac, first_seen, status) select mac, ?, 'ignored' from ignored_macs where ignore
+		on conflict(mac) do update set status = excluded.status;
+	drop table ignored_macs;
+	`, now, now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// canonicalMAC formats a MAC from a request the way routers report them
+func canonicalMAC(mac string) string {
+	return strings.ToUpper(strings.Replace(strings.TrimSpace(mac), "-", ":", -1))
+}
+
+// deviceStatus is the MAC's status, new if it isn't in the inventory yet
+func deviceStatus(mac string) (string, error) {
+	var status string
+	err := application.db.QueryRow(`select coalesce(p.status, d.status) from devices d
+		left join devices p on p.mac = d.alias_of where d.mac = ?`, mac).Scan(&status)
+	if sql.ErrNoRows == err {
+		return deviceNew, nil
+	}
+	return status, err
+}
+
+// deviceStates returns the state of every device in the inventory
+func deviceStates() (map[string]deviceState, error) {
+	states := make(map[string]deviceState)
+	rows, err := application.db.Query(`select d.mac, coalesce(p.status, d.status), coalesce(d.alias_of, ''),
+		coalesce(p.name, d.name, ''), coalesce(p.tags, d.tags, '') from devices d left join devices p on p.mac = d.alias_of`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mac string
+		var state deviceState
+		var tags string
+		if err = rows.Scan(&mac, &state.status, &state.aliasOf, &state.name, &tags); err != nil {
+			return nil, err
+		}
+		state.tags = splitTags(tags)
+		states[mac] = state
+	}
+	return states, rows.Err()
+}
+
+const deviceColumns = "mac, status, name, owner, notes, tags, first_seen, last_seen, random, client_id, correlate, alias_of, presence, absence_threshold, absent_since, blocked"
+
+func scanDevice(row interface{ Scan(...interface{}) error }) (device, error) {
+	var d device
+	var name, owner, notes, tags, clientID, correlate, aliasOf sql.NullString
+	var lastSeen, absentSince sql.NullTime
+	var random, presence, blocked sql.NullBool
+	var threshold sql.NullInt64
+	err := row.Scan(&d.MAC, &d.Status, &name, &owner, &notes, &tags, &d.FirstSeen, &lastSeen, &random, &clientID,
+		&correlate, &aliasOf, &presence, &threshold, &absentSince, &blocked)
+	d.Blocked = blocked.Bool
+	d.Presence, d.AbsenceThreshold = presence.Bool, int(threshold.Int64)
+	if absentSince.Valid {
+		d.AbsentSince = &absentSince.Time
+	}
+	d.Name, d.Owner, d.Notes = name.String, owner.String, notes.String
+	d.Random, d.ClientID, d.Correlate, d.AliasOf = random.Bool, clientID.String, correlate.String, aliasOf.String
+	d.Tags = splitTags(tags.String)
+	if lastSeen.Valid {
+		d.LastSeen = &lastSeen.Time
+	}
+	return d, err
+}
+
+// listDevices returns the devices with the status, or every device if it's
+// empty
+func listDevices(status string) ([]device, error) {
+	rows, err := application.db.Query("select "+deviceColumns+" from devices where ? = '' or status = ? order by mac",
+		status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]device, 0)
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// getDevice returns the device, or errUnknownDevice
+func getDevice(mac string) (device, error) {
+	d, err := scanDevice(application.db.QueryRow("select "+deviceColumns+" from devices where mac = ?", mac))
+	if sql.ErrNoRows == err {
+		return d, fmt.Errorf("%w: %s", errUnknownDevice, mac)
+	}
+	return d, err
+}
+
+// setDeviceStatus moves a device to the status, adding it to the inventory
+// if it hasn't been seen yet
+func setDeviceStatus(mac string, status string, by string, reason string) error {
+	if !contains(deviceStatuses, status) {
+		return fmt.Errorf("%w: %s", errUnknownStatus, status)
+	}
+	return updateDevice(mac, map[string]string{"status": status}, by, reason)
+}
+
+// updateDevice sets the device's fields, recording each change in the audit
+// trail
+func updateDevice(mac string, fields map[string]string, by string, reason string) error {
+	tx, err := application.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := historyTime(time.Now())
+	_, err = tx.Exec("insert or ignore into devices (mac, first_seen) values (?, ?)", mac, now)
+	if err != nil {
+		return err
+	}
+	for field, value := range fields {
+		if "tags" == field {
+			value = strings.Join(splitTags(value), ",")
+		}
+		if "correlate" == field && !contains(correlations, value) {
+			return fmt.Errorf("%w: %s", errUnknownCorrelation, value)
+		}
+		if "presence" == field {
+			presence, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errInvalidPresence, value)
+			}
+			// Stored as a number so it can be tested in SQL
+			value = "0"
+			if presence {
+				value = "1"
+			}
+		}
+		if "absence_threshold" == field {
+			seconds, err := parseSeconds(value)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errInvalidThreshold, value)
+			}
+			value = strconv.Itoa(seconds)
+		}
+		var old sql.NullString
+		// field is one of deviceFields or status, never user input
+		err = tx.QueryRow(fmt.Sprintf("select %s from devices where mac = ?", field), mac).Scan(&old)
+		if err != nil {
+			return err
+		}
+		if old.String == value {
+			continue
+		}
+		_, err = tx.Exec(fmt.Sprintf("update devices set %s = ? where mac = ?", field), value, mac)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`insert into device_audit (mac, at, field, old_value, new_value, by, reason)
+			values (?,?,?,?,?,?,?)`, mac, now, field, old.String, value, by, reason)
+		if err != nil {
+			return err
+		}
+		log.Printf("Device %s %s changed from '%s' to '%s'", mac, field, old.String, value)
+	}
+	return tx.Commit()
+}
+
+// deviceAudit returns the changes made to a device, oldest first
+func deviceAudit(mac string) ([]auditEntry, error) {
+	rows, err := application.db.Query(`select mac, at, field, old_value, new_value, by, reason from device_audit
+		where mac = ? order by at, id`, mac)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]auditEntry, 0)
+	for rows.Next() {
+		var e auditEntry
+		var old, value, by, reason sql.NullString
+		if err = rows.Scan(&e.MAC, &e.At, &e.Field, &old, &value, &by, &reason); err != nil {
+			return nil, err
+		}
+		e.OldValue, e.NewValue, e.By, e.Reason = old.String, value.String, by.String, reason.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func splitTags(raw string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(raw, ",") {
+		tag = strings.TrimSpace(tag)
+		if 0 != len(tag) && !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// clientAlert is the notification for a client change given the device's
+// status and its groups' alert policy, or "" if there shouldn't be one.
+// Group policies, even never, don't apply to suspicious devices.
+func clientAlert(status string, policy alertPolicy, change clientChange) string {
+	c := change.Client
+	switch {
+	case deviceIgnored == status:
+		return ""
+	case policy.set && deviceSuspicious != status:
+		return groupAlert(policy, change)
+	case clientNew == change.Kind && deviceNew == status:
+		return fmt.Sprintf("New client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+	case (clientNew == change.Kind && c.Online) || clientOnline == change.Kind:
+		if deviceSuspicious == status {
+			return fmt.Sprintf("Suspicious client %s connected (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+		}
+		return fmt.Sprintf("Connected client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+	case (clientOffline == change.Kind || clientDropped == change.Kind) && deviceSuspicious == status:
+		return fmt.Sprintf("Suspicious client %s disconnected (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+	}
+	return ""
+}
+
+// devicesHandler lists the inventory, optionally by status, group and tag,
+// and edits it with action=status (mac, status and reason) or action=update
+// (mac and any of name, owner, notes, tags, correlate, presence and
+// absence_threshold), or reads a device's changes with action=audit
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling devices request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	query := r.URL.Query()
+	mac := canonicalMAC(query.Get("mac"))
+	action := query.Get("action")
+	if 0 != len(action) && 0 == len(mac) {
+		http.Error(w, "A mac is required", http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	var err error
+	switch action {
+	case "status":
+		err = setDeviceStatus(mac, query.Get("status"), r.RemoteAddr, query.Get("reason"))
+		result = message{Message: "ok"}
+	case "update":
+		fields := make(map[string]string)
+		for _, field := range deviceFields {
+			if values, prs := query[field]; prs {
+				fields[field] = values[0]
+			}
+		}
+		err = updateDevice(mac, fields, r.RemoteAddr, query.Get("reason"))
+		result = message{Message: "ok"}
+	case "audit":
+		result, err = deviceAudit(mac)
+	case "get":
+		result, err = getDevice(mac)
+	default:
+		var devices []device
+		if devices, err = listDevices(query.Get("status")); nil == err {
+			result, err = filterDevices(devices, query.Get("group"), query.Get("tag"))
+		}
+	}
+
+	if errors.Is(err, errUnknownStatus) || errors.Is(err, errUnknownCorrelation) || errors.Is(err, errInvalidPresence) ||
+		errors.Is(err, errInvalidThreshold) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errUnknownDevice) || errors.Is(err, errUnknownGroup) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if nil != err {
+		log.Println("Cannot handle devices request:", err)
+		http.Error(w, "Cannot read devices", 500)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Cannot read devices", 500)
+	} else {
+		w.Write(b)
+	}
+}
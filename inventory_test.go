@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+func TestClientAlert(t *testing.T) {
+	c := router.Client{MAC: "00:11:22:33:44:01", Name: "phone", IP: "192.168.1.10", Online: true}
+	newClient := clientChange{Kind: clientNew, Client: c}
+	online := clientChange{Kind: clientOnline, Client: c}
+	offline := clientChange{Kind: clientOffline, Client: c}
+	none := alertPolicy{}
+	never := alertPolicy{set: true, never: true}
+	offlineOnly := alertPolicy{set: true, offline: true}
+
+	tests := []struct {
+		name   string
+		status string
+		policy alertPolicy
+		change clientChange
+		want   string
+	}{
+		{"new device", deviceNew, none, newClient, "New client phone (MAC=00:11:22:33:44:01, IP=192.168.1.10)"},
+		{"trusted connects", deviceTrusted, none, online,
+			"Connected client phone (MAC=00:11:22:33:44:01, IP=192.168.1.10)"},
+		{"trusted disconnects", deviceTrusted, none, offline, ""},
+		{"ignored", deviceIgnored, none, online, ""},
+		{"ignored in a group", deviceIgnored, offlineOnly, offline, ""},
+		{"suspicious disconnects", deviceSuspicious, none, offline,
+			"Suspicious client phone disconnected (MAC=00:11:22:33:44:01, IP=192.168.1.10)"},
+		{"group policy", deviceTrusted, offlineOnly, offline,
+			"Disconnected client phone (MAC=00:11:22:33:44:01, IP=192.168.1.10)"},
+		{"group policy instead of status", deviceTrusted, offlineOnly, online, ""},
+		{"never group", deviceNew, never, newClient, ""},
+		{"never wins in a group", deviceTrusted, alertPolicy{set: true, offline: true, never: true}, offline, ""},
+		// Suspicious devices alert whatever their groups' policy
+		{"suspicious in a never group connects", deviceSuspicious, never, online,
+			"Suspicious client phone connected (MAC=00:11:22:33:44:01, IP=192.168.1.10)"},
+		{"suspicious in a never group disconnects", deviceSuspicious, never, offline,
+			"Suspicious client phone disconnected (MAC=00:11:22:33:44:01, IP=192.168.1.10)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := clientAlert(test.status, test.policy, test.change); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -1,29 +1,38 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/disrvptor/wifi_client_watch/events"
+	"github.com/disrvptor/wifi_client_watch/fingerprint"
 	"github.com/disrvptor/wifi_client_watch/notification"
 	"github.com/disrvptor/wifi_client_watch/preferences"
 	"github.com/disrvptor/wifi_client_watch/router"
+	"github.com/disrvptor/wifi_client_watch/scheduler"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type wifiClientWatchApp struct {
-	clients       []router.Client
-	ignoredMacs   []string
-	myRouter      interface{ router.Router }
+	sitesMu       sync.RWMutex // guards sites, which reloading replaces
+	sites         []*site
 	notifications interface{ notification.Notification }
 	preferences   preferences.Preferences
+	outbox        *notification.Outbox
+	scheduler     *scheduler.Scheduler
+	discovery     *fingerprint.Listener
+	events        *events.Bus
 	dbFile        string
-	stopPoller    chan bool
-	ticker        *time.Ticker
+	db            *sql.DB
+	server        *http.Server
 }
 
 var application *wifiClientWatchApp
@@ -32,26 +41,6 @@ type message struct {
 	Message string `json:"message"`
 }
 
-func ignoreClient(mac string) {
-	log.Printf("Ignoring client %s", mac)
-	if contains(application.ignoredMacs, mac) {
-		log.Printf("Already ignoring %s", mac)
-	} else {
-		application.ignoredMacs = append(application.ignoredMacs, mac)
-		// TODO: Serialize this in the DB
-	}
-}
-
-func unignoreClient(mac string) {
-	log.Printf("Unignoring client %s", mac)
-	if !contains(application.ignoredMacs, mac) {
-		log.Printf("Already unignoring %s", mac)
-	} else {
-		// TODO: Remove MAC from the list
-		// TODO: Serialize this in the DB
-	}
-}
-
 // Not for production use!!
 func enableCors(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
@@ -62,18 +51,20 @@ func clientsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	enableCors(&w)
 	switch r.URL.Query().Get("action") {
-	case "ignore":
-		mac := r.URL.Query().Get("mac")
-		ignoreClient(mac)
-		b, err := json.Marshal(message{Message: "ok"})
-		if err != nil {
-			http.Error(w, "Cannot create ok message", 500)
-		} else {
-			w.Write(b)
+	case "ignore", "unignore":
+		// Kept for older clients, see /devices
+		status := deviceIgnored
+		if "unignore" == r.URL.Query().Get("action") {
+			status = deviceNew
+		}
+		mac := canonicalMAC(r.URL.Query().Get("mac"))
+		log.Printf("Setting client %s to %s", mac, status)
+		err := setDeviceStatus(mac, status, r.RemoteAddr, "")
+		if nil != err {
+			log.Println("Cannot set device status:", err)
+			http.Error(w, "Cannot set device status", 500)
+			return
 		}
-	case "unignore":
-		mac := r.URL.Query().Get("mac")
-		unignoreClient(mac)
 		b, err := json.Marshal(message{Message: "ok"})
 		if err != nil {
 			http.Error(w, "Cannot create ok message", 500)
@@ -82,15 +73,51 @@ func clientsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	case "ignored":
 		log.Println("Returning ignored MACs")
-		b, err := json.Marshal(application.ignoredMacs)
-		if err != nil {
+		devices, err := listDevices(deviceIgnored)
+		macs := make([]string, 0, len(devices))
+		for _, d := range devices {
+			macs = append(macs, d.MAC)
+		}
+		b, err2 := json.Marshal(macs)
+		if nil != err || nil != err2 {
 			http.Error(w, "Cannot read ignored MACs", 500)
 		} else {
 			w.Write(b)
 		}
 	default:
 		log.Println("Returning clients")
-		b, err := json.Marshal(application.clients)
+		states, err := deviceStates()
+		if nil != err {
+			log.Println("Cannot read the inventory:", err)
+			http.Error(w, "Cannot read clients", http.StatusInternalServerError)
+			return
+		}
+		groups, err := loadGroups()
+		if nil != err {
+			log.Println("Cannot read the groups:", err)
+			http.Error(w, "Cannot read clients", http.StatusInternalServerError)
+			return
+		}
+		group, tag := r.URL.Query().Get("group"), r.URL.Query().Get("tag")
+		clients := make([]siteClient, 0)
+		for _, s := range requestedSites(r) {
+			s.mu.Lock()
+			for _, c := range s.clients {
+				state, prs := states[c.MAC]
+				if !prs {
+					state.status, state.tags = deviceNew, []string{}
+				}
+				subject := groupSubject{mac: c.MAC, hostname: c.Name, name: state.name, vendor: c.Vendor, tags: state.tags}
+				member := groupNames(memberOf(subject, groups))
+				if (0 != len(group) && !contains(member, group)) || (0 != len(tag) && !contains(state.tags, tag)) {
+					continue
+				}
+				clients = append(clients, siteClient{Site: s.Name, Status: state.status, Random: router.IsRandomMAC(c.MAC),
+					AliasOf: state.aliasOf, Groups: member, Tags: state.tags, Client: c})
+			}
+			s.mu.Unlock()
+		}
+		b, err := json.Marshal(clients)
 		if err != nil {
 			http.Error(w, "Cannot read clients", 500)
 		} else {
@@ -99,6 +126,72 @@ func clientsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// requestedSites returns the site named by the site query parameter, or
+// every site if there isn't one
+func requestedSites(r *http.Request) []*site {
+	name := r.URL.Query().Get("site")
+	if 0 == len(name) {
+		return application.allSites()
+	}
+	s := findSite(name)
+	if nil == s {
+		return []*site{}
+	}
+	return []*site{s}
+}
+
+func nodesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling nodes request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	nodes := make([]siteNode, 0)
+	for _, s := range requestedSites(r) {
+		s.mu.Lock()
+		for _, n := range s.nodes {
+			nodes = append(nodes, siteNode{Site: s.Name, Node: n})
+		}
+		s.mu.Unlock()
+	}
+	b, err := json.Marshal(nodes)
+	if err != nil {
+		http.Error(w, "Cannot read nodes", 500)
+	} else {
+		w.Write(b)
+	}
+}
+
+func sitesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling sites request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	sites := make([]siteInfo, 0)
+	for _, s := range requestedSites(r) {
+		sites = append(sites, s.info())
+	}
+	b, err := json.Marshal(sites)
+	if err != nil {
+		http.Error(w, "Cannot read sites", 500)
+	} else {
+		w.Write(b)
+	}
+}
+
+func driversHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling router drivers request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	drivers := make([]driverInfo, 0)
+	for _, d := range router.Drivers() {
+		drivers = append(drivers, driverInfo{Driver: d, Capabilities: d.Capabilities()})
+	}
+	b, err := json.Marshal(drivers)
+	if err != nil {
+		http.Error(w, "Cannot read router drivers", 500)
+	} else {
+		w.Write(b)
+	}
+}
+
 func prefsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Handling preferences request")
 	w.Header().Set("Content-Type", "application/json")
@@ -108,6 +201,10 @@ func prefsHandler(w http.ResponseWriter, r *http.Request) {
 		name := r.URL.Query().Get("name")
 		value := r.URL.Query().Get("value")
 		secure, _ := strconv.ParseBool(r.URL.Query().Get("secure"))
+		if isSecretPreference(name) {
+			// Router secrets are never stored in the clear
+			secure = true
+		}
 		log.Printf("Setting preference %s=%s, secure=%t", name, value, secure)
 		application.preferences.Set(name, value, secure)
 		b, err := json.Marshal(message{Message: "ok"})
@@ -118,7 +215,7 @@ func prefsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	default:
 		log.Println("Returning preferences")
-		b, err := json.Marshal(application.preferences)
+		b, err := json.Marshal(&application.preferences)
 		if err != nil {
 			http.Error(w, "Cannot read preferences", 500)
 		} else {
@@ -127,107 +224,207 @@ func prefsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func checkClients() {
-	log.Println("Beginning checking clients")
-
-	url, prs := application.preferences.Get("url")
-	if !prs {
-		log.Println("No router URL defined")
-		log.Println("Ended checking clients")
-		return
-	}
-	username, prs := application.preferences.Get("username")
-	if !prs {
-		log.Println("No router Username defined")
-		log.Println("Ended checking clients")
-		return
+func checkClients(ctx context.Context, s *site) error {
+	log.Printf("Beginning checking clients for site %s", s.Name)
+	s.routerMu.Lock()
+	defer s.routerMu.Unlock()
+
+	// Bound the whole poll so a hung router can't block the next one
+	if rawTimeout, prs := s.preference("poll_timeout"); prs {
+		if timeout, err := strconv.Atoi(*rawTimeout); nil == err && timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+			defer cancel()
+		}
 	}
-	password, prs := application.preferences.Get("password")
-	if !prs {
-		log.Println("No router Password defined")
+
+	myRouter, err := s.currentRouter()
+	if nil != err {
+		log.Println("An error occurred creating the router:", err)
 		log.Println("Ended checking clients")
-		return
+		return err
 	}
 
-	err := (application.myRouter).Connect(*url, *username, *password)
+	err = myRouter.Connect(ctx)
+	s.checkCertificate(myRouter, err)
 	if nil != err {
 		log.Println("An error occurred establishing a connection:", err)
 		log.Println("Ended checking clients")
-		return
+		return err
 	}
 
 	// Get the clients
-	newClients, err := (application.myRouter).Clients()
+	newClients, err := myRouter.Clients(ctx)
+	s.checkCertificate(myRouter, err)
 	if err != nil {
 		log.Println("An error occurred retrieving the client list:", err)
+		log.Println("Ended checking clients")
+		return err
 	}
-
-	// TODO: Compare clients and newClients for differences
-	if nil != application.clients {
-		// droppedClients := make([]asuswrtapi.Client, 0)
-		for _, c := range application.clients {
-			c2 := findClient(c.MAC, newClients)
-			if nil == c2 {
-				// droppedClients = append(droppedClients, c)
-				log.Printf("Dropped client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
-			} else if c.Online && !c2.Online {
-				log.Printf("Offlined client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+	router.LookupVendors(newClients)
+	fingerprintClients(newClients)
+	groups, err := loadGroups()
+	if nil != err {
+		log.Println("An error occurred reading the groups:", err)
+		log.Println("Ended checking clients")
+		return err
+	}
+	previous := s.lastClients()
+	verifyClients(ctx, s, previous, newClients, groups)
+
+	checkNodes(ctx, s)
+
+	changes := diffClients(previous, newClients)
+	for _, change := range changes {
+		c := change.Client
+		status, err := alertStatus(s, &change)
+		var subject groupSubject
+		if nil == err {
+			subject, err = clientSubject(c)
+		}
+		presence := false
+		if nil == err {
+			presence, err = isPresenceDevice(c.MAC)
+		}
+		if nil != err {
+			log.Printf("Cannot check whether to alert about client %s: %v", c.MAC, err)
+		} else {
+			member := memberOf(subject, groups)
+			// People's presence devices are notified as them arriving and leaving instead
+			alert := clientAlert(status, groupsAlertPolicy(member), change)
+			if 0 != len(alert) && alertsDeviceType(s, c.DeviceType) && !presence {
+				sendClientAlert(s, alert, change, status, subject, member)
 			}
 		}
+		switch change.Kind {
+		case clientDropped:
+			log.Printf("Dropped client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+		case clientOffline:
+			log.Printf("Offlined client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+		case clientRoamed:
+			log.Printf("Roamed client %s (MAC=%s, IP=%s) from node %s to %s", c.Name, c.MAC, c.IP, change.Previous.Node, c.Node)
+		case clientNew:
+			log.Printf("New client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+			startFastPolling(s)
+			announceAutoBlock(s, c)
+		case clientOnline:
+			log.Printf("Onlined client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
+		}
+		publishEvent(s, string(change.Kind), c.MAC, changeMessage(change), c)
 	}
 
 	if nil != newClients {
-		// addedClients := make([]asuswrtapi.Client, 0)
-		for _, c := range newClients {
-			c2 := findClient(c.MAC, application.clients)
-			if nil == c2 {
-				// addedClients = append(addedClients, c)
-				log.Printf("New client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
-				if !contains(application.ignoredMacs, c.MAC) {
-					sendNotification(fmt.Sprintf("New client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP))
-				}
-			} else if !c2.Online && c.Online {
-				log.Printf("Onlined client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP)
-				if !contains(application.ignoredMacs, c.MAC) {
-					sendNotification(fmt.Sprintf("Connected client %s (MAC=%s, IP=%s)", c.Name, c.MAC, c.IP))
-				}
-			}
+		if known, err := knownDevices(); nil != err {
+			log.Println("Cannot read the inventory to detect anomalies:", err)
+		} else {
+			raiseAnomalies(s, detectAnomalies(s, newClients, known), known)
 		}
+		recordHistory(s, changes, newClients)
+		autoBlock(ctx, s, newClients)
 
 		// Save the list of new clients in the DB
-		db, err := sql.Open("sqlite3", "./wifi_client_watch.db")
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer db.Close()
-		_, err = db.Exec("delete from clients;")
+		db := application.db
+		_, err = db.Exec("delete from clients where site = ?;", s.Name)
 		if err != nil {
 			log.Fatal(err)
 		}
 		stmt, err := db.Prepare(`
-		insert into clients (name, ip, mac, vendor, online) values (?,?,?,?,?)
-			on conflict(mac) do update set name = ?, ip = ?, vendor = ?, online = ?;
+		insert into clients (site, name, ip, mac, vendor, online, medium, band, ssid, guest, rssi, tx_rate, rx_rate, connected_since, node,
+			client_id, dhcp_fingerprint, device_type, os, router_online, reachable)
+			values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+			on conflict(site, mac) do update set name = excluded.name, ip = excluded.ip, vendor = excluded.vendor,
+				online = excluded.online, medium = excluded.medium, band = excluded.band, ssid = excluded.ssid,
+				guest = excluded.guest, rssi = excluded.rssi, tx_rate = excluded.tx_rate, rx_rate = excluded.rx_rate,
+				connected_since = excluded.connected_since, node = excluded.node, client_id = excluded.client_id,
+				dhcp_fingerprint = excluded.dhcp_fingerprint, device_type = excluded.device_type, os = excluded.os,
+				router_online = excluded.router_online, reachable = excluded.reachable;
 		`)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer stmt.Close()
 		for _, c := range newClients {
-			_, err = stmt.Exec(c.Name, c.IP, c.MAC, c.Vendor, c.Online, c.Name, c.IP, c.Vendor, c.Online)
+			_, err = stmt.Exec(s.Name, c.Name, c.IP, c.MAC, c.Vendor, c.Online, c.Medium, c.Band, c.SSID, c.Guest,
+				c.RSSI, c.TxRate, c.RxRate, c.ConnectedSince, c.Node, c.ClientID, c.DHCPFingerprint, c.DeviceType, c.OS,
+				c.RouterOnline, c.Reachable)
 			if err != nil {
 				log.Fatal(err)
 			}
 		}
 
 		// Save our list of the new clients
-		application.clients = newClients
+		s.mu.Lock()
+		s.clients = newClients
+		s.mu.Unlock()
+		if err := updatePresence(); nil != err {
+			log.Printf("Cannot update who's home: %v", err)
+		}
+		checkAbsence()
 	}
 	log.Println("Ended checking clients")
+	return nil
 }
 
-func sendNotification(message string) {
+// checkNodes refreshes the mesh nodes of routers that have them and notifies
+// when a node goes offline or comes back
+func checkNodes(ctx context.Context, s *site) {
+	meshRouter, ok := s.myRouter.(router.MeshRouter)
+	if !ok {
+		return
+	}
+
+	newNodes, err := meshRouter.Nodes(ctx)
+	if err != nil {
+		log.Println("An error occurred retrieving the node list:", err)
+		return
+	}
+
+	previous := s.lastNodes()
+	for _, n := range newNodes {
+		n2 := findNode(n.MAC, previous)
+		if nil == n2 {
+			log.Printf("New node %s (MAC=%s, IP=%s)", n.Name, n.MAC, n.IP)
+		} else if n2.Online && !n.Online {
+			log.Printf("Offlined node %s (MAC=%s, IP=%s)", n.Name, n.MAC, n.IP)
+			sendNotification(s, fmt.Sprintf("Node %s went offline (MAC=%s, IP=%s)", n.Name, n.MAC, n.IP))
+		} else if !n2.Online && n.Online {
+			log.Printf("Onlined node %s (MAC=%s, IP=%s)", n.Name, n.MAC, n.IP)
+			sendNotification(s, fmt.Sprintf("Node %s is back online (MAC=%s, IP=%s)", n.Name, n.MAC, n.IP))
+		}
+	}
+	for _, n := range previous {
+		if nil == findNode(n.MAC, newNodes) {
+			log.Printf("Dropped node %s (MAC=%s, IP=%s)", n.Name, n.MAC, n.IP)
+			sendNotification(s, fmt.Sprintf("Node %s was removed from the mesh (MAC=%s, IP=%s)", n.Name, n.MAC, n.IP))
+		}
+	}
+
+	s.mu.Lock()
+	s.nodes = newNodes
+	s.mu.Unlock()
+}
+
+func sendNotification(s *site, message string) {
+	notify(fmt.Sprintf("[%s] %s", s.Name, message))
+}
+
+// sendNotificationTo queues a notification about the site for a recipient
+// other than notification_to
+func sendNotificationTo(s *site, to string, message string) {
+	notifyTo(to, fmt.Sprintf("[%s] %s", s.Name, message))
+}
+
+// notify queues a notification that isn't about a single site
+func notify(message string) {
 	to, _ := application.preferences.Get("notification_to")
-	application.notifications.Send(*to, message, &application.preferences)
+	notifyTo(*to, message)
+}
+
+func notifyTo(to string, message string) {
+	err := application.outbox.Send(application.notifications, to, message)
+	if nil != err {
+		log.Printf("Cannot send notification: %v", err)
+	}
 }
 
 func contains(a []string, x string) bool {
@@ -248,93 +445,176 @@ func findClient(mac string, clients []router.Client) *router.Client {
 	return nil
 }
 
+func findNode(mac string, nodes []router.Node) *router.Node {
+	for _, n := range nodes {
+		if n.MAC == mac {
+			return &n
+		}
+	}
+	return nil
+}
+
 func readClients(app *wifiClientWatchApp) {
-	var dbClients = make([]router.Client, 0)
+	var dbClients = make(map[string][]router.Client)
 
 	log.Printf("Reading clients from '%s'", app.dbFile)
-	db, err := sql.Open("sqlite3", app.dbFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
+	db := app.db
 	sqlStmt := `
-	create table IF NOT EXISTS clients (name text, ip text, mac text primary key, vendor text, online bool);
+	create table IF NOT EXISTS clients (site text not null, name text, ip text, mac text, vendor text, online bool,
+		medium text, band text, ssid text, guest bool, rssi integer, tx_rate real, rx_rate real,
+		connected_since timestamp, node text, client_id text, dhcp_fingerprint text, device_type text, os text,
+		router_online bool, reachable bool, primary key (site, mac));
 	`
-	_, err = db.Exec(sqlStmt)
+	_, err := db.Exec(sqlStmt)
 	if err != nil {
 		log.Printf("%q: %s\n", err, sqlStmt)
 		return
 	}
+	// Databases created before there were sites are keyed by MAC alone
+	err = migrateClientsToSites(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Databases created before the optional client fields existed
+	err = addMissingColumns(db, "clients", []string{
+		"medium text", "band text", "ssid text", "guest bool", "rssi integer", "tx_rate real",
+		"rx_rate real", "connected_since timestamp", "node text", "client_id text", "dhcp_fingerprint text",
+		"device_type text", "os text", "router_online bool", "reachable bool",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	rows, err := db.Query("select name, ip, mac, vendor, online from clients")
+	rows, err := db.Query(`select site, name, ip, mac, vendor, online, medium, band, ssid, guest, rssi, tx_rate,
+		rx_rate, connected_since, node, client_id, dhcp_fingerprint, device_type, os, router_online, reachable
+		from clients`)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var name string
-		var ip string
-		var mac string
-		var vendor string
-		var online bool
-		err = rows.Scan(&name, &ip, &mac, &vendor, &online)
+		var c router.Client
+		var siteName string
+		var medium, band, ssid, node, clientID, dhcpFingerprint, deviceType, os sql.NullString
+		var guest, routerOnline, reachable sql.NullBool
+		var rssi sql.NullInt64
+		var txRate, rxRate sql.NullFloat64
+		var connectedSince sql.NullTime
+		err = rows.Scan(&siteName, &c.Name, &c.IP, &c.MAC, &c.Vendor, &c.Online, &medium, &band, &ssid, &guest, &rssi,
+			&txRate, &rxRate, &connectedSince, &node, &clientID, &dhcpFingerprint, &deviceType, &os, &routerOnline,
+			&reachable)
 		if err != nil {
 			log.Fatal(err)
 		}
-		dbClients = append(dbClients, router.Client{
-			Name:   name,
-			IP:     ip,
-			MAC:    mac,
-			Vendor: vendor,
-			Online: online,
-		})
+		c.Medium = router.Medium(medium.String)
+		c.Band = router.Band(band.String)
+		c.SSID = ssid.String
+		c.Guest = guest.Bool
+		c.Node = node.String
+		c.ClientID = clientID.String
+		c.DHCPFingerprint = dhcpFingerprint.String
+		c.DeviceType = router.DeviceType(deviceType.String)
+		c.OS = router.OSFamily(os.String)
+		// Clients saved before they were verified are as the router reported
+		c.RouterOnline = c.Online
+		if routerOnline.Valid {
+			c.RouterOnline = routerOnline.Bool
+		}
+		if reachable.Valid {
+			c.Reachable = &reachable.Bool
+		}
+		if rssi.Valid {
+			v := int(rssi.Int64)
+			c.RSSI = &v
+		}
+		if txRate.Valid {
+			c.TxRate = &txRate.Float64
+		}
+		if rxRate.Valid {
+			c.RxRate = &rxRate.Float64
+		}
+		if connectedSince.Valid {
+			c.ConnectedSince = &connectedSince.Time
+		}
+		dbClients[siteName] = append(dbClients[siteName], c)
 	}
 	err = rows.Err()
 	if err != nil {
 		log.Fatal(err)
 	}
-	application.clients = dbClients
+	for _, s := range app.allSites() {
+		clients, prs := dbClients[s.Name]
+		if !prs {
+			clients = make([]router.Client, 0)
+		}
+		s.mu.Lock()
+		s.clients = clients
+		s.mu.Unlock()
+	}
 }
 
-func readIgnoredMacs(app *wifiClientWatchApp) {
-	var ignoredMacs = make([]string, 0)
-
-	log.Printf("Reading ignored MACs from '%s'", app.dbFile)
-	db, err := sql.Open("sqlite3", app.dbFile)
-	if err != nil {
-		log.Fatal(err)
+// migrateClientsToSites rebuilds a clients table keyed by MAC alone so it's
+// keyed by site and MAC, moving the existing clients to the default site
+func migrateClientsToSites(db *sql.DB) error {
+	var count int
+	err := db.QueryRow("select count(*) from pragma_table_info('clients') where name = 'site'").Scan(&count)
+	if err != nil || count > 0 {
+		return err
 	}
-	defer db.Close()
-	sqlStmt := `
-	create table IF NOT EXISTS ignored_macs (mac text primary key, ignore bool);
-	`
-	_, err = db.Exec(sqlStmt)
+
+	log.Printf("Moving clients to site %s", defaultSite)
+	err = addMissingColumns(db, "clients", []string{
+		"medium text", "band text", "ssid text", "guest bool", "rssi integer", "tx_rate real",
+		"rx_rate real", "connected_since timestamp", "node text",
+	})
 	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
-		return
+		return err
 	}
+	_, err = db.Exec(`
+	alter table clients rename to clients_old;
+	create table clients (site text not null, name text, ip text, mac text, vendor text, online bool,
+		medium text, band text, ssid text, guest bool, rssi integer, tx_rate real, rx_rate real,
+		connected_since timestamp, node text, primary key (site, mac));
+	insert into clients select ?, name, ip, mac, vendor, online, medium, band, ssid, guest, rssi, tx_rate,
+		rx_rate, connected_since, node from clients_old;
+	drop table clients_old;
+	`, defaultSite)
+	return err
+}
 
-	rows, err := db.Query("select mac, ignore from ignored_macs")
+// addMissingColumns adds any of the column definitions (e.g. "band text")
+// that the table doesn't have yet
+func addMissingColumns(db *sql.DB, table string, columns []string) error {
+	rows, err := db.Query(fmt.Sprintf("pragma table_info(%s)", table))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer rows.Close()
+	existing := make(map[string]bool)
 	for rows.Next() {
-		var mac string
-		var ignored bool
-		err = rows.Scan(&mac, &ignored)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if ignored {
-			ignoredMacs = append(ignoredMacs, mac)
+		var cid int
+		var name, colType string
+		var notNull bool
+		var dflt sql.NullString
+		var pk int
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
 		}
+		existing[name] = true
 	}
-	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
+	rows.Close()
+
+	for _, column := range columns {
+		name := strings.Fields(column)[0]
+		if existing[name] {
+			continue
+		}
+		log.Printf("Adding column %s to %s", name, table)
+		if _, err = db.Exec(fmt.Sprintf("alter table %s add column %s;", table, column)); err != nil {
+			return err
+		}
 	}
-	application.ignoredMacs = ignoredMacs
+	return nil
 }
 
 func main() {
@@ -343,11 +623,38 @@ func main() {
 	}
 	// application.myRouter = &asuswrtapi.AsusRouter{}
 
+	// Every table shares one connection pool, closed on shutdown
+	db, err := sql.Open("sqlite3", application.dbFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	application.db = db
+
 	// readPreferences(application)
-	application.preferences.SetBackingStore(application.dbFile)
+	application.preferences.SetBackingStore(application.db)
 
 	// ensure default preferences
 	application.preferences.SetDefaultPreference("poll_time", "60")
+	application.preferences.SetDefaultPreference("poll_timeout", "30")
+	application.preferences.SetDefaultPreference("max_backoff", "900")
+	application.preferences.SetDefaultPreference("unreachable_after", "3")
+	application.preferences.SetDefaultPreference("fast_poll_time", "0")
+	application.preferences.SetDefaultPreference("fast_poll_duration", "300")
+	application.preferences.SetDefaultPreference("shutdown_timeout", "10")
+	application.preferences.SetDefaultPreference("random_mac_policy", randomMACAlert)
+	application.preferences.SetDefaultPreference("passive_discovery", "false")
+	application.preferences.SetDefaultPreference("alert_device_types", "")
+	application.preferences.SetDefaultPreference("away_grace", "600")
+	application.preferences.SetDefaultPreference("auto_block", "false")
+	application.preferences.SetDefaultPreference("auto_block_after", "300")
+	application.preferences.SetDefaultPreference("verify_probe", "")
+	application.preferences.SetDefaultPreference("verify_failures", "2")
+	application.preferences.SetDefaultPreference("verify_timeout", "2")
+	application.preferences.SetDefaultPreference("verify_ports", "")
+	application.preferences.SetDefaultPreference("max_events", strconv.Itoa(events.DefaultMaxEvents))
+	for _, t := range anomalyTypes {
+		application.preferences.SetDefaultPreference(fmt.Sprintf("notify_%s", t), "true")
+	}
 	application.preferences.SetDefaultPreference("url", "http://192.168.1.1")
 	application.preferences.SetDefaultPreference("username", "admin", true)
 	application.preferences.SetDefaultPreference("password", "admin", true)
@@ -359,23 +666,42 @@ func main() {
 	application.preferences.SetDefaultPreference("smtp_user", "user@gmail.com", true)
 	application.preferences.SetDefaultPreference("smtp_pass", "password", true)
 
-	rtr, prs := application.preferences.Get("router")
-	application.myRouter, prs = router.GetRouter(*rtr)
-	if !prs {
-		log.Fatalf("A router implementation for %s was not found", *rtr)
+	// Sites fall back to the global router, poll_time and router setting
+	// preferences unless they override them with site.<name>.*
+	application.preferences.SetDefaultPreference("sites", defaultSite)
+
+	loadSites()
+	if 0 == len(application.allSites()) {
+		log.Fatal("No sites could be loaded")
 	}
 
 	readClients(application)
-	readIgnoredMacs(application)
-
-	notif, prs := application.preferences.Get("notification")
-	application.notifications, prs = notification.GetNotification(*notif)
-	if !prs {
-		log.Fatalf("A notification implementation for %s was not found", *notif)
+	readHistory(application)
+	readInventory(application)
+	readAnomalies(application)
+	readPeople(application)
+	readGroups(application)
+	readAbsence(application)
+	readBlocking(application)
+	readEvents(application)
+
+	if !loadNotification() {
+		log.Fatal("No notification implementation could be loaded")
 	}
+	application.outbox = notification.NewOutbox(&application.preferences, 100)
 
-	startBackgroundTask(checkClients)
-	application.preferences.AddWatcher("poll_time", restartBackgroundTask)
+	application.discovery = fingerprint.NewListener()
+	setDiscovery(nil, nil)
+	application.preferences.AddWatcher("passive_discovery", setDiscovery)
+
+	application.scheduler = scheduler.New()
+	for _, s := range application.allSites() {
+		scheduleSite(s)
+	}
+	application.scheduler.Start(context.Background())
+	application.preferences.AddWatcher("poll_time", scheduleAllSites)
+	application.preferences.AddWatcher("max_backoff", scheduleAllSites)
+	application.preferences.AddWatcher("sites", reloadSites)
 
 	fs := http.FileServer(http.Dir("../wcwweb/dist/wcwweb"))
 	// // http.Handle("/ui/", http.StripPrefix("/ui", fs))
@@ -392,6 +718,17 @@ func main() {
 	// })
 
 	http.HandleFunc("/clients", clientsHandler)
+	http.HandleFunc("/clients/", clientPathHandler)
+	http.HandleFunc("/devices", devicesHandler)
+	http.HandleFunc("/anomalies", anomaliesHandler)
+	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/events/ws", eventsSocketHandler)
+	http.HandleFunc("/people", peopleHandler)
+	http.HandleFunc("/groups", groupsHandler)
+	http.HandleFunc("/nodes", nodesHandler)
+	http.HandleFunc("/routers/drivers", driversHandler)
+	http.HandleFunc("/sites", sitesHandler)
+	http.HandleFunc("/jobs", jobsHandler)
 	http.HandleFunc("/preferences", prefsHandler)
 	// http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 	// 	// The "/" pattern matches everything, so we need to check
@@ -405,5 +742,25 @@ func main() {
 	http.Handle("/", fs)
 
 	log.Printf("Starting server")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	application.server = &http.Server{Addr: ":8080"}
+	go func() {
+		err := application.server.ListenAndServe()
+		if nil != err && http.ErrServerClosed != err {
+			log.Fatal(err)
+		}
+	}()
+	handleSignals()
+}
+
+// loadNotification looks up the notification implementation named by the
+// notification preference
+func loadNotification() bool {
+	notif, _ := application.preferences.Get("notification")
+	impl, prs := notification.GetNotification(*notif)
+	if !prs {
+		log.Printf("A notification implementation for %s was not found", *notif)
+		return false
+	}
+	application.notifications = impl
+	return true
 }
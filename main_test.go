@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/events"
+	"github.com/disrvptor/wifi_client_watch/fingerprint"
+	"github.com/disrvptor/wifi_client_watch/notification"
+	"github.com/disrvptor/wifi_client_watch/preferences"
+	"github.com/disrvptor/wifi_client_watch/router"
+	"github.com/disrvptor/wifi_client_watch/router/routertest"
+)
+
+// recordingNotification keeps the messages it's asked to send
+type recordingNotification struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (n *recordingNotification) Send(to string, message string, prefs *preferences.Preferences) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func (n *recordingNotification) Messages() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string{}, n.messages...)
+}
+
+func (n *recordingNotification) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = nil
+}
+
+var testNotification = &recordingNotification{}
+
+func init() {
+	notification.AddNotification("test", testNotification)
+}
+
+// startTestApp sets the application up the way main does, on a scratch DB
+// and polling a router with the settings. The returned function flushes the
+// notifications and removes the DB.
+func startTestApp(t *testing.T, driver string, config router.Config) func() {
+	dir, err := ioutil.TempDir("", "wifi_client_watch")
+	if nil != err {
+		t.Fatal(err)
+	}
+	application = &wifiClientWatchApp{dbFile: filepath.Join(dir, "wifi_client_watch.db")}
+	db, err := sql.Open("sqlite3", application.dbFile)
+	if nil != err {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	application.db = db
+	testNotification.Reset()
+
+	application.preferences.SetBackingStore(db)
+	application.preferences.Set("sites", defaultSite)
+	application.preferences.Set("router", driver)
+	for name, value := range config {
+		application.preferences.Set(name, value)
+	}
+	application.preferences.Set("notification", "test")
+	application.preferences.Set("notification_to", "test")
+
+	loadSites()
+	readClients(application)
+	readHistory(application)
+	readInventory(application)
+	readAnomalies(application)
+	readPeople(application)
+	readGroups(application)
+	readAbsence(application)
+	readBlocking(application)
+	readEvents(application)
+	if !loadNotification() {
+		t.Fatal("the test notification wasn't registered")
+	}
+	application.outbox = notification.NewOutbox(&application.preferences, 100)
+	application.discovery = fingerprint.NewListener()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		application.outbox.Flush(ctx)
+		application.events.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestCheckClientsJoinLeave polls a fake router whose clients join, leave
+// and drop off between polls, checking the changes are seen on the right
+// poll
+func TestCheckClientsJoinLeave(t *testing.T) {
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	phone := router.Client{MAC: "00:11:22:33:44:01", Name: "phone", IP: "192.168.1.10", Online: true}
+	laptop := router.Client{MAC: "00:11:22:33:44:02", Name: "laptop", IP: "192.168.1.11", Online: true}
+	fake.SetClients(phone)
+	fake.At(2, func(f *routertest.Fake) { f.Join(laptop) })
+	fake.At(3, func(f *routertest.Fake) { f.Leave(phone.MAC) })
+	fake.At(4, func(f *routertest.Fake) { f.Drop(laptop.MAC) })
+	fake.At(5, func(f *routertest.Fake) { f.Join(phone) })
+
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+	s := findSite(defaultSite)
+
+	polls := []struct {
+		online  []string
+		offline []string
+		events  []string
+	}{
+		{[]string{phone.MAC}, nil, []string{events.TypeNew}},
+		{[]string{phone.MAC, laptop.MAC}, nil, []string{events.TypeNew}},
+		{[]string{laptop.MAC}, []string{phone.MAC}, []string{events.TypeOffline}},
+		{nil, []string{phone.MAC}, []string{events.TypeDropped}},
+		{[]string{phone.MAC}, nil, []string{events.TypeOnline}},
+		{[]string{phone.MAC}, nil, nil},
+	}
+	lastEvent := int64(0)
+	for i, poll := range polls {
+		if err := checkClients(context.Background(), s); nil != err {
+			t.Fatalf("poll %d: %v", i+1, err)
+		}
+
+		s.mu.Lock()
+		clients := append([]router.Client{}, s.clients...)
+		s.mu.Unlock()
+		if len(clients) != len(poll.online)+len(poll.offline) {
+			t.Errorf("poll %d: got %d clients, want %d", i+1, len(clients), len(poll.online)+len(poll.offline))
+		}
+		for _, mac := range poll.online {
+			if c := findClient(mac, clients); nil == c || !c.Online {
+				t.Errorf("poll %d: want %s online, got %+v", i+1, mac, c)
+			}
+		}
+		for _, mac := range poll.offline {
+			if c := findClient(mac, clients); nil == c || c.Online {
+				t.Errorf("poll %d: want %s offline, got %+v", i+1, mac, c)
+			}
+		}
+
+		sub, replay, err := application.events.Resume(lastEvent, events.Filter{Types: []string{events.TypeNew,
+			events.TypeOnline, events.TypeOffline, events.TypeDropped}})
+		if nil != err {
+			t.Fatal(err)
+		}
+		sub.Close()
+		types := make([]string, len(replay))
+		for j, e := range replay {
+			types[j] = e.Type
+			lastEvent = e.ID
+		}
+		if len(types) != len(poll.events) {
+			t.Errorf("poll %d: got events %v, want %v", i+1, types, poll.events)
+			continue
+		}
+		for j := range types {
+			if types[j] != poll.events[j] {
+				t.Errorf("poll %d: got events %v, want %v", i+1, types, poll.events)
+			}
+		}
+	}
+	if fake.Polls() != len(polls) {
+		t.Errorf("the router was polled %d times, want %d", fake.Polls(), len(polls))
+	}
+
+	// Clients going offline or dropping off aren't alerted by default
+	application.outbox.Flush(context.Background())
+	want := []string{
+		"[default] New client phone (MAC=00:11:22:33:44:01, IP=192.168.1.10)",
+		"[default] New client laptop (MAC=00:11:22:33:44:02, IP=192.168.1.11)",
+		"[default] Connected client phone (MAC=00:11:22:33:44:01, IP=192.168.1.10)",
+	}
+	if got := testNotification.Messages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got notifications %q, want %q", got, want)
+	}
+
+	// The clients are kept in the DB for the next start
+	var saved int
+	if err := application.db.QueryRow("select count(*) from clients where site = ?", s.Name).Scan(&saved); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != saved {
+		t.Errorf("got %d saved clients, want 1", saved)
+	}
+}
+
+// TestHandlersDBError checks requests that can't read the DB are answered
+// with an error instead of stopping the server
+func TestHandlersDBError(t *testing.T) {
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+	application.db.Close()
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+	}{
+		{"clients", clientsHandler, http.MethodGet, "/clients"},
+		{"groups", groupsHandler, http.MethodGet, "/groups"},
+		{"client actions", clientPathHandler, http.MethodGet, "/clients/00:11:22:33:44:01/actions"},
+		{"run client action", clientPathHandler, http.MethodPost, "/clients/00:11:22:33:44:01/actions/ping"},
+		// The router blocks the client but it can't be recorded
+		{"block client", clientPathHandler, http.MethodPost, "/clients/00:11:22:33:44:01/block"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.handler(w, httptest.NewRequest(test.method, test.target, nil))
+			if http.StatusInternalServerError != w.Code {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+		})
+	}
+}
+
+// TestCheckClientsReload polls while the clients are reloaded, as SIGHUP
+// does, for go test -race
+func TestCheckClientsReload(t *testing.T) {
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	fake.SetClients(router.Client{MAC: "00:11:22:33:44:01", Name: "phone", IP: "192.168.1.10", Online: true})
+	fake.SetNodes(router.Node{MAC: "00:11:22:33:44:AA", Name: "main", Online: true})
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+	s := findSite(defaultSite)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			readClients(application)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := checkClients(context.Background(), s); nil != err {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
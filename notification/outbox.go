@@ -0,0 +1,89 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/disrvptor/wifi_client_watch/preferences"
+)
+
+var (
+	// ErrOutboxFull is returned when too many notifications are waiting to
+	// be sent
+	ErrOutboxFull = errors.New("notification outbox is full")
+	// ErrOutboxClosed is returned when sending after the outbox was flushed
+	ErrOutboxClosed = errors.New("notification outbox is closed")
+)
+
+// Outbox sends notifications in the background so a slow notification
+// service doesn't hold up the caller
+type Outbox struct {
+	prefs  *preferences.Preferences
+	mu     sync.Mutex // guards closed and sends on queue
+	closed bool
+	queue  chan outboxMessage
+	done   chan struct{}
+}
+
+type outboxMessage struct {
+	notification Notification
+	to           string
+	message      string
+}
+
+// NewOutbox starts an outbox holding up to size unsent notifications
+func NewOutbox(prefs *preferences.Preferences, size int) *Outbox {
+	o := &Outbox{
+		prefs: prefs,
+		queue: make(chan outboxMessage, size),
+		done:  make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+// Send queues a message to be sent with the notification method
+func (o *Outbox) Send(notification Notification, to string, message string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ErrOutboxClosed
+	}
+	select {
+	case o.queue <- outboxMessage{notification: notification, to: to, message: message}:
+		return nil
+	default:
+		return ErrOutboxFull
+	}
+}
+
+// Flush stops accepting notifications and waits for the queued ones to be
+// sent. If the context ends first the rest are dropped and its error is
+// returned.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.queue)
+	}
+	o.mu.Unlock()
+
+	select {
+	case <-o.done:
+		return nil
+	case <-ctx.Done():
+		log.Printf("Dropping %d unsent notifications", len(o.queue))
+		return ctx.Err()
+	}
+}
+
+func (o *Outbox) run() {
+	defer close(o.done)
+	for m := range o.queue {
+		if err := m.notification.Send(m.to, m.message, o.prefs); nil != err {
+			log.Printf("Cannot send notification to %s: %v", m.to, err)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+#!/bin/sh
+# Downloads the IEEE MA-L, MA-M and MA-S registries and regenerates
+# registry.go from them. Run it with go generate ./oui.
+set -e
+
+dir=$(mktemp -d)
+trap 'rm -rf "$dir"' EXIT
+
+for registry in oui/oui.csv mam/mam.csv oui36/oui36.csv; do
+	curl -fsSL -o "$dir/$(basename "$registry")" "https://standards-oui.ieee.org/$registry"
+done
+go run ../cmd/ouigen -o registry.go "$dir/oui.csv" "$dir/mam.csv" "$dir/oui36.csv"
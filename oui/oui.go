@@ -0,0 +1,126 @@
+// Package oui looks up the organization a MAC address is registered to in a
+// copy of the IEEE MA-L, MA-M and MA-S registries compiled into the binary.
+//
+// registry.go is generated by cmd/ouigen from the CSV files the IEEE
+// publishes. go generate downloads them and regenerates it, which needs
+// curl and network access. Without them it can be generated from seed.csv,
+// a few common vendors in the same format:
+//
+//	go run ./cmd/ouigen -o oui/registry.go oui/seed.csv
+package oui
+
+//go:generate sh generate.sh
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNotFound is returned for MACs whose prefix isn't registered
+	ErrNotFound = errors.New("MAC prefix not registered")
+	// ErrRandom is returned for locally administered MACs, which devices
+	// make up and aren't registered to anyone
+	ErrRandom = errors.New("MAC is randomized")
+)
+
+// Prefix lengths in hex digits, longest first
+var prefixLengths = []int{
+	9, // MA-S, 36 bits
+	7, // MA-M, 28 bits
+	6, // MA-L, 24 bits
+}
+
+var (
+	loadOnce sync.Once
+	prefixes map[string]string
+)
+
+// Lookup returns the organization the MAC is registered to. It returns
+// ErrRandom for randomized MACs rather than whatever their made up prefix
+// happens to match.
+func Lookup(mac string) (string, error) {
+	digits := hexDigits(mac)
+	if IsRandom(digits) {
+		return "", ErrRandom
+	}
+	loadOnce.Do(load)
+	return lookup(prefixes, digits)
+}
+
+// lookup returns the organization of the longest prefix in the registry the
+// MAC's hex digits start with, so MA-S assignments carved out of an MA-L
+// block win over it
+func lookup(registry map[string]string, digits string) (string, error) {
+	for _, length := range prefixLengths {
+		if len(digits) < length {
+			continue
+		}
+		if org, prs := registry[digits[:length]]; prs {
+			return org, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// IsRandom reports whether the MAC is locally administered, the U/L bit of
+// its first octet being set
+func IsRandom(mac string) bool {
+	digits := hexDigits(mac)
+	if len(digits) < 2 {
+		return false
+	}
+	first, err := strconv.ParseUint(digits[:2], 16, 8)
+	return nil == err && 0 != first&0x02
+}
+
+// Len is the number of registered prefixes
+func Len() int {
+	loadOnce.Do(load)
+	return len(prefixes)
+}
+
+// hexDigits returns the MAC's hex digits in upper case without separators
+func hexDigits(mac string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(mac) {
+		if (r >= '0' && r <= '9') || (r >= 'A' && r <= 'F') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// load decompresses the registry, which is gzipped lines of a hex prefix and
+// the organization separated by a tab
+func load() {
+	prefixes = make(map[string]string)
+	raw, err := base64.StdEncoding.DecodeString(registry)
+	if nil != err {
+		log.Printf("Cannot decode the OUI registry: %v", err)
+		return
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if nil != err {
+		log.Printf("Cannot decompress the OUI registry: %v", err)
+		return
+	}
+	defer gz.Close()
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if 2 == len(fields) {
+			prefixes[fields[0]] = fields[1]
+		}
+	}
+	if err := scanner.Err(); nil != err {
+		log.Printf("Cannot read the OUI registry: %v", err)
+	}
+}
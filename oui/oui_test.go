@@ -0,0 +1,98 @@
+package oui
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLookupLongestPrefix(t *testing.T) {
+	registry := map[string]string{
+		"70B3D5":    "IEEE Registration Authority",
+		"70B3D51":   "MA-M Org",
+		"70B3D5ABC": "MA-S Org",
+		"B827EB":    "Raspberry Pi Foundation",
+	}
+	tests := []struct {
+		mac  string
+		want string
+		err  error
+	}{
+		{"70:B3:D5:AB:C1:23", "MA-S Org", nil},
+		{"70-b3-d5-ab-c1-23", "MA-S Org", nil},
+		{"70:B3:D5:1F:00:01", "MA-M Org", nil},
+		{"70:B3:D5:AB:D1:23", "IEEE Registration Authority", nil},
+		{"B8:27:EB:12:34:56", "Raspberry Pi Foundation", nil},
+		{"B8:27:EC:12:34:56", "", ErrNotFound},
+		{"B8:27", "", ErrNotFound},
+	}
+	for _, test := range tests {
+		org, err := lookup(registry, hexDigits(test.mac))
+		if org != test.want || !errors.Is(err, test.err) {
+			t.Errorf("lookup(%s) = %q, %v, want %q, %v", test.mac, org, err, test.want, test.err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if 0 == Len() {
+		t.Fatal("the registry is empty")
+	}
+	if org, err := Lookup("b8:27:eb:01:02:03"); nil != err || "Raspberry Pi Foundation" != org {
+		t.Errorf("got %q, %v, want Raspberry Pi Foundation", org, err)
+	}
+	if _, err := Lookup("01:00:5E:00:00:01"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v for an unregistered prefix, want ErrNotFound", err)
+	}
+}
+
+// TestLookupRegistryPrefixes looks up a MAC in the first MA-M and MA-S
+// assignment of the compiled registry, which needs it generated from the
+// IEEE's mam.csv and oui36.csv rather than seed.csv
+func TestLookupRegistryPrefixes(t *testing.T) {
+	Len()
+	for _, test := range []struct {
+		name   string
+		length int
+	}{{"MA-M", 7}, {"MA-S", 9}} {
+		t.Run(test.name, func(t *testing.T) {
+			prefix := ""
+			for p := range prefixes {
+				if len(p) == test.length && !IsRandom(p) && (0 == len(prefix) || p < prefix) {
+					prefix = p
+				}
+			}
+			if 0 == len(prefix) {
+				t.Skipf("the registry has no %s prefixes, regenerate it with go generate ./oui", test.name)
+			}
+			mac := (prefix + "000000")[:12]
+			if org, err := Lookup(mac); nil != err || prefixes[prefix] != org {
+				t.Errorf("Lookup(%s) = %q, %v, want %q", mac, org, err, prefixes[prefix])
+			}
+		})
+	}
+}
+
+func TestLookupRandom(t *testing.T) {
+	// Setting the U/L bit on a registered prefix doesn't make it registered
+	for _, mac := range []string{"BA:27:EB:01:02:03", "DA:A1:19:01:02:03", "02:00:00:00:00:01"} {
+		if org, err := Lookup(mac); !errors.Is(err, ErrRandom) {
+			t.Errorf("Lookup(%s) = %q, %v, want ErrRandom", mac, org, err)
+		}
+	}
+}
+
+func TestIsRandom(t *testing.T) {
+	tests := map[string]bool{
+		"B8:27:EB:01:02:03": false,
+		"BA:27:EB:01:02:03": true,
+		"02:00:00:00:00:01": true,
+		"fe-00-00-00-00-01": true,
+		"01:00:5E:00:00:01": false,
+		"":                  false,
+	}
+	for mac, want := range tests {
+		if got := IsRandom(mac); got != want {
+			t.Errorf("IsRandom(%q) = %t, want %t", mac, got, want)
+		}
+	}
+}
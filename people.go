@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUnknownPerson = errors.New("unknown person")
+
+// presenceMu serialises presence updates from sites polled at the same time
+var presenceMu sync.Mutex
+
+// person owns the devices whose owner is their name. They're home while any
+// of their presence devices is online, and away once all of them have been
+// offline for the away grace period.
+type person struct {
+	Name string `json:"name"`
+	Home bool   `json:"home"`
+	// Since is when they arrived or left
+	Since      *time.Time `json:"since,omitempty"`
+	LastOnline *time.Time `json:"last_online,omitempty"`
+	// AwayGrace is in seconds, 0 uses the away_grace preference
+	AwayGrace int            `json:"away_grace"`
+	Devices   []personDevice `json:"devices"`
+}
+
+// personDevice is a device a person owns
+type personDevice struct {
+	MAC      string `json:"mac"`
+	Name     string `json:"name,omitempty"`
+	Presence bool   `json:"presence"`
+	Online   bool   `json:"online"`
+}
+
+// readPeople creates the people table and the devices' presence column
+func readPeople(app *wifiClientWatchApp) {
+	db := app.db
+	sqlStmt := `
+	create table IF NOT EXISTS people (name text not null primary key, away_grace integer not null default 0,
+		home bool not null default 0, since timestamp, last_online timestamp);
+	`
+	_, err := db.Exec(sqlStmt)
+	if err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+		return
+	}
+	if err = addMissingColumns(db, "devices", []string{"presence bool not null default 0"}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// onlineMACs returns the MACs online on any site
+func onlineMACs() map[string]bool {
+	online := make(map[string]bool)
+	for _, s := range application.allSites() {
+		s.mu.Lock()
+		for _, c := range s.clients {
+			if c.Online {
+				online[c.MAC] = true
+			}
+		}
+		s.mu.Unlock()
+	}
+	return online
+}
+
+// presenceOwners returns the owner of each presence device, including the
+// random MACs correlated with one
+func presenceOwners() (map[string]string, error) {
+	owners := make(map[string]string)
+	rows, err := application.db.Query(`select d.mac, coalesce(p.owner, d.owner) from devices d
+		left join devices p on p.mac = d.alias_of
+		where coalesce(p.presence, d.presence) and coalesce(p.owner, d.owner, '') != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mac, owner string
+		if err = rows.Scan(&mac, &owner); err != nil {
+			return nil, err
+		}
+		owners[mac] = owner
+	}
+	return owners, rows.Err()
+}
+
+// isPresenceDevice is whether the MAC, or the device it's correlated with,
+// tracks a person's presence. Its connects and disconnects are notified as
+// the person arriving and leaving instead.
+func isPresenceDevice(mac string) (bool, error) {
+	var count int
+	err := application.db.QueryRow(`select count(*) from devices d left join devices p on p.mac = d.alias_of
+		join people on people.name = coalesce(p.owner, d.owner)
+		where d.mac = ? and coalesce(p.presence, d.presence)`, mac).Scan(&count)
+	return 0 != count, err
+}
+
+// awayGrace is how long a person's presence devices have to be offline
+// before they're away
+func awayGrace(p person) time.Duration {
+	if p.AwayGrace > 0 {
+		return time.Duration(p.AwayGrace) * time.Second
+	}
+	seconds := 600
+	if raw, prs := application.preferences.Get("away_grace"); prs {
+		if v, err := strconv.Atoi(*raw); nil == err && v >= 0 {
+			seconds = v
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// updatePresence moves people home or away from what's online on every site,
+// notifying their arrivals and departures
+func updatePresence() error {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+
+	people, err := listPeople()
+	if nil != err {
+		return err
+	}
+	owners, err := presenceOwners()
+	if nil != err {
+		return err
+	}
+	online := onlineMACs()
+	now := historyTime(time.Now())
+	for _, p := range people {
+		seen := false
+		for mac, owner := range owners {
+			if owner == p.Name && online[mac] {
+				seen = true
+				break
+			}
+		}
+
+		changed := false
+		switch {
+		case seen:
+			p.LastOnline = &now
+			if !p.Home {
+				p.Home, p.Since, changed = true, &now, true
+				log.Printf("%s arrived home", p.Name)
+				notify(fmt.Sprintf("%s arrived home", p.Name))
+			}
+		case p.Home && (nil == p.LastOnline || now.Sub(*p.LastOnline) >= awayGrace(p)):
+			p.Home, p.Since, changed = false, &now, true
+			log.Printf("%s left home", p.Name)
+			notify(fmt.Sprintf("%s left home", p.Name))
+		}
+		if !seen && !changed {
+			continue
+		}
+		_, err = application.db.Exec("update people set home = ?, since = ?, last_online = ? where name = ?",
+			p.Home, p.Since, p.LastOnline, p.Name)
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// listPeople returns everyone with their devices
+func listPeople() ([]person, error) {
+	rows, err := application.db.Query("select name, away_grace, home, since, last_online from people order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	people := make([]person, 0)
+	for rows.Next() {
+		var p person
+		var since, lastOnline sql.NullTime
+		if err = rows.Scan(&p.Name, &p.AwayGrace, &p.Home, &since, &lastOnline); err != nil {
+			return nil, err
+		}
+		if since.Valid {
+			p.Since = &since.Time
+		}
+		if lastOnline.Valid {
+			p.LastOnline = &lastOnline.Time
+		}
+		people = append(people, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	online := onlineMACs()
+	for i := range people {
+		if people[i].Devices, err = personDevices(people[i].Name, online); err != nil {
+			return nil, err
+		}
+	}
+	return people, nil
+}
+
+func personDevices(name string, online map[string]bool) ([]personDevice, error) {
+	rows, err := application.db.Query("select mac, name, presence from devices where owner = ? order by mac", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]personDevice, 0)
+	for rows.Next() {
+		var d personDevice
+		var deviceName sql.NullString
+		if err = rows.Scan(&d.MAC, &deviceName, &d.Presence); err != nil {
+			return nil, err
+		}
+		d.Name, d.Online = deviceName.String, online[d.MAC]
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// getPerson returns the person, or errUnknownPerson
+func getPerson(name string) (person, error) {
+	people, err := listPeople()
+	if nil != err {
+		return person{}, err
+	}
+	for _, p := range people {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return person{}, fmt.Errorf("%w: %s", errUnknownPerson, name)
+}
+
+// savePerson adds the person, or sets their away grace if they exist. A nil
+// away grace keeps theirs, or uses the away_grace preference for someone new.
+func savePerson(name string, awayGrace *int) error {
+	_, err := application.db.Exec(`insert into people (name, away_grace) values (?, coalesce(?, 0))
+		on conflict(name) do update set away_grace = coalesce(?, away_grace)`, name, awayGrace, awayGrace)
+	return err
+}
+
+// removePerson removes the person. Their devices keep them as their owner.
+func removePerson(name string) error {
+	result, err := application.db.Exec("delete from people where name = ?", name)
+	if nil != err {
+		return err
+	}
+	if n, _ := result.RowsAffected(); 0 == n {
+		return fmt.Errorf("%w: %s", errUnknownPerson, name)
+	}
+	return nil
+}
+
+// peopleHandler lists people and whether they're home, and edits them with
+// action=add or action=update (name and away_grace), action=remove (name),
+// action=assign (name, mac and presence) or reads one with action=get
+func peopleHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Handling people request")
+	w.Header().Set("Content-Type", "application/json")
+	enableCors(&w)
+	query := r.URL.Query()
+	name := strings.TrimSpace(query.Get("name"))
+	action := query.Get("action")
+	if 0 != len(action) && 0 == len(name) {
+		http.Error(w, "A name is required", http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	var err error
+	switch action {
+	case "add", "update":
+		var grace *int
+		if raw := query.Get("away_grace"); 0 != len(raw) {
+			seconds, err := strconv.Atoi(raw)
+			if nil != err || seconds < 0 {
+				http.Error(w, "away_grace must be a number of seconds", http.StatusBadRequest)
+				return
+			}
+			grace = &seconds
+		}
+		if "update" == action {
+			if _, err = getPerson(name); nil != err {
+				break
+			}
+		}
+		err = savePerson(name, grace)
+		result = message{Message: "ok"}
+	case "remove":
+		err = removePerson(name)
+		result = message{Message: "ok"}
+	case "assign":
+		mac := canonicalMAC(query.Get("mac"))
+		if 0 == len(mac) {
+			http.Error(w, "A mac is required", http.StatusBadRequest)
+			return
+		}
+		if _, err = getPerson(name); nil != err {
+			break
+		}
+		fields := map[string]string{"owner": name}
+		if values, prs := query["presence"]; prs {
+			fields["presence"] = values[0]
+		}
+		err = updateDevice(mac, fields, r.RemoteAddr, query.Get("reason"))
+		result = message{Message: "ok"}
+	case "get":
+		result, err = getPerson(name)
+	default:
+		result, err = listPeople()
+	}
+
+	if errors.Is(err, errUnknownPerson) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, errInvalidPresence) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if nil != err {
+		log.Println("Cannot handle people request:", err)
+		http.Error(w, "Cannot read people", 500)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Cannot read people", 500)
+	} else {
+		w.Write(b)
+	}
+}
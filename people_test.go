@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/disrvptor/wifi_client_watch/router/routertest"
+)
+
+// TestPeopleHandlerAwayGrace checks updating a person only changes their
+// away grace when it's given
+func TestPeopleHandlerAwayGrace(t *testing.T) {
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+
+	steps := []struct {
+		query string
+		want  int
+	}{
+		{"action=add&name=Alex", 0},
+		{"action=update&name=Alex&away_grace=1800", 1800},
+		{"action=update&name=Alex", 1800},
+		{"action=add&name=Alex", 1800},
+		{"action=update&name=Alex&away_grace=0", 0},
+	}
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		peopleHandler(w, httptest.NewRequest(http.MethodPost, "/people?"+step.query, nil))
+		if http.StatusOK != w.Code {
+			t.Fatalf("%s: got status %d: %s", step.query, w.Code, w.Body)
+		}
+		p, err := getPerson("Alex")
+		if nil != err {
+			t.Fatal(err)
+		}
+		if p.AwayGrace != step.want {
+			t.Errorf("%s: got away_grace %d, want %d", step.query, p.AwayGrace, step.want)
+		}
+	}
+}
+
+// TestPresenceDBError checks presence errors are returned for the poll to
+// log instead of stopping the server
+func TestPresenceDBError(t *testing.T) {
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+	application.db.Close()
+
+	if err := updatePresence(); nil == err {
+		t.Error("updatePresence succeeded without a DB")
+	}
+	if _, err := isPresenceDevice("00:11:22:33:44:01"); nil == err {
+		t.Error("isPresenceDevice succeeded without a DB")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/hex"
 	"io"
 	"log"
+	"sync"
 )
 
 type preference struct {
@@ -17,71 +18,131 @@ type preference struct {
 	secure bool
 }
 
-// Preferences object type
+// Preferences object type. Preferences are read and set from any goroutine,
+// and watchers are called after the change is made, without the lock held,
+// so they can read and set preferences themselves.
 type Preferences struct {
+	mu          sync.RWMutex // guards preferences, passphrase, watchers and db
 	preferences map[string]preference
 	passphrase  string
 	watchers    map[string][]func(*string, *string)
-	dbFile      *string
+	db          *sql.DB
 }
 
 // SetBackingStore sets the database backing store
-func (p *Preferences) SetBackingStore(dbFile string) {
+func (p *Preferences) SetBackingStore(db *sql.DB) {
+	p.mu.Lock()
 	validate(p)
+	passphrase := p.passphrase
+	p.mu.Unlock()
 
 	// Read any preferences from the DB connection
-	log.Printf("Reading preferences from '%s'", dbFile)
-	db, err := sql.Open("sqlite3", dbFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
+	log.Println("Reading preferences")
 	sqlStmt := `
 	create table IF NOT EXISTS preferences (name text not null primary key, value text, secure bool);
 	`
-	_, err = db.Exec(sqlStmt)
+	_, err := db.Exec(sqlStmt)
 	if err != nil {
 		log.Printf("%q: %s\n", err, sqlStmt)
 		return
 	}
 
+	for _, pref := range readPreferences(db, passphrase) {
+		// This won't attempt to save in the DB because we haven't saved a
+		// reference to the DB yet
+		p.Set(pref.name, pref.value, pref.secure)
+	}
+
+	// Save the DB reference
+	p.mu.Lock()
+	p.db = db
+	p.mu.Unlock()
+}
+
+// Reload re-reads the preferences from the backing store, notifying the
+// watchers of any that changed once they're all read. Preferences deleted
+// from the store keep their value until the next start, since callers
+// expect the ones they set defaults for to exist.
+func (p *Preferences) Reload() {
+	p.mu.Lock()
+	validate(p)
+	if nil == p.db {
+		p.mu.Unlock()
+		return
+	}
+
+	log.Println("Reloading preferences")
+	notifications := make([]func(), 0)
+	stored := make(map[string]bool)
+	for _, pref := range readPreferences(p.db, p.passphrase) {
+		stored[pref.name] = true
+		current, prs := p.get(pref.name)
+		if prs && *current == pref.value && p.preferences[pref.name].secure == pref.secure {
+			continue
+		}
+		log.Printf("Preference %s changed", pref.name)
+		// The value is already saved
+		value := pref.value
+		previous, watchers := p.store(pref.name, pref.value, pref.secure, false)
+		notifications = append(notifications, func() { notify(watchers, previous, &value) })
+	}
+	for name := range p.preferences {
+		if !stored[name] {
+			log.Printf("Preference %s was deleted, keeping its value until restarted", name)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, f := range notifications {
+		f()
+	}
+}
+
+type storedPreference struct {
+	name   string
+	value  string
+	secure bool
+}
+
+// readPreferences reads every preference, decrypting secure values
+func readPreferences(db *sql.DB, passphrase string) []storedPreference {
+	prefs := make([]storedPreference, 0)
 	rows, err := db.Query("select name, value, secure from preferences")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var name string
-		var value string
-		var secure bool
-		err = rows.Scan(&name, &value, &secure)
+		var pref storedPreference
+		err = rows.Scan(&pref.name, &pref.value, &pref.secure)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if secure {
-			rawBytes, err := base64.StdEncoding.DecodeString(value)
+		if pref.secure {
+			rawBytes, err := base64.StdEncoding.DecodeString(pref.value)
 			if nil != err {
 				log.Fatal(err)
 			}
-			value = string(decrypt(rawBytes, p.passphrase))
+			pref.value = string(decrypt(rawBytes, passphrase))
 		}
-		// This won't attempt to save in the DB because we haven't saved a
-		// reference to the DB yet
-		p.Set(name, value, secure)
+		prefs = append(prefs, pref)
 	}
 	err = rows.Err()
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// Save the DB reference
-	p.dbFile = &dbFile
+	return prefs
 }
 
 // Get the value of the named preference
 func (p *Preferences) Get(name string) (*string, bool) {
-	validate(p)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.get(name)
+}
 
+// get the value of the named preference. The caller must hold mu.
+func (p *Preferences) get(name string) (*string, bool) {
 	pref, prs := p.preferences[name]
 	if prs {
 		var value string
@@ -106,10 +167,25 @@ func (p *Preferences) Get(name string) (*string, bool) {
 
 // Set the value of the named preference
 func (p *Preferences) Set(name string, value string, secure ...bool) {
+	p.set(name, value, len(secure) > 0 && secure[0], true)
+}
+
+// set the value of the named preference, saving it to the DB when save is set
+func (p *Preferences) set(name string, value string, secure bool, save bool) {
+	p.mu.Lock()
+	previous, watchers := p.store(name, value, secure, save)
+	p.mu.Unlock()
+	notify(watchers, previous, &value)
+}
+
+// store the value of the named preference, saving it to the DB when save is
+// set. It returns the previous value and the watchers to notify once mu is
+// released. The caller must hold mu.
+func (p *Preferences) store(name string, value string, secure bool, save bool) (*string, []func(*string, *string)) {
 	validate(p)
 
 	pref := preference{}
-	if len(secure) > 0 && secure[0] {
+	if secure {
 		pref.secure = true
 		rawBytes := encrypt([]byte(value), p.passphrase)
 		pref.value = base64.StdEncoding.EncodeToString(rawBytes)
@@ -117,17 +193,12 @@ func (p *Preferences) Set(name string, value string, secure ...bool) {
 		pref.value = value
 	}
 
-	_value, _ := p.Get(name)
+	previous, _ := p.get(name)
 	p.preferences[name] = pref
 
 	// Save the value to the DB
-	if nil != p.dbFile {
-		db, err := sql.Open("sqlite3", *p.dbFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer db.Close()
-		stmt, err := db.Prepare("insert into preferences(name, value, secure) values(?, ?, ?) on conflict(name) do update set value = ?, secure = ?;")
+	if save && nil != p.db {
+		stmt, err := p.db.Prepare("insert into preferences(name, value, secure) values(?, ?, ?) on conflict(name) do update set value = ?, secure = ?;")
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -138,31 +209,33 @@ func (p *Preferences) Set(name string, value string, secure ...bool) {
 		}
 	}
 
-	// Notify all watchers
-	watchers, exists := p.watchers[name]
-	if exists {
-		for _, f := range watchers {
-			f(_value, &value)
-		}
+	// Copy the watchers, which can be added to once mu is released
+	return previous, append([]func(*string, *string){}, p.watchers[name]...)
+}
+
+// notify calls the watchers with the previous and new value
+func notify(watchers []func(*string, *string), previous *string, value *string) {
+	for _, f := range watchers {
+		f(previous, value)
 	}
 }
 
 // SetDefaultPreference will set the preference value if no value is currently set
 func (p *Preferences) SetDefaultPreference(name string, value string, secure ...bool) {
-	validate(p)
-
-	_, prs := p.Get(name)
-	if !prs {
-		_secure := false
-		if len(secure) > 0 {
-			_secure = secure[0]
-		}
-		p.Set(name, value, _secure)
+	p.mu.Lock()
+	if _, prs := p.get(name); prs {
+		p.mu.Unlock()
+		return
 	}
+	previous, watchers := p.store(name, value, len(secure) > 0 && secure[0], true)
+	p.mu.Unlock()
+	notify(watchers, previous, &value)
 }
 
 // AddWatcher adds a watcher function for the given name
 func (p *Preferences) AddWatcher(name string, watcher func(*string, *string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	validate(p)
 
 	watchers, exists := p.watchers[name]
@@ -0,0 +1,126 @@
+package preferences
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSetAndGet(t *testing.T) {
+	var p Preferences
+	p.Set("plain", "value")
+	p.Set("secret", "hidden", true)
+
+	if value, prs := p.Get("plain"); !prs || "value" != *value {
+		t.Errorf("got %v, want value", value)
+	}
+	if value, prs := p.Get("secret"); !prs || "hidden" != *value {
+		t.Errorf("got %v, want hidden", value)
+	}
+	if "hidden" == p.preferences["secret"].value {
+		t.Error("the secure preference is stored unencrypted")
+	}
+	if _, prs := p.Get("missing"); prs {
+		t.Error("got a value for a missing preference")
+	}
+}
+
+func TestSetDefaultPreference(t *testing.T) {
+	var p Preferences
+	p.SetDefaultPreference("name", "default")
+	p.SetDefaultPreference("name", "other")
+	if value, _ := p.Get("name"); "default" != *value {
+		t.Errorf("got %s, want the first default", *value)
+	}
+}
+
+func TestWatchers(t *testing.T) {
+	var p Preferences
+	p.Set("name", "old")
+	changes := make([]string, 0)
+	p.AddWatcher("name", func(previous *string, value *string) {
+		changes = append(changes, fmt.Sprintf("%s->%s", *previous, *value))
+		// Watchers are called without the lock, so can use the preferences
+		if current, _ := p.Get("name"); *current != *value {
+			t.Errorf("got %s in the watcher, want %s", *current, *value)
+		}
+		p.Set("seen", *value)
+	})
+
+	p.Set("name", "new")
+	if 1 != len(changes) || "old->new" != changes[0] {
+		t.Errorf("got changes %v, want old->new", changes)
+	}
+	if value, _ := p.Get("seen"); "new" != *value {
+		t.Errorf("the watcher didn't set seen, got %s", *value)
+	}
+}
+
+// TestConcurrentUse is meant for go test -race
+func TestConcurrentUse(t *testing.T) {
+	var p Preferences
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("pref%d", i%2)
+			for j := 0; j < 100; j++ {
+				p.Set(name, fmt.Sprint(j), 0 == i%4)
+				p.SetDefaultPreference(name, "default")
+				p.Get(name)
+				p.AddWatcher(name, func(*string, *string) {})
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preferences")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "preferences.db"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var p Preferences
+	p.SetBackingStore(db)
+	p.Set("kept", "same")
+	p.Set("changed", "old")
+	p.Set("deleted", "value")
+	changes := make([]string, 0)
+	for _, name := range []string{"kept", "changed", "deleted"} {
+		name := name
+		p.AddWatcher(name, func(previous *string, value *string) {
+			changes = append(changes, fmt.Sprintf("%s:%s->%s", name, *previous, *value))
+			// The reload has released the lock by now
+			p.Get(name)
+		})
+	}
+
+	if _, err = db.Exec("update preferences set value = 'new' where name = 'changed'"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("delete from preferences where name = 'deleted'"); nil != err {
+		t.Fatal(err)
+	}
+	p.Reload()
+
+	if 1 != len(changes) || "changed:old->new" != changes[0] {
+		t.Errorf("got changes %v, want changed:old->new", changes)
+	}
+	if value, prs := p.Get("deleted"); !prs || "value" != *value {
+		t.Errorf("got %v for the deleted preference, want it kept until restarted", value)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// Policies for the random_mac_policy preference, deciding how random MACs
+// that aren't correlated with a device alert
+const (
+	// randomMACAlert alerts like any other new device
+	randomMACAlert = "alert"
+	// randomMACAlertOnce alerts for the first random MAC with a hostname
+	// and not the ones it rotates to
+	randomMACAlertOnce = "alert_once"
+	// randomMACIgnore never alerts
+	randomMACIgnore = "ignore"
+)
+
+// Values of a device's correlate setting, deciding how the random MACs it
+// rotates to are recognised
+const (
+	correlateNone     = ""
+	correlateHostname = "hostname"
+	correlateClientID = "client_id"
+)
+
+var correlations = []string{correlateNone, correlateHostname, correlateClientID}
+
+// alertStatus is the status a client change alerts with. Random MACs are
+// correlated with the device they belong to, alerting as a reconnect of that
+// device, and otherwise follow the random_mac_policy while they're new.
+func alertStatus(s *site, change *clientChange) (string, error) {
+	c := change.Client
+	parent, err := correlateRandomMAC(c)
+	if nil != err {
+		return "", err
+	}
+	if 0 != len(parent) {
+		if clientNew == change.Kind && c.Online {
+			change.Kind = clientOnline
+		}
+		return deviceStatus(parent)
+	}
+
+	status, err := deviceStatus(c.MAC)
+	if nil != err || !router.IsRandomMAC(c.MAC) || deviceNew != status {
+		return status, err
+	}
+	policy, _ := s.preference("random_mac_policy")
+	switch {
+	case nil == policy:
+	case randomMACIgnore == *policy:
+		return deviceIgnored, nil
+	case randomMACAlertOnce == *policy:
+		seen, err := randomHostnameSeen(c)
+		if seen {
+			return deviceIgnored, err
+		}
+		return status, err
+	}
+	return status, nil
+}
+
+// correlateRandomMAC returns the device a random MAC belongs to, matching
+// it by hostname or DHCP client ID to a device set to correlate by them the
+// first time it's seen. It returns "" if there's no such device.
+func correlateRandomMAC(c router.Client) (string, error) {
+	var status string
+	var aliasOf sql.NullString
+	err := application.db.QueryRow("select status, alias_of from devices where mac = ?", c.MAC).Scan(&status, &aliasOf)
+	if nil == err && 0 != len(aliasOf.String) {
+		return aliasOf.String, nil
+	} else if nil != err && sql.ErrNoRows != err {
+		return "", err
+	}
+	// Only random MACs nobody has classified yet are correlated
+	if !router.IsRandomMAC(c.MAC) || (nil == err && deviceNew != status) {
+		return "", nil
+	}
+
+	var parent, correlate string
+	err = application.db.QueryRow(`select mac, correlate from devices
+		where mac != ? and alias_of is null and ((correlate = 'hostname' and hostname = ? and '' != ?)
+			or (correlate = 'client_id' and client_id = ? and '' != ?))
+		order by last_seen desc limit 1`, c.MAC, c.Name, c.Name, c.ClientID, c.ClientID).Scan(&parent, &correlate)
+	if sql.ErrNoRows == err {
+		return "", nil
+	} else if nil != err {
+		return "", err
+	}
+
+	log.Printf("Correlated random MAC %s with device %s by %s", c.MAC, parent, correlate)
+	err = updateDevice(c.MAC, map[string]string{"alias_of": parent}, "correlation", "matched by "+correlate)
+	if nil != err {
+		return "", err
+	}
+	return parent, nil
+}
+
+// randomHostnameSeen is whether another random MAC has already reported the
+// client's hostname
+func randomHostnameSeen(c router.Client) (bool, error) {
+	if 0 == len(c.Name) {
+		return false, nil
+	}
+	var count int
+	err := application.db.QueryRow("select count(*) from devices where random and hostname = ? and mac != ?",
+		c.Name, c.MAC).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/actions"
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// Probes that verify a client the router reports online is really there
+const (
+	probeARP  = "arp"
+	probeICMP = "icmp"
+	probeTCP  = "tcp"
+	// probeNone turns verification off, e.g. for a group on a site that
+	// verifies every client
+	probeNone = "none"
+)
+
+var probeTypes = []string{probeARP, probeICMP, probeTCP, probeNone}
+
+// verifyConcurrency bounds how many clients are probed at once
+const verifyConcurrency = 16
+
+// parseProbes parses a comma separated list of probes, which are tried in
+// turn until one gets an answer
+func parseProbes(value string) ([]string, error) {
+	probes := splitTags(strings.ToLower(value))
+	for _, p := range probes {
+		if !contains(probeTypes, p) {
+			return nil, fmt.Errorf("unknown probe %s", p)
+		}
+	}
+	if contains(probes, probeNone) && 1 != len(probes) {
+		return nil, fmt.Errorf("probe none can't be combined")
+	}
+	return probes, nil
+}
+
+// siteProbes are the site's verify_probe preference
+func siteProbes(s *site) []string {
+	value, prs := s.preference("verify_probe")
+	if !prs {
+		return nil
+	}
+	probes, err := parseProbes(*value)
+	if nil != err {
+		log.Printf("Ignoring verify_probe on site %s: %v", s.Name, err)
+		return nil
+	}
+	return probes
+}
+
+// clientProbes are the probes of the first of the client's groups that has
+// any, or else the site's
+func clientProbes(probes []string, groups []*group) []string {
+	for _, g := range groups {
+		if 0 != len(g.Probe) {
+			probes = splitTags(g.Probe)
+			break
+		}
+	}
+	if contains(probes, probeNone) {
+		return nil
+	}
+	return probes
+}
+
+// probeClient runs the probes in turn, each within the timeout, and reports
+// whether any of them got an answer
+func probeClient(ctx context.Context, c router.Client, probes []string, ports []int, timeout time.Duration) bool {
+	for _, p := range probes {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		var err error
+		switch p {
+		case probeARP:
+			_, err = actions.ARPPing(probeCtx, c.IP, c.MAC)
+		case probeICMP:
+			_, err = actions.Ping(probeCtx, c.IP)
+		case probeTCP:
+			_, err = actions.ProbeTCP(probeCtx, c.IP, ports)
+		}
+		cancel()
+		if nil == err {
+			return true
+		}
+		log.Printf("The %s probe of client %s (MAC=%s, IP=%s) failed: %v", p, c.Name, c.MAC, c.IP, err)
+	}
+	return false
+}
+
+// verifyClients probes the clients the router reports online, and those it
+// has just reported offline, when their groups or the site ask for it. A
+// client that doesn't answer isn't counted as coming online, and one that
+// was online only goes offline once verify_failures probes in a row have
+// gone unanswered or the router reports it offline and it doesn't answer. A
+// client that answers stays online whatever the router says. Clients the
+// router stops listing altogether, or lists without an IP, can't be probed. previous are the clients
+// from the site's last poll. The caller must hold the site's routerMu.
+func verifyClients(ctx context.Context, s *site, previous []router.Client, clients []router.Client, groups []*group) {
+	probes := siteProbes(s)
+	failures := sitePreferenceInt(s, "verify_failures", 2)
+	timeout := time.Duration(sitePreferenceInt(s, "verify_timeout", 2)) * time.Second
+	var ports []int
+	if value, prs := s.preference("verify_ports"); prs {
+		var err error
+		if ports, err = actions.ParsePorts(*value); nil != err {
+			log.Printf("Ignoring verify_ports on site %s: %v", s.Name, err)
+		}
+	}
+	if 0 == len(ports) {
+		ports = actions.DefaultTCPPorts
+	}
+	s.mu.Lock()
+	if nil == s.probeFailures {
+		s.probeFailures = make(map[string]int)
+	}
+	s.mu.Unlock()
+
+	reachable := make([]*bool, len(clients))
+	limit := make(chan struct{}, verifyConcurrency)
+	var wg sync.WaitGroup
+	for i := range clients {
+		c := &clients[i]
+		c.RouterOnline = c.Online
+		var cp []string
+		if (c.Online || wasOnline(c.MAC, previous)) && 0 != len(c.IP) {
+			subject, err := clientSubject(*c)
+			if nil != err {
+				log.Printf("Cannot read the groups of %s, using the site's probes: %v", c.MAC, err)
+			}
+			cp = clientProbes(probes, memberOf(subject, groups))
+		}
+		if 0 == len(cp) {
+			s.mu.Lock()
+			delete(s.probeFailures, c.MAC)
+			s.mu.Unlock()
+			continue
+		}
+		reachable[i] = new(bool)
+		wg.Add(1)
+		go func(c router.Client, cp []string, answered *bool) {
+			defer wg.Done()
+			limit <- struct{}{}
+			*answered = probeClient(ctx, c, cp, ports, timeout)
+			<-limit
+		}(*c, cp, reachable[i])
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range clients {
+		c := &clients[i]
+		if c.Reachable = reachable[i]; nil == c.Reachable {
+			continue
+		}
+		if *c.Reachable {
+			delete(s.probeFailures, c.MAC)
+			if !c.Online {
+				log.Printf("Client %s (MAC=%s) is reported offline but answered a probe", c.Name, c.MAC)
+				c.Online = true
+			}
+			continue
+		}
+		if !c.RouterOnline {
+			// Gone by the router and by the probes
+			delete(s.probeFailures, c.MAC)
+			continue
+		}
+		s.probeFailures[c.MAC]++
+		online := wasOnline(c.MAC, previous)
+		if online && s.probeFailures[c.MAC] < failures {
+			continue
+		}
+		if online {
+			log.Printf("Client %s (MAC=%s, IP=%s) is reported online but didn't answer %d probes in a row", c.Name,
+				c.MAC, c.IP, s.probeFailures[c.MAC])
+		}
+		c.Online = false
+	}
+}
+
+// wasOnline is whether the client was online on the site's last poll
+func wasOnline(mac string, previous []router.Client) bool {
+	last := findClient(mac, previous)
+	return nil != last && last.Online
+}
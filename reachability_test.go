@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+	"github.com/disrvptor/wifi_client_watch/router/routertest"
+)
+
+// TestVerifyClientsOffline checks clients the router has just reported
+// offline are probed, staying online while they answer
+func TestVerifyClientsOffline(t *testing.T) {
+	fake := routertest.NewFakeAsus()
+	defer fake.Close()
+	stop := startTestApp(t, "asuswrt", fake.Config(true))
+	defer stop()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	application.preferences.Set("verify_probe", "tcp")
+	application.preferences.Set("verify_ports", strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+	application.preferences.Set("verify_timeout", "1")
+	s := findSite(defaultSite)
+
+	answers := router.Client{MAC: "00:11:22:33:44:01", IP: "127.0.0.1"}
+	// TCP can't connect to the broadcast address, so it never answers
+	silent := router.Client{MAC: "00:11:22:33:44:02", IP: "255.255.255.255"}
+	noIP := router.Client{MAC: "00:11:22:33:44:03"}
+	neverOnline := router.Client{MAC: "00:11:22:33:44:04", IP: "127.0.0.1"}
+	previous := []router.Client{answers, silent, noIP, neverOnline}
+	for i := range previous[:3] {
+		previous[i].Online = true
+	}
+	clients := []router.Client{answers, silent, noIP, neverOnline}
+
+	verifyClients(context.Background(), s, previous, clients, nil)
+	tests := []struct {
+		online    bool
+		probed    bool
+		reachable bool
+	}{
+		{true, true, true},
+		{false, true, false},
+		{false, false, false},
+		{false, false, false},
+	}
+	for i, test := range tests {
+		c := clients[i]
+		if c.RouterOnline {
+			t.Errorf("%s: router_online overruled", c.MAC)
+		}
+		if c.Online != test.online {
+			t.Errorf("%s: got online %t, want %t", c.MAC, c.Online, test.online)
+		}
+		if test.probed != (nil != c.Reachable) {
+			t.Errorf("%s: probed %t, want %t", c.MAC, nil != c.Reachable, test.probed)
+		} else if test.probed && *c.Reachable != test.reachable {
+			t.Errorf("%s: got reachable %t, want %t", c.MAC, *c.Reachable, test.reachable)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if 0 != len(s.probeFailures) {
+		t.Errorf("got probe failures %v for clients the router reports offline", s.probeFailures)
+	}
+}
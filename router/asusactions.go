@@ -0,0 +1,36 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+)
+
+// asusActionWake wakes a client with the router's wake on LAN
+const asusActionWake = "wol"
+
+// ClientActions the router can run
+func (rtr *AsusRouter) ClientActions() []ClientAction {
+	return []ClientAction{
+		{Name: asusActionWake, Description: "Wake the client with the router's wake on LAN"},
+	}
+}
+
+// RunClientAction runs one of the router's ClientActions
+func (rtr *AsusRouter) RunClientAction(ctx context.Context, name string, c Client) (string, error) {
+	switch name {
+	case asusActionWake:
+		log.Printf("AsusRouter: Waking %s", c.MAC)
+		form := url.Values{}
+		form.Set("dstmac", normalizeMAC(c.MAC))
+		err := rtr.withToken(ctx, func() error {
+			return rtr.doPost(ctx, "wol_action.cgi", form)
+		})
+		if nil != err {
+			return "", err
+		}
+		return fmt.Sprintf("The router sent a magic packet to %s", c.MAC), nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotSupported, name)
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// asusMeshNode is an entry in the get_cfg_clientlist hook response
+type asusMeshNode struct {
+	Alias     asusString `json:"alias"`
+	ModelName asusString `json:"model_name"`
+	UIModel   asusString `json:"ui_model_name"`
+	MAC       asusString `json:"mac"`
+	IP        asusString `json:"ip"`
+	FwVer     asusString `json:"fwver"`
+	Online    asusString `json:"online"`
+	Level     asusString `json:"level"`
+	RePath    asusString `json:"re_path"`
+	Pap2G     asusString `json:"pap2g"`
+	Rssi2G    asusString `json:"rssi2g"`
+	Pap5G     asusString `json:"pap5g"`
+	Rssi5G    asusString `json:"rssi5g"`
+	Pap6G     asusString `json:"pap6g"`
+	Rssi6G    asusString `json:"rssi6g"`
+}
+
+// Nodes in the AiMesh network. Firmware without AiMesh has no nodes.
+func (rtr *AsusRouter) Nodes(ctx context.Context) ([]Node, error) {
+	result, err := rtr.appGet(ctx, "get_cfg_clientlist()")
+	if nil != err {
+		return nil, err
+	}
+	raw, prs := result["get_cfg_clientlist"]
+	if !prs {
+		return nil, nil
+	}
+
+	var meshNodes []asusMeshNode
+	if err := json.Unmarshal(raw, &meshNodes); nil != err {
+		return nil, fmt.Errorf("%w: get_cfg_clientlist: %v", ErrSchema, err)
+	}
+
+	nodes := make([]Node, len(meshNodes))
+	for i, n := range meshNodes {
+		nodes[i] = n.toNode(0 == i)
+	}
+	return nodes, nil
+}
+
+// toNode converts the raw node. The first node in the list is the router
+// itself.
+func (n *asusMeshNode) toNode(first bool) Node {
+	model := string(n.UIModel)
+	if 0 == len(model) {
+		model = string(n.ModelName)
+	}
+	online, _ := strconv.ParseBool(string(n.Online))
+	node := Node{
+		Name:     string(n.Alias),
+		Model:    model,
+		MAC:      normalizeMAC(string(n.MAC)),
+		IP:       string(n.IP),
+		Firmware: string(n.FwVer),
+		Online:   online,
+		Primary:  first || "0" == n.Level,
+	}
+	if 0 == len(node.Name) {
+		node.Name = model
+	}
+	if node.Primary {
+		// The router is always online if it answered
+		node.Online = true
+		return node
+	}
+
+	// re_path is a bit field of the backhaul in use
+	path, _ := strconv.Atoi(string(n.RePath))
+	var pap, rssi asusString
+	switch {
+	case path&1 != 0:
+		node.Backhaul = MediumWired
+	case path&16 != 0:
+		node.Backhaul, node.Band, pap, rssi = MediumWireless, Band6GHz, n.Pap6G, n.Rssi6G
+	case path&(4|8) != 0:
+		node.Backhaul, node.Band, pap, rssi = MediumWireless, Band5GHz, n.Pap5G, n.Rssi5G
+	case path&2 != 0:
+		node.Backhaul, node.Band, pap, rssi = MediumWireless, Band2GHz, n.Pap2G, n.Rssi2G
+	}
+	node.Parent = normalizeMAC(string(pap))
+	if v, err := strconv.Atoi(string(rssi)); nil == err && v != 0 {
+		node.RSSI = &v
+	}
+	return node
+}
+
+// parseAsusAllClientList maps client MACs to the MAC of the node they're
+// attached to. Depending on the firmware the hook result is either a list
+// of single node objects or one object keyed by node.
+func parseAsusAllClientList(raw json.RawMessage) map[string]string {
+	var nodes []map[string]map[string]map[string]json.RawMessage
+	var node map[string]map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &nodes); nil != err {
+		if err := json.Unmarshal(raw, &node); nil != err {
+			return nil
+		}
+		nodes = append(nodes, node)
+	}
+
+	attached := make(map[string]string)
+	for _, n := range nodes {
+		for nodeMAC, bands := range n {
+			// bands is keyed by 2G, 5G, ..., and wired_mac
+			for _, clients := range bands {
+				for clientMAC := range clients {
+					attached[normalizeMAC(clientMAC)] = normalizeMAC(nodeMAC)
+				}
+			}
+		}
+	}
+	return attached
+}
+
+// attachAsusClients sets the node of every client found in attached
+func attachAsusClients(clients []Client, attached map[string]string) {
+	for i := range clients {
+		if nodeMAC, prs := attached[normalizeMAC(clients[i].MAC)]; prs {
+			clients[i].Node = nodeMAC
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// The parental control MAC filter is kept in nvram as parallel lists
+// separated by ">". An entry enabled with asusFilterBlock has no internet
+// access at all, while asusFilterSchedule only allows it at set times.
+const (
+	asusFilterBlock    = "2"
+	asusFilterSchedule = "1"
+)
+
+// asusFilterLists are the nvram lists that make up the filter, which must be
+// edited together to keep them aligned
+var asusFilterLists = []string{"MULTIFILTER_ENABLE", "MULTIFILTER_MAC", "MULTIFILTER_DEVICENAME",
+	"MULTIFILTER_MACFILTER_DAYTIME_V2"}
+
+// asusFilter is the parental control MAC filter, by nvram name
+type asusFilter map[string][]string
+
+// Block the client with the parental control MAC filter
+func (rtr *AsusRouter) Block(ctx context.Context, mac string) error {
+	filter, err := rtr.filter(ctx)
+	if nil != err {
+		return err
+	}
+	if i := filter.find(mac); i >= 0 {
+		if asusFilterBlock == filter["MULTIFILTER_ENABLE"][i] {
+			return nil
+		}
+		filter["MULTIFILTER_ENABLE"][i] = asusFilterBlock
+	} else {
+		filter.add(map[string]string{
+			"MULTIFILTER_ENABLE":     asusFilterBlock,
+			"MULTIFILTER_MAC":        normalizeMAC(mac),
+			"MULTIFILTER_DEVICENAME": normalizeMAC(mac),
+		})
+	}
+	log.Printf("AsusRouter: Blocking %s", mac)
+	return rtr.applyFilter(ctx, filter)
+}
+
+// Unblock the client by removing it from the parental control MAC filter.
+// Clients that are only filtered on a schedule are left alone.
+func (rtr *AsusRouter) Unblock(ctx context.Context, mac string) error {
+	filter, err := rtr.filter(ctx)
+	if nil != err {
+		return err
+	}
+	i := filter.find(mac)
+	if i < 0 || asusFilterSchedule == filter["MULTIFILTER_ENABLE"][i] {
+		return nil
+	}
+	filter.remove(i)
+	log.Printf("AsusRouter: Unblocking %s", mac)
+	return rtr.applyFilter(ctx, filter)
+}
+
+// filter reads the parental control MAC filter
+func (rtr *AsusRouter) filter(ctx context.Context) (asusFilter, error) {
+	hooks := make([]string, 0, len(asusFilterLists))
+	for _, name := range asusFilterLists {
+		hooks = append(hooks, fmt.Sprintf("nvram_get(%s)", name))
+	}
+	result, err := rtr.appGet(ctx, strings.Join(hooks, ";"))
+	if nil != err {
+		return nil, err
+	}
+	return parseAsusFilter(result)
+}
+
+// parseAsusFilter returns the filter from the nvram_get() results, padding
+// lists that are shorter than the MAC list
+func parseAsusFilter(result map[string]json.RawMessage) (asusFilter, error) {
+	filter := make(asusFilter)
+	for _, name := range asusFilterLists {
+		var value asusString
+		if raw, prs := result[name]; prs {
+			if err := json.Unmarshal(raw, &value); nil != err {
+				return nil, fmt.Errorf("%w: %s: %v", ErrSchema, name, err)
+			}
+		}
+		filter[name] = make([]string, 0)
+		if 0 != len(value) {
+			filter[name] = strings.Split(string(value), ">")
+		}
+	}
+	macs := len(filter["MULTIFILTER_MAC"])
+	for _, name := range asusFilterLists {
+		for len(filter[name]) < macs {
+			filter[name] = append(filter[name], "")
+		}
+		filter[name] = filter[name][:macs]
+	}
+	return filter, nil
+}
+
+// find returns the index of the MAC in the filter, or -1
+func (f asusFilter) find(mac string) int {
+	for i, m := range f["MULTIFILTER_MAC"] {
+		if strings.EqualFold(m, mac) {
+			return i
+		}
+	}
+	return -1
+}
+
+// add appends an entry to every list
+func (f asusFilter) add(entry map[string]string) {
+	for _, name := range asusFilterLists {
+		f[name] = append(f[name], entry[name])
+	}
+}
+
+// remove deletes the entry from every list
+func (f asusFilter) remove(i int) {
+	for _, name := range asusFilterLists {
+		f[name] = append(f[name][:i], f[name][i+1:]...)
+	}
+}
+
+// applyFilter saves the filter and restarts the firewall so it takes effect
+func (rtr *AsusRouter) applyFilter(ctx context.Context, filter asusFilter) error {
+	form := url.Values{}
+	form.Set("action_mode", "apply")
+	form.Set("rc_service", "restart_firewall")
+	form.Set("MULTIFILTER_ALL", "1")
+	for _, name := range asusFilterLists {
+		form.Set(name, strings.Join(filter[name], ">"))
+	}
+	return rtr.withToken(ctx, func() error {
+		return rtr.doPost(ctx, "applyapp.cgi", form)
+	})
+}
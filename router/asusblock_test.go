@@ -0,0 +1,153 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// multifilter is the filter in asuswrt/multifilter.json, where the device
+// names and schedules are short of the MAC list and the enable list has a
+// stale extra entry
+var multifilter = asusFilter{
+	"MULTIFILTER_ENABLE":               {"1", "2", "2"},
+	"MULTIFILTER_MAC":                  {"AA:BB:CC:DD:EE:01", "AA:BB:CC:DD:EE:02", "AA:BB:CC:DD:EE:03"},
+	"MULTIFILTER_DEVICENAME":           {"kids-tablet", "AA:BB:CC:DD:EE:02", ""},
+	"MULTIFILTER_MACFILTER_DAYTIME_V2": {"W03E21000700<W04122000800", "", ""},
+}
+
+func TestParseAsusFilter(t *testing.T) {
+	result, err := parseAsusAppGet(readFixture(t, "asuswrt/multifilter.json"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	filter, err := parseAsusFilter(result)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(filter, multifilter) {
+		t.Errorf("got %q, want %q", filter, multifilter)
+	}
+
+	// No filter at all is empty lists
+	filter, err = parseAsusFilter(map[string]json.RawMessage{})
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, name := range asusFilterLists {
+		if 0 != len(filter[name]) {
+			t.Errorf("got %s %q from no filter", name, filter[name])
+		}
+	}
+}
+
+// TestAsusBlock blocks and unblocks clients against the filter fixture,
+// checking the lists posted to applyapp.cgi stay aligned
+func TestAsusBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		mac   string
+		block bool
+		want  map[string]string // the lists posted, or nil for no post
+	}{
+		{"block a new client", "aa:bb:cc:dd:ee:04", true, map[string]string{
+			"MULTIFILTER_ENABLE":               "1>2>2>2",
+			"MULTIFILTER_MAC":                  "AA:BB:CC:DD:EE:01>AA:BB:CC:DD:EE:02>AA:BB:CC:DD:EE:03>AA:BB:CC:DD:EE:04",
+			"MULTIFILTER_DEVICENAME":           "kids-tablet>AA:BB:CC:DD:EE:02>>AA:BB:CC:DD:EE:04",
+			"MULTIFILTER_MACFILTER_DAYTIME_V2": "W03E21000700<W04122000800>>>",
+		}},
+		{"block a scheduled client", "aa:bb:cc:dd:ee:01", true, map[string]string{
+			"MULTIFILTER_ENABLE":               "2>2>2",
+			"MULTIFILTER_MAC":                  "AA:BB:CC:DD:EE:01>AA:BB:CC:DD:EE:02>AA:BB:CC:DD:EE:03",
+			"MULTIFILTER_DEVICENAME":           "kids-tablet>AA:BB:CC:DD:EE:02>",
+			"MULTIFILTER_MACFILTER_DAYTIME_V2": "W03E21000700<W04122000800>>",
+		}},
+		{"block a blocked client", "AA:BB:CC:DD:EE:02", true, nil},
+		{"unblock from the middle", "aa:bb:cc:dd:ee:02", false, map[string]string{
+			"MULTIFILTER_ENABLE":               "1>2",
+			"MULTIFILTER_MAC":                  "AA:BB:CC:DD:EE:01>AA:BB:CC:DD:EE:03",
+			"MULTIFILTER_DEVICENAME":           "kids-tablet>",
+			"MULTIFILTER_MACFILTER_DAYTIME_V2": "W03E21000700<W04122000800>",
+		}},
+		{"unblock the last client", "AA:BB:CC:DD:EE:03", false, map[string]string{
+			"MULTIFILTER_ENABLE":               "1>2",
+			"MULTIFILTER_MAC":                  "AA:BB:CC:DD:EE:01>AA:BB:CC:DD:EE:02",
+			"MULTIFILTER_DEVICENAME":           "kids-tablet>AA:BB:CC:DD:EE:02",
+			"MULTIFILTER_MACFILTER_DAYTIME_V2": "W03E21000700<W04122000800>",
+		}},
+		{"unblock a scheduled client", "AA:BB:CC:DD:EE:01", false, nil},
+		{"unblock an unknown client", "AA:BB:CC:DD:EE:09", false, nil},
+	}
+	filter := readFixture(t, "asuswrt/multifilter.json")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var posted url.Values
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/login.cgi":
+					w.Write(readFixture(t, "asuswrt/login_ok.json"))
+				case "/appGet.cgi":
+					want := "nvram_get(MULTIFILTER_ENABLE);nvram_get(MULTIFILTER_MAC);nvram_get(MULTIFILTER_DEVICENAME);" +
+						"nvram_get(MULTIFILTER_MACFILTER_DAYTIME_V2)"
+					// The hooks are sent unescaped, as the firmware expects
+					if hook := strings.TrimPrefix(r.URL.RawQuery, "hook="); want != hook {
+						t.Errorf("got hook %q, want %q", hook, want)
+					}
+					w.Write(filter)
+				case "/applyapp.cgi":
+					if http.MethodPost != r.Method {
+						t.Errorf("got %s applyapp.cgi, want POST", r.Method)
+					}
+					if err := r.ParseForm(); nil != err {
+						t.Error(err)
+					}
+					posted = r.PostForm
+					w.Write([]byte(`{"modify":"1"}`))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			rtr, err := NewAsusRouter(Config{"url": server.URL, "username": "admin", "password": "admin"})
+			if nil != err {
+				t.Fatal(err)
+			}
+			blocker := rtr.(Blocker)
+			if test.block {
+				err = blocker.Block(context.Background(), test.mac)
+			} else {
+				err = blocker.Unblock(context.Background(), test.mac)
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			if nil == test.want {
+				if nil != posted {
+					t.Errorf("got %v posted, want nothing", posted)
+				}
+				return
+			}
+			if nil == posted {
+				t.Fatal("nothing was posted")
+			}
+			want := url.Values{
+				"action_mode":     {"apply"},
+				"rc_service":      {"restart_firewall"},
+				"MULTIFILTER_ALL": {"1"},
+			}
+			for name, value := range test.want {
+				want.Set(name, value)
+			}
+			if !reflect.DeepEqual(posted, want) {
+				t.Errorf("got %q posted, want %q", posted, want)
+			}
+		})
+	}
+}
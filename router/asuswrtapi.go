@@ -1,17 +1,23 @@
 package router
 
 import (
+	"bytes"
+	"context"
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
+const asusUserAgent = "asusrouter-Android-DUTUtil-1.0.0.3.58-163"
+
 // AsusConnection is a connection to an Asus router
 type AsusConnection struct {
 	url           string
@@ -22,134 +28,459 @@ type AsusConnection struct {
 // AsusRouter is an Asus router
 type AsusRouter struct {
 	connection *AsusConnection
+	client     *httpClient
+	url        string
+	username   string
+	password   string
 }
 
+// asusString is a string value that some firmware versions send as a number
+type asusString string
+
+func (s *asusString) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*s = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var v string
+		if err := json.Unmarshal(data, &v); nil != err {
+			return err
+		}
+		*s = asusString(v)
+		return nil
+	}
+	var v json.Number
+	if err := json.Unmarshal(data, &v); nil != err {
+		return err
+	}
+	*s = asusString(v.String())
+	return nil
+}
+
+// asusLoginResponse is the body returned by login.cgi
+type asusLoginResponse struct {
+	Token             asusString `json:"asus_token"`
+	ErrorStatus       asusString `json:"error_status"`
+	RemainingLockTime asusString `json:"remaining_lock_time"`
+}
+
+// asusClient is an entry in the get_clientlist hook response
+type asusClient struct {
+	Name          asusString `json:"name"`
+	NickName      asusString `json:"nickName"`
+	MAC           asusString `json:"mac"`
+	IP            asusString `json:"ip"`
+	Vendor        asusString `json:"vendor"`
+	IsOnline      asusString `json:"isOnline"`
+	IsWL          asusString `json:"isWL"`
+	IsGN          asusString `json:"isGN"`
+	RSSI          asusString `json:"rssi"`
+	CurTx         asusString `json:"curTx"`
+	CurRx         asusString `json:"curRx"`
+	WlConnectTime asusString `json:"wlConnectTime"`
+	PapMAC        asusString `json:"amesh_papMac"`
+}
+
+// asusBands maps isWL to the band and the nvram wl unit for that band
+var asusBands = map[string]struct {
+	band Band
+	unit int
+}{
+	"1": {Band2GHz, 0},
+	"2": {Band5GHz, 1},
+	"3": {Band5GHz2, 2},
+	"4": {Band6GHz, 3},
+}
+
+// asusClientListHook fetches the client list along with the mesh client
+// assignments and the SSIDs of every band and guest network
+var asusClientListHook = func() string {
+	hooks := []string{"get_clientlist()", "get_allclientlist()"}
+	for unit := 0; unit < 4; unit++ {
+		hooks = append(hooks, fmt.Sprintf("nvram_get(wl%d_ssid)", unit))
+		for guest := 1; guest < 4; guest++ {
+			hooks = append(hooks, fmt.Sprintf("nvram_get(wl%d.%d_ssid)", unit, guest))
+		}
+	}
+	return strings.Join(hooks, ";")
+}()
+
+// Login error_status values
+const (
+	asusErrorAuthFailed = "3"
+	asusErrorLockedOut  = "7"
+	asusErrorCaptcha    = "10"
+)
+
+// errTokenRejected means the router no longer accepts our token
+var errTokenRejected = errors.New("AsusRouter: token rejected")
+
 func init() {
 	log.Println("Registering 'asuswrt' router driver")
-	AddRouter("asuswrt", &AsusRouter{})
+	AddRouter(Driver{
+		Name:        "asuswrt",
+		Description: "ASUS routers running stock or Merlin firmware",
+		Config: append([]ConfigField{
+			{Name: "url", Description: "Router admin URL", Required: true, Default: "http://192.168.1.1"},
+			{Name: "username", Description: "Admin username", Required: true, Default: "admin"},
+			{Name: "password", Description: "Admin password", Required: true, Secret: true},
+		}, tlsConfigFields...),
+		New: NewAsusRouter,
+	})
 }
 
 // ValidConnection is true if the connection is valid
 func ValidConnection(conn *AsusConnection) bool {
 	// See if the token is older than 1 hour
 	if nil != conn {
-		// log.Printf("%s ? %s", conn.timestamp, time.Now().Add(-1*time.Hour))
 		return conn.timestamp.After(time.Now().Add(-1 * time.Hour))
 	}
 	return false
 }
 
+// NewAsusRouter creates an Asus router from its url, username and password
+// settings
+func NewAsusRouter(config Config) (Router, error) {
+	client, err := newHTTPClient(config)
+	if nil != err {
+		return nil, err
+	}
+	return &AsusRouter{
+		client:   client,
+		url:      strings.TrimSuffix(config.Get("url"), "/"),
+		username: config.Get("username"),
+		password: config.Get("password"),
+	}, nil
+}
+
 // Connect to a router
-func (rtr *AsusRouter) Connect(url string, username string, password string) error {
+func (rtr *AsusRouter) Connect(ctx context.Context) error {
 	if nil != rtr.connection && ValidConnection(rtr.connection) {
 		return nil
 	}
 
 	log.Println("AsusRouter: Invalid connection, attempting to connect")
+	return rtr.login(ctx)
+}
 
-	client := &http.Client{}
+func (rtr *AsusRouter) login(ctx context.Context) error {
+	rtr.connection = nil
 
-	// body := fmt.Sprintf("group_id=&action_mode=&action_script=&action_wait=5&current_page=Main_Login.asp&next_page=index.asp&login_authorization=%s", b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))))
-	body := fmt.Sprintf("login_authorization=%s", b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))))
-	// fmt.Println(body)
-	loginURL := fmt.Sprintf("%s/login.cgi", url)
-	// fmt.Println(loginURL)
-	req, err := http.NewRequest("POST", loginURL, strings.NewReader(body))
+	body := fmt.Sprintf("login_authorization=%s", b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", rtr.username, rtr.password))))
+	loginURL := fmt.Sprintf("%s/login.cgi", rtr.url)
+	req, err := http.NewRequestWithContext(ctx, "POST", loginURL, strings.NewReader(body))
 	if nil != err {
 		return err
 	}
 
-	req.Header.Add("User-Agent", "asusrouter-Android-DUTUtil-1.0.0.3.58-163")
-	// req.Header.Add("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:73.0) Gecko/20100101 Firefox/73.0")
+	req.Header.Add("User-Agent", asusUserAgent)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Accept", "application/json")
-	resp, err := client.Do(req)
+	resp, err := rtr.client.Do(req)
 	if nil != err {
 		return err
 	}
+	defer resp.Body.Close()
 
-	// for i, s := range resp.Header {
-	// 	fmt.Printf("%s  ===  %s\n", i, s)
-	// }
-	// fmt.Println(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Router responded with code %d", resp.StatusCode)
+	}
 
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	token, err := parseAsusLogin(bodyBytes)
+	if nil != err {
+		return err
+	}
+
+	rtr.connection = &AsusConnection{url: rtr.url, authorization: token, timestamp: time.Now()}
+	log.Printf("Connected to %s", rtr.connection.url)
+	return nil
+}
+
+// parseAsusLogin returns the token from a login.cgi response body
+func parseAsusLogin(body []byte) (string, error) {
+	var result asusLoginResponse
+	if err := json.Unmarshal(body, &result); nil != err {
+		return "", fmt.Errorf("%w: login response: %v", ErrSchema, err)
+	}
+
+	switch result.ErrorStatus {
+	case "":
+	case asusErrorAuthFailed:
+		return "", ErrAuthFailed
+	case asusErrorLockedOut, asusErrorCaptcha:
+		if 0 != len(result.RemainingLockTime) {
+			return "", fmt.Errorf("%w for %s seconds", ErrLockedOut, result.RemainingLockTime)
 		}
-		bodyString := string(bodyBytes)
-		log.Println(bodyString)
-
-		var result map[string]interface{}
-		json.Unmarshal([]byte(bodyString), &result)
-		// Note: If result["error_status"] exists then the connection failed
-		// TODO: Check for an error
-		rtr.connection = &AsusConnection{url: url, authorization: result["asus_token"].(string), timestamp: time.Now()}
-		log.Printf("Connected to %s with token %s", rtr.connection.url, rtr.connection.authorization)
-		// fmt.Println(connection)
-		return nil
+		return "", ErrLockedOut
+	default:
+		return "", fmt.Errorf("%w: login error_status %s", ErrAuthFailed, result.ErrorStatus)
 	}
 
-	return fmt.Errorf("Router responded with code %d", resp.StatusCode)
+	if 0 == len(result.Token) {
+		return "", fmt.Errorf("%w: login response has no asus_token", ErrSchema)
+	}
+	return string(result.Token), nil
 }
 
 // Clients connected to the router
-func (rtr *AsusRouter) Clients() ([]Client, error) {
-	client := http.Client{}
+func (rtr *AsusRouter) Clients(ctx context.Context) ([]Client, error) {
+	result, err := rtr.appGet(ctx, asusClientListHook)
+	if nil != err {
+		return nil, err
+	}
+	clients, err := parseAsusClientList(result)
+	if nil != err {
+		return nil, err
+	}
+
+	// Mesh firmware knows which node each client is attached to
+	if raw, prs := result["get_allclientlist"]; prs {
+		attachAsusClients(clients, parseAsusAllClientList(raw))
+	}
+	return clients, nil
+}
+
+// appGet runs the hooks
+func (rtr *AsusRouter) appGet(ctx context.Context, hook string) (map[string]json.RawMessage, error) {
+	var result map[string]json.RawMessage
+	err := rtr.withToken(ctx, func() error {
+		var err error
+		result, err = rtr.doAppGet(ctx, hook)
+		return err
+	})
+	return result, err
+}
+
+// withToken makes the request, logging in first if needed, and logging in
+// again and retrying once if the router rejects the token
+func (rtr *AsusRouter) withToken(ctx context.Context, request func() error) error {
+	if nil == rtr.connection {
+		if err := rtr.login(ctx); nil != err {
+			return err
+		}
+	}
 
-	url := fmt.Sprintf("%s/appGet.cgi?hook=get_clientlist()", rtr.connection.url)
-	// fmt.Println(url)
-	req, err := http.NewRequest("GET", url, nil)
+	err := request()
+	if errTokenRejected == err {
+		// The router can forget a token before the hour is up (e.g. after
+		// a reboot or another login) so log in again and retry once
+		log.Println("AsusRouter: Token rejected, attempting to reconnect")
+		if err := rtr.login(ctx); nil != err {
+			return err
+		}
+		err = request()
+	}
+	return err
+}
+
+func (rtr *AsusRouter) doAppGet(ctx context.Context, hook string) (map[string]json.RawMessage, error) {
+	url := fmt.Sprintf("%s/appGet.cgi?hook=%s", rtr.connection.url, hook)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if nil != err {
 		return nil, err
 	}
 
-	req.Header.Add("User-Agent", "asusrouter-Android-DUTUtil-1.0.0.3.58-163")
-	// req.Header.Add("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:73.0) Gecko/20100101 Firefox/73.0")
+	req.Header.Add("User-Agent", asusUserAgent)
 	req.Header.Add("Accept", "application/json")
 	req.AddCookie(&http.Cookie{Name: "asus_token", Value: rtr.connection.authorization})
-	resp, err := client.Do(req)
+	resp, err := rtr.client.Do(req)
 	if nil != err {
 		return nil, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, errTokenRejected
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Router responded with code %d", resp.StatusCode)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseAsusAppGet(bodyBytes)
+}
 
-	// for i, s := range resp.Header {
-	// 	fmt.Printf("%s  ===  %s\n", i, s)
-	// }
-	// fmt.Println(resp.Body)
+// doPost posts the form to one of the router's cgi endpoints, which answer
+// with a JSON object
+func (rtr *AsusRouter) doPost(ctx context.Context, endpoint string, form url.Values) error {
+	endpointURL := fmt.Sprintf("%s/%s", rtr.connection.url, endpoint)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpointURL, strings.NewReader(form.Encode()))
+	if nil != err {
+		return err
+	}
 
+	req.Header.Add("User-Agent", asusUserAgent)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.AddCookie(&http.Cookie{Name: "asus_token", Value: rtr.connection.authorization})
+	resp, err := rtr.client.Do(req)
+	if nil != err {
+		return err
+	}
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return errTokenRejected
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Router responded with code %d", resp.StatusCode)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	_, err = parseAsusAppGet(bodyBytes)
+	return err
+}
+
+// parseAsusAppGet splits an appGet.cgi response body into its hook results
+func parseAsusAppGet(body []byte) (map[string]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		// An expired token gets the login page (or a redirect to it)
+		// instead of JSON
+		if bytes.Contains(body, []byte("Main_Login.asp")) {
+			return nil, errTokenRejected
+		}
+		return nil, fmt.Errorf("%w: appGet response is not JSON", ErrSchema)
+	}
+
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &result); nil != err {
+		return nil, fmt.Errorf("%w: appGet response: %v", ErrSchema, err)
+	}
+	if _, prs := result["error_status"]; prs {
+		return nil, errTokenRejected
+	}
+	return result, nil
+}
+
+// parseAsusClientList returns the clients from the get_clientlist() hook
+// result
+func parseAsusClientList(result map[string]json.RawMessage) ([]Client, error) {
+	rawList, prs := result["get_clientlist"]
+	if !prs {
+		return nil, fmt.Errorf("%w: no get_clientlist in response", ErrSchema)
+	}
+	var clientList map[string]json.RawMessage
+	if err := json.Unmarshal(rawList, &clientList); nil != err {
+		return nil, fmt.Errorf("%w: get_clientlist: %v", ErrSchema, err)
+	}
+
+	rawMacList, prs := clientList["maclist"]
+	if !prs {
+		return nil, fmt.Errorf("%w: no maclist in get_clientlist", ErrSchema)
+	}
+	var macList []string
+	if err := json.Unmarshal(rawMacList, &macList); nil != err {
+		return nil, fmt.Errorf("%w: maclist: %v", ErrSchema, err)
+	}
+
+	now := time.Now()
+	clients := make([]Client, 0, len(macList))
+	for _, mac := range macList {
+		rawClient, prs := clientList[mac]
+		if !prs {
+			log.Printf("AsusRouter: No client details for %s", mac)
+			continue
+		}
+		var c asusClient
+		if err := json.Unmarshal(rawClient, &c); nil != err {
+			return nil, fmt.Errorf("%w: client %s: %v", ErrSchema, mac, err)
+		}
+
+		if 0 == len(c.MAC) {
+			c.MAC = asusString(mac)
 		}
-		bodyString := string(bodyBytes)
-		// fmt.Println(bodyString)
-
-		var result map[string]interface{}
-		json.Unmarshal([]byte(bodyString), &result)
-
-		clientList := result["get_clientlist"].(map[string]interface{})
-		macList := clientList["maclist"].([]interface{})
-		clients := make([]Client, len(macList))
-		for i, s := range macList {
-			// fmt.Println(i, s)
-			rawClient := clientList[s.(string)].(map[string]interface{})
-			online, _ := strconv.ParseBool(rawClient["isOnline"].(string))
-			clients[i] = Client{
-				Name:   rawClient["name"].(string),
-				MAC:    rawClient["mac"].(string),
-				IP:     rawClient["ip"].(string),
-				Vendor: rawClient["vendor"].(string),
-				Online: online,
-			}
+		clients = append(clients, c.toClient(result, now))
+	}
+	return clients, nil
+}
+
+// toClient converts the raw client. nvram holds the nvram_get() results that
+// accompany the client list.
+func (c *asusClient) toClient(nvram map[string]json.RawMessage, now time.Time) Client {
+	name := string(c.NickName)
+	if 0 == len(name) {
+		name = string(c.Name)
+	}
+	online, _ := strconv.ParseBool(string(c.IsOnline))
+	client := Client{
+		Name:   name,
+		MAC:    string(c.MAC),
+		IP:     string(c.IP),
+		Vendor: string(c.Vendor),
+		Online: online,
+		Node:   normalizeMAC(string(c.PapMAC)),
+	}
+
+	if "0" == c.IsWL {
+		client.Medium = MediumWired
+		return client
+	}
+	band, prs := asusBands[string(c.IsWL)]
+	if !prs {
+		return client
+	}
+	client.Medium = MediumWireless
+	client.Band = band.band
+
+	guest, _ := strconv.Atoi(string(c.IsGN))
+	client.Guest = guest > 0
+	ssidKey := fmt.Sprintf("wl%d_ssid", band.unit)
+	if client.Guest {
+		ssidKey = fmt.Sprintf("wl%d.%d_ssid", band.unit, guest)
+	}
+	var ssid asusString
+	if raw, prs := nvram[ssidKey]; prs && nil == json.Unmarshal(raw, &ssid) {
+		client.SSID = string(ssid)
+	}
+
+	if rssi, err := strconv.Atoi(string(c.RSSI)); nil == err && rssi != 0 {
+		client.RSSI = &rssi
+	}
+	if tx, err := strconv.ParseFloat(strings.TrimSpace(string(c.CurTx)), 64); nil == err {
+		client.TxRate = &tx
+	}
+	if rx, err := strconv.ParseFloat(strings.TrimSpace(string(c.CurRx)), 64); nil == err {
+		client.RxRate = &rx
+	}
+	if connected, ok := parseAsusDuration(string(c.WlConnectTime)); ok {
+		since := now.Add(-connected).Truncate(time.Second)
+		client.ConnectedSince = &since
+	}
+	return client
+}
+
+// parseAsusDuration parses the HH:MM:SS durations used by wlConnectTime
+func parseAsusDuration(s string) (time.Duration, bool) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		v, err := strconv.Atoi(parts[i])
+		if nil != err || v < 0 {
+			return 0, false
 		}
-		// fmt.Println(clients)
-		return clients, nil
+		d += time.Duration(v) * unit
 	}
+	return d, true
+}
 
-	return nil, fmt.Errorf("Router responded with code %d", resp.StatusCode)
+// PeerFingerprint is the fingerprint of the certificate presented on the
+// last HTTPS connection
+func (rtr *AsusRouter) PeerFingerprint() string {
+	return rtr.client.PeerFingerprint()
 }
@@ -0,0 +1,222 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAsusString(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    asusString
+		wantErr bool
+	}{
+		{`"1"`, "1", false},
+		{`1`, "1", false},
+		{`-52`, "-52", false},
+		{`866.7`, "866.7", false},
+		{`null`, "", false},
+		{`""`, "", false},
+		{`{"a":1}`, "", true},
+		{`[1]`, "", true},
+	}
+	for _, test := range tests {
+		var s asusString
+		err := json.Unmarshal([]byte(test.json), &s)
+		if test.wantErr != (nil != err) {
+			t.Errorf("%s: got error %v", test.json, err)
+		} else if s != test.want {
+			t.Errorf("%s: got %q, want %q", test.json, s, test.want)
+		}
+	}
+}
+
+func TestParseAsusLogin(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		wantToken string
+		wantErr   error
+	}{
+		{"login_ok.json", "d3cbd8b2e0d7f1a6b1b8a9f0c4e5d6a7", nil},
+		{"login_failed_386.json", "", ErrAuthFailed},
+		{"login_failed_388.json", "", ErrAuthFailed},
+		{"login_locked_386.json", "", ErrLockedOut},
+		{"login_locked_388.json", "", ErrLockedOut},
+		{"login_captcha.json", "", ErrLockedOut},
+		{"login_unknown.json", "", ErrAuthFailed},
+		{"login_no_token.json", "", ErrSchema},
+		{"login_html.txt", "", ErrSchema},
+	}
+	for _, test := range tests {
+		token, err := parseAsusLogin(readFixture(t, "asuswrt/"+test.fixture))
+		if !errors.Is(err, test.wantErr) || (nil == test.wantErr && nil != err) {
+			t.Errorf("%s: got error %v, want %v", test.fixture, err, test.wantErr)
+		}
+		if token != test.wantToken {
+			t.Errorf("%s: got token %q, want %q", test.fixture, token, test.wantToken)
+		}
+	}
+}
+
+func TestParseAsusLoginLockTime(t *testing.T) {
+	for _, fixture := range []string{"login_locked_386.json", "login_locked_388.json"} {
+		_, err := parseAsusLogin(readFixture(t, "asuswrt/"+fixture))
+		if want := fmt.Sprintf("%v for 58 seconds", ErrLockedOut); nil == err || err.Error() != want {
+			t.Errorf("%s: got %v, want %s", fixture, err, want)
+		}
+	}
+}
+
+func TestParseAsusAppGet(t *testing.T) {
+	tests := []struct {
+		fixture string
+		wantErr error
+	}{
+		{"clientlist_386.json", nil},
+		{"appget_error_status.json", errTokenRejected},
+		{"appget_login_page.html", errTokenRejected},
+		{"login_html.txt", ErrSchema},
+	}
+	for _, test := range tests {
+		_, err := parseAsusAppGet(readFixture(t, "asuswrt/"+test.fixture))
+		if !errors.Is(err, test.wantErr) || (nil == test.wantErr && nil != err) {
+			t.Errorf("%s: got error %v, want %v", test.fixture, err, test.wantErr)
+		}
+	}
+}
+
+func TestParseAsusClientList(t *testing.T) {
+	rssi, tx, rx := -52, 866.7, 780.0
+	want := []Client{
+		{Name: "Pixel-7", MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.50.10", Vendor: "Google", Online: true,
+			Medium: MediumWireless, Band: Band5GHz, SSID: "Home-5G", RSSI: &rssi, TxRate: &tx, RxRate: &rx},
+		// The nickname wins over the name, and wired clients have no radio
+		// details
+		{Name: "Synology NAS", MAC: "AA:BB:CC:DD:EE:02", IP: "192.168.50.5", Vendor: "Synology", Online: true,
+			Medium: MediumWired},
+		{Name: "visitor", MAC: "AA:BB:CC:DD:EE:03", IP: "192.168.101.20", Medium: MediumWireless, Band: Band2GHz,
+			Guest: true, SSID: "Home-Guest", Node: "11:22:33:44:55:66"},
+	}
+	// Firmware 386 sends every field as a string, 388 sends numbers and
+	// nulls, and lists MACs it has no details for
+	for _, fixture := range []string{"clientlist_386.json", "clientlist_388.json"} {
+		result, err := parseAsusAppGet(readFixture(t, "asuswrt/"+fixture))
+		if nil != err {
+			t.Fatal(err)
+		}
+		before := time.Now()
+		clients, err := parseAsusClientList(result)
+		if nil != err {
+			t.Fatalf("%s: %v", fixture, err)
+		}
+		if 0 == len(clients) || nil == clients[0].ConnectedSince {
+			t.Fatalf("%s: no connected_since for the first client", fixture)
+		}
+		connected := before.Add(-(time.Hour + 2*time.Minute + 3*time.Second))
+		if d := clients[0].ConnectedSince.Sub(connected); d < -time.Second || d > time.Second {
+			t.Errorf("%s: got connected_since %s, want %s", fixture, clients[0].ConnectedSince, connected)
+		}
+		clients[0].ConnectedSince = nil
+		expectClients(t, clients, want)
+	}
+}
+
+func TestParseAsusClientListSchema(t *testing.T) {
+	for _, fixture := range []string{"clientlist_missing.json", "clientlist_no_maclist.json",
+		"clientlist_bad_field.json"} {
+		result, err := parseAsusAppGet(readFixture(t, "asuswrt/"+fixture))
+		if nil != err {
+			t.Fatal(err)
+		}
+		if _, err = parseAsusClientList(result); !errors.Is(err, ErrSchema) {
+			t.Errorf("%s: got %v, want %v", fixture, err, ErrSchema)
+		}
+	}
+}
+
+// TestAsusRelogin checks a request with a rejected token logs in again and
+// is retried once, however the firmware rejects it
+func TestAsusRelogin(t *testing.T) {
+	rejections := map[string]func(w http.ResponseWriter){
+		"unauthorized": func(w http.ResponseWriter) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		},
+		"login page": func(w http.ResponseWriter) {
+			w.Write(readFixture(t, "asuswrt/appget_login_page.html"))
+		},
+		"error_status": func(w http.ResponseWriter) {
+			w.Write(readFixture(t, "asuswrt/appget_error_status.json"))
+		},
+	}
+	clientList := readFixture(t, "asuswrt/clientlist_386.json")
+	for name, reject := range rejections {
+		logins := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/login.cgi":
+				logins++
+				fmt.Fprintf(w, `{"asus_token":"token%d"}`, logins)
+			case "/appGet.cgi":
+				// Only the latest token is accepted
+				if cookie, err := r.Cookie("asus_token"); nil != err || cookie.Value != fmt.Sprintf("token%d", logins) ||
+					1 == logins {
+					reject(w)
+					return
+				}
+				w.Write(clientList)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+
+		rtr, err := NewAsusRouter(Config{"url": server.URL, "username": "admin", "password": "admin"})
+		if nil != err {
+			t.Fatal(err)
+		}
+		if err = rtr.Connect(context.Background()); nil != err {
+			t.Fatal(err)
+		}
+		clients, err := rtr.Clients(context.Background())
+		if nil != err {
+			t.Errorf("%s: %v", name, err)
+		} else if 3 != len(clients) {
+			t.Errorf("%s: got %d clients, want 3", name, len(clients))
+		}
+		if 2 != logins {
+			t.Errorf("%s: got %d logins, want 2", name, logins)
+		}
+		server.Close()
+	}
+}
+
+// TestAsusReloginOnce checks a token that's rejected again after logging in
+// isn't retried forever
+func TestAsusReloginOnce(t *testing.T) {
+	logins := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/login.cgi" == r.URL.Path {
+			logins++
+			fmt.Fprint(w, `{"asus_token":"token"}`)
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	rtr, err := NewAsusRouter(Config{"url": server.URL, "username": "admin", "password": "admin"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = rtr.Clients(context.Background()); errTokenRejected != err {
+		t.Errorf("got %v, want %v", err, errTokenRejected)
+	}
+	if 2 != logins {
+		t.Errorf("got %d logins, want 2", logins)
+	}
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"context"
+	"errors"
+)
+
+// Capability is something a router can do beyond listing its clients
+type Capability string
+
+// Capabilities drivers can have
+const (
+	CapabilityClients Capability = "clients"
+	CapabilityNodes   Capability = "nodes"
+	CapabilityBlock   Capability = "block"
+	CapabilityActions Capability = "actions"
+)
+
+// ErrNotSupported is returned when the router can't do what was asked
+var ErrNotSupported = errors.New("not supported by the router")
+
+// Blocker is a Router that can stop clients from using the network
+type Blocker interface {
+	Router
+	// Block the client, which is harmless if it's already blocked
+	Block(ctx context.Context, mac string) error
+	// Unblock the client, which is harmless if it isn't blocked
+	Unblock(ctx context.Context, mac string) error
+}
+
+// ClientAction describes something a driver can do to one of its clients
+type ClientAction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ActionRunner is a Router that contributes actions on its clients. Its
+// actions take the place of the server's own actions with the same name.
+type ActionRunner interface {
+	Router
+	ClientActions() []ClientAction
+	// RunClientAction runs the named action on the client, returning a
+	// message about what it did
+	RunClientAction(ctx context.Context, name string, c Client) (string, error)
+}
+
+// Capabilities returns what the driver's routers can do, or nil if one can't
+// be created from the driver's defaults
+func (d Driver) Capabilities() []Capability {
+	config := make(Config)
+	for _, field := range d.Config {
+		config[field.Name] = field.Default
+	}
+	rtr, err := d.New(config)
+	if nil != err {
+		return nil
+	}
+	return Capabilities(rtr)
+}
+
+// Capabilities returns what the router can do
+func Capabilities(r Router) []Capability {
+	capabilities := []Capability{CapabilityClients}
+	if _, ok := r.(MeshRouter); ok {
+		capabilities = append(capabilities, CapabilityNodes)
+	}
+	if _, ok := r.(Blocker); ok {
+		capabilities = append(capabilities, CapabilityBlock)
+	}
+	if _, ok := r.(ActionRunner); ok {
+		capabilities = append(capabilities, CapabilityActions)
+	}
+	return capabilities
+}
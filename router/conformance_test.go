@@ -0,0 +1,19 @@
+package router_test
+
+import (
+	"testing"
+
+	"github.com/disrvptor/wifi_client_watch/router/routertest"
+)
+
+func TestAsusConformance(t *testing.T) {
+	routertest.Run(t, "asuswrt", func() routertest.FakeServer { return routertest.NewFakeAsus() })
+}
+
+func TestOPNsenseConformance(t *testing.T) {
+	routertest.Run(t, "opnsense", func() routertest.FakeServer { return routertest.NewFakeOPNsense() })
+}
+
+func TestPfSenseConformance(t *testing.T) {
+	routertest.Run(t, "pfsense", func() routertest.FakeServer { return routertest.NewFakePfSense() })
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// dhcpLease is a DHCP lease as reported by a firewall API
+type dhcpLease struct {
+	ip       string
+	mac      string
+	hostname string
+	vendor   string
+	clientID string
+	// fingerprint is the DHCP parameter request list, when the server
+	// records it
+	fingerprint string
+}
+
+// arpEntry is an ARP table entry as reported by a firewall API
+type arpEntry struct {
+	ip       string
+	mac      string
+	hostname string
+	vendor   string
+	active   bool
+}
+
+// normalizeMAC returns the MAC in the upper case, colon separated form used
+// by the asuswrt driver so clients compare equal across drivers
+func normalizeMAC(mac string) string {
+	return strings.ToUpper(strings.Replace(strings.TrimSpace(mac), "-", ":", -1))
+}
+
+// leaseMAC is the normalized MAC, or "" for placeholders like the
+// "(incomplete)" of unresolved ARP entries
+func leaseMAC(mac string) string {
+	mac = normalizeMAC(mac)
+	if _, err := net.ParseMAC(mac); nil != err {
+		return ""
+	}
+	return mac
+}
+
+// mergeLeases combines DHCP leases with the ARP table. Every lease and every
+// ARP entry becomes a client, and a client is online when it has an active
+// ARP entry.
+func mergeLeases(leases []dhcpLease, arp []arpEntry) []Client {
+	clients := make([]Client, 0, len(leases))
+	index := make(map[string]int)
+
+	for _, l := range leases {
+		mac := leaseMAC(l.mac)
+		if 0 == len(mac) {
+			continue
+		}
+		if _, prs := index[mac]; prs {
+			continue
+		}
+		index[mac] = len(clients)
+		clients = append(clients, Client{
+			Name:            l.hostname,
+			MAC:             mac,
+			IP:              l.ip,
+			Vendor:          l.vendor,
+			ClientID:        l.clientID,
+			DHCPFingerprint: l.fingerprint,
+		})
+	}
+
+	for _, a := range arp {
+		mac := leaseMAC(a.mac)
+		if 0 == len(mac) {
+			continue
+		}
+		i, prs := index[mac]
+		if !prs {
+			index[mac] = len(clients)
+			clients = append(clients, Client{
+				Name:   a.hostname,
+				MAC:    mac,
+				IP:     a.ip,
+				Vendor: a.vendor,
+				Online: a.active,
+			})
+			continue
+		}
+		c := &clients[i]
+		if a.active {
+			c.Online = true
+			c.IP = a.ip
+		}
+		if 0 == len(c.Name) {
+			c.Name = a.hostname
+		}
+		if 0 == len(c.Vendor) {
+			c.Vendor = a.vendor
+		}
+	}
+
+	return clients
+}
+
+// getJSON performs the request and decodes a JSON response body into v
+func getJSON(client *httpClient, req *http.Request, v interface{}) error {
+	req.Header.Add("Accept", "application/json")
+	resp, err := client.Do(req)
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return ErrAuthFailed
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Router responded with code %d", resp.StatusCode)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bodyBytes, v); nil != err {
+		return fmt.Errorf("%w: %s: %v", ErrSchema, req.URL.Path, err)
+	}
+	return nil
+}
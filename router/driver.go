@@ -0,0 +1,91 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// ConfigField describes one of the settings a driver is configured with
+type ConfigField struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	Secret      bool   `json:"secret"`
+	Default     string `json:"default,omitempty"`
+}
+
+// Config is the settings a router is created with, keyed by ConfigField name
+type Config map[string]string
+
+// Get the named setting, or "" if it isn't set
+func (c Config) Get(name string) string {
+	return c[name]
+}
+
+// Bool returns the named setting as a bool, or false if it isn't one
+func (c Config) Bool(name string) bool {
+	v, _ := strconv.ParseBool(c[name])
+	return v
+}
+
+// Driver is a kind of router along with the settings it needs
+type Driver struct {
+	Name        string                       `json:"name"`
+	Description string                       `json:"description"`
+	Config      []ConfigField                `json:"config"`
+	New         func(Config) (Router, error) `json:"-"`
+}
+
+// ErrUnknownDriver is returned when there is no driver with the given name
+var ErrUnknownDriver = errors.New("unknown router driver")
+
+// ErrMissingConfig is returned when a required setting isn't set
+var ErrMissingConfig = errors.New("missing router setting")
+
+var routers map[string]Driver = make(map[string]Driver)
+
+// GetRouter returns a new router for the named driver. Missing settings get
+// the driver's defaults, and every call returns a separate instance so each
+// caller has its own connection state.
+func GetRouter(name string, config Config) (Router, error) {
+	driver, prs := routers[name]
+	if !prs {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDriver, name)
+	}
+
+	resolved := make(Config)
+	for _, field := range driver.Config {
+		value, prs := config[field.Name]
+		if !prs || 0 == len(value) {
+			value = field.Default
+		}
+		if field.Required && 0 == len(value) {
+			return nil, fmt.Errorf("%w: %s needs %s", ErrMissingConfig, name, field.Name)
+		}
+		resolved[field.Name] = value
+	}
+	return driver.New(resolved)
+}
+
+// GetDriver returns the named driver
+func GetDriver(name string) (Driver, bool) {
+	driver, prs := routers[name]
+	return driver, prs
+}
+
+// Drivers returns every driver sorted by name
+func Drivers() []Driver {
+	drivers := make([]Driver, 0, len(routers))
+	for _, driver := range routers {
+		drivers = append(drivers, driver)
+	}
+	sort.Slice(drivers, func(i, j int) bool { return drivers[i].Name < drivers[j].Name })
+	return drivers
+}
+
+// AddRouter adds a router driver to the lookup table
+func AddRouter(driver Driver) {
+	routers[driver.Name] = driver
+}
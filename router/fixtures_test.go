@@ -0,0 +1,53 @@
+package router
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readFixture reads the file from testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if nil != err {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// fixtureServer answers each path with the named file from testdata. The
+// caller closes it.
+func fixtureServer(t *testing.T, files map[string]string) *httptest.Server {
+	t.Helper()
+	bodies := make(map[string][]byte)
+	for path, name := range files {
+		bodies[path] = readFixture(t, name)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, prs := bodies[r.URL.Path]
+		if !prs {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	return server
+}
+
+func unauthorizedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func expectClients(t *testing.T, got []Client, want []Client) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got clients\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,27 @@
+package router
+
+import (
+	"errors"
+
+	"github.com/disrvptor/wifi_client_watch/oui"
+)
+
+// IsRandomMAC reports whether the MAC is locally administered, which is how
+// phones and laptops mark the private MACs they make up per network
+func IsRandomMAC(mac string) bool {
+	return oui.IsRandom(mac)
+}
+
+// LookupVendors fills in or corrects each client's Vendor from the OUI
+// registry. Random MACs have their vendor cleared, since whatever the router
+// reports for them is a guess.
+func LookupVendors(clients []Client) {
+	for i := range clients {
+		vendor, err := oui.Lookup(clients[i].MAC)
+		if errors.Is(err, oui.ErrRandom) {
+			clients[i].Vendor = ""
+		} else if nil == err {
+			clients[i].Vendor = vendor
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package router
+
+import "testing"
+
+func TestLookupVendors(t *testing.T) {
+	clients := []Client{
+		{MAC: "B8:27:EB:01:02:03", Vendor: "Raspberry"},
+		{MAC: "01:00:5E:00:00:01", Vendor: "Router's guess"},
+		{MAC: "01:00:5E:00:00:02"},
+		{MAC: "BA:27:EB:01:02:03", Vendor: "Raspberry"},
+	}
+	LookupVendors(clients)
+
+	want := []string{
+		// Registered prefixes replace the router's vendor
+		"Raspberry Pi Foundation",
+		// Ones the registry doesn't have keep it
+		"Router's guess",
+		"",
+		// Random MACs have none
+		"",
+	}
+	for i, c := range clients {
+		if c.Vendor != want[i] {
+			t.Errorf("%s has vendor %q, want %q", c.MAC, c.Vendor, want[i])
+		}
+	}
+}
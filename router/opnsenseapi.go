@@ -0,0 +1,116 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// OPNsenseRouter is an OPNsense firewall that owns DHCP for the network
+type OPNsenseRouter struct {
+	client *httpClient
+	url    string
+	key    string
+	secret string
+}
+
+type opnsenseLeases struct {
+	Rows []struct {
+		Address  string `json:"address"`
+		MAC      string `json:"mac"`
+		Hostname string `json:"hostname"`
+		Man      string `json:"man"`
+		State    string `json:"state"`
+		UID      string `json:"uid"`
+		// Set by dhcpd when it's configured to record option 55, see the
+		// README
+		ParameterRequestList string `json:"parameter-request-list"`
+	} `json:"rows"`
+}
+
+type opnsenseArpEntry struct {
+	IP           string `json:"ip"`
+	MAC          string `json:"mac"`
+	Hostname     string `json:"hostname"`
+	Manufacturer string `json:"manufacturer"`
+	Expired      bool   `json:"expired"`
+}
+
+func init() {
+	log.Println("Registering 'opnsense' router driver")
+	AddRouter(Driver{
+		Name:        "opnsense",
+		Description: "OPNsense firewalls, using the DHCP leases and ARP table",
+		Config: append([]ConfigField{
+			{Name: "url", Description: "Firewall URL", Required: true},
+			{Name: "api_key", Description: "API key", Required: true},
+			{Name: "api_secret", Description: "API secret", Required: true, Secret: true},
+		}, tlsConfigFields...),
+		New: NewOPNsenseRouter,
+	})
+}
+
+// NewOPNsenseRouter creates an OPNsense router from its url, api_key and
+// api_secret settings
+func NewOPNsenseRouter(config Config) (Router, error) {
+	client, err := newHTTPClient(config)
+	if nil != err {
+		return nil, err
+	}
+	return &OPNsenseRouter{
+		client: client,
+		url:    strings.TrimSuffix(config.Get("url"), "/"),
+		key:    config.Get("api_key"),
+		secret: config.Get("api_secret"),
+	}, nil
+}
+
+// Connect to a router. OPNsense authenticates every request with the API key
+// and secret, so there is no session to establish.
+func (rtr *OPNsenseRouter) Connect(ctx context.Context) error {
+	return nil
+}
+
+// Clients known to the router from its DHCP leases and ARP table
+func (rtr *OPNsenseRouter) Clients(ctx context.Context) ([]Client, error) {
+	var leaseResult opnsenseLeases
+	if err := rtr.get(ctx, "/api/dhcpv4/leases/searchLease", &leaseResult); nil != err {
+		return nil, err
+	}
+	leases := make([]dhcpLease, 0, len(leaseResult.Rows))
+	for _, l := range leaseResult.Rows {
+		if 0 != len(l.State) && "active" != l.State {
+			continue
+		}
+		leases = append(leases, dhcpLease{ip: l.Address, mac: l.MAC, hostname: l.Hostname, vendor: l.Man, clientID: l.UID,
+			fingerprint: l.ParameterRequestList})
+	}
+
+	var arpResult []opnsenseArpEntry
+	if err := rtr.get(ctx, "/api/diagnostics/interface/getArp", &arpResult); nil != err {
+		return nil, err
+	}
+	arp := make([]arpEntry, len(arpResult))
+	for i, a := range arpResult {
+		arp[i] = arpEntry{ip: a.IP, mac: a.MAC, hostname: a.Hostname, vendor: a.Manufacturer, active: !a.Expired}
+	}
+
+	return mergeLeases(leases, arp), nil
+}
+
+func (rtr *OPNsenseRouter) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s", rtr.url, path), nil)
+	if nil != err {
+		return err
+	}
+	req.SetBasicAuth(rtr.key, rtr.secret)
+	return getJSON(rtr.client, req, v)
+}
+
+// PeerFingerprint is the fingerprint of the certificate presented on the
+// last HTTPS connection
+func (rtr *OPNsenseRouter) PeerFingerprint() string {
+	return rtr.client.PeerFingerprint()
+}
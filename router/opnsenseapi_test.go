@@ -0,0 +1,49 @@
+package router
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOPNsenseClients(t *testing.T) {
+	server := fixtureServer(t, map[string]string{
+		"/api/dhcpv4/leases/searchLease":    "opnsense/searchLease.json",
+		"/api/diagnostics/interface/getArp": "opnsense/getArp.json",
+	})
+	defer server.Close()
+	rtr, err := NewOPNsenseRouter(Config{"url": server.URL + "/", "api_key": "key", "api_secret": "secret"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	clients, err := rtr.Clients(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	expectClients(t, clients, []Client{
+		// An active ARP entry makes the lease online, at the ARP entry's IP
+		{Name: "laptop", MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.1.20", Vendor: "Apple, Inc.", Online: true,
+			ClientID: `\001\252\273\314\335\356\001`, DHCPFingerprint: "1,121,3,6,15,119,252,95,44,46"},
+		// Leases without an ARP entry are offline, and dashes become colons
+		{Name: "printer", MAC: "AA:BB:CC:DD:EE:02", IP: "192.168.1.11"},
+		// The expired lease for EE:03 is dropped, and an expired ARP entry
+		// leaves the lease offline while filling in what it lacks
+		{Name: "esp-1234.lan", MAC: "AA:BB:CC:DD:EE:04", IP: "192.168.1.13", Vendor: "Espressif Inc."},
+		// Static mappings have no state
+		{Name: "nas", MAC: "AA:BB:CC:DD:EE:05", IP: "192.168.1.5", Vendor: "Synology Incorporated", Online: true},
+		// ARP entries without a lease are clients too
+		{MAC: "AA:BB:CC:DD:EE:06", IP: "192.168.1.99", Online: true},
+	})
+}
+
+func TestOPNsenseAuthFailed(t *testing.T) {
+	server := httptest.NewServer(unauthorizedHandler())
+	defer server.Close()
+	rtr, err := NewOPNsenseRouter(Config{"url": server.URL, "api_key": "key", "api_secret": "wrong"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = rtr.Clients(context.Background()); ErrAuthFailed != err {
+		t.Errorf("got %v, want %v", err, ErrAuthFailed)
+	}
+}
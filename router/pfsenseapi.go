@@ -0,0 +1,119 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// PfSenseRouter is a pfSense firewall running the pfSense REST API package
+type PfSenseRouter struct {
+	client   *httpClient
+	url      string
+	clientID string
+	token    string
+}
+
+type pfsenseLeases struct {
+	Data []struct {
+		IP       string `json:"ip"`
+		MAC      string `json:"mac"`
+		Hostname string `json:"hostname"`
+		State    string `json:"state"`
+	} `json:"data"`
+}
+
+type pfsenseArp struct {
+	Data []struct {
+		IP         string `json:"ip"`
+		MAC        string `json:"mac"`
+		DNSResolve string `json:"dnsresolve"`
+		Status     string `json:"status"`
+	} `json:"data"`
+}
+
+func init() {
+	log.Println("Registering 'pfsense' router driver")
+	AddRouter(Driver{
+		Name:        "pfsense",
+		Description: "pfSense firewalls running the REST API package, using the DHCP leases and ARP table",
+		Config: append([]ConfigField{
+			{Name: "url", Description: "Firewall URL", Required: true},
+			{Name: "client_id", Description: "API client ID", Required: true},
+			{Name: "client_token", Description: "API client token", Required: true, Secret: true},
+		}, tlsConfigFields...),
+		New: NewPfSenseRouter,
+	})
+}
+
+// NewPfSenseRouter creates a pfSense router from its url, client_id and
+// client_token settings
+func NewPfSenseRouter(config Config) (Router, error) {
+	client, err := newHTTPClient(config)
+	if nil != err {
+		return nil, err
+	}
+	return &PfSenseRouter{
+		client:   client,
+		url:      strings.TrimSuffix(config.Get("url"), "/"),
+		clientID: config.Get("client_id"),
+		token:    config.Get("client_token"),
+	}, nil
+}
+
+// Connect to a router. The pfSense API authenticates every request with the
+// client ID and token, so there is no session to establish.
+func (rtr *PfSenseRouter) Connect(ctx context.Context) error {
+	return nil
+}
+
+// Clients known to the router from its DHCP leases and ARP table
+func (rtr *PfSenseRouter) Clients(ctx context.Context) ([]Client, error) {
+	var leaseResult pfsenseLeases
+	if err := rtr.get(ctx, "/api/v1/services/dhcpd/lease", &leaseResult); nil != err {
+		return nil, err
+	}
+	leases := make([]dhcpLease, 0, len(leaseResult.Data))
+	for _, l := range leaseResult.Data {
+		// Static mappings never expire
+		if 0 != len(l.State) && "active" != l.State && "static" != l.State {
+			continue
+		}
+		leases = append(leases, dhcpLease{ip: l.IP, mac: l.MAC, hostname: l.Hostname})
+	}
+
+	var arpResult pfsenseArp
+	if err := rtr.get(ctx, "/api/v1/diagnostics/arp", &arpResult); nil != err {
+		return nil, err
+	}
+	arp := make([]arpEntry, len(arpResult.Data))
+	for i, a := range arpResult.Data {
+		// Unresolved names are reported as "?"
+		hostname := a.DNSResolve
+		if "?" == hostname {
+			hostname = ""
+		}
+		status := strings.ToLower(a.Status)
+		active := !strings.Contains(status, "expired") && !strings.Contains(status, "incomplete")
+		arp[i] = arpEntry{ip: a.IP, mac: a.MAC, hostname: hostname, active: active}
+	}
+
+	return mergeLeases(leases, arp), nil
+}
+
+func (rtr *PfSenseRouter) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s", rtr.url, path), nil)
+	if nil != err {
+		return err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("%s %s", rtr.clientID, rtr.token))
+	return getJSON(rtr.client, req, v)
+}
+
+// PeerFingerprint is the fingerprint of the certificate presented on the
+// last HTTPS connection
+func (rtr *PfSenseRouter) PeerFingerprint() string {
+	return rtr.client.PeerFingerprint()
+}
@@ -0,0 +1,47 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPfSenseClients(t *testing.T) {
+	server := fixtureServer(t, map[string]string{
+		"/api/v1/services/dhcpd/lease": "pfsense/lease.json",
+		"/api/v1/diagnostics/arp":      "pfsense/arp.json",
+	})
+	defer server.Close()
+	rtr, err := NewPfSenseRouter(Config{"url": server.URL, "client_id": "client", "client_token": "token"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	clients, err := rtr.Clients(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+	expectClients(t, clients, []Client{
+		{Name: "laptop", MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.1.20", Online: true},
+		// An expired ARP entry leaves the lease offline
+		{Name: "printer", MAC: "AA:BB:CC:DD:EE:02", IP: "192.168.1.11"},
+		// The expired lease for EE:03 is dropped
+		{Name: "nas", MAC: "AA:BB:CC:DD:EE:05", IP: "192.168.1.5", Online: true},
+		// Unresolved names are left empty, and incomplete entries without a
+		// MAC are skipped
+		{MAC: "AA:BB:CC:DD:EE:06", IP: "192.168.1.99", Online: true},
+	})
+}
+
+func TestPfSenseSchemaError(t *testing.T) {
+	server := fixtureServer(t, map[string]string{
+		"/api/v1/services/dhcpd/lease": "opnsense/getArp.json",
+	})
+	defer server.Close()
+	rtr, err := NewPfSenseRouter(Config{"url": server.URL, "client_id": "client", "client_token": "token"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = rtr.Clients(context.Background()); !errors.Is(err, ErrSchema) {
+		t.Errorf("got %v, want %v", err, ErrSchema)
+	}
+}
@@ -1,29 +1,132 @@
 package router
 
-// Client is a Router client
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Medium is how a client is attached to the network
+type Medium string
+
+// Mediums reported by router drivers
+const (
+	MediumUnknown  Medium = ""
+	MediumWired    Medium = "wired"
+	MediumWireless Medium = "wireless"
+)
+
+// Band is the WiFi band a wireless client is associated on
+type Band string
+
+// Bands reported by router drivers
+const (
+	BandUnknown Band = ""
+	Band2GHz    Band = "2.4GHz"
+	Band5GHz    Band = "5GHz"
+	Band5GHz2   Band = "5GHz-2"
+	Band6GHz    Band = "6GHz"
+)
+
+// DeviceType is what kind of device a client is, as guessed by fingerprinting
+type DeviceType string
+
+// Device types
+const (
+	DeviceTypeUnknown  DeviceType = ""
+	DeviceTypePhone    DeviceType = "phone"
+	DeviceTypeTablet   DeviceType = "tablet"
+	DeviceTypeLaptop   DeviceType = "laptop"
+	DeviceTypeComputer DeviceType = "computer"
+	DeviceTypeTV       DeviceType = "tv"
+	DeviceTypeIoT      DeviceType = "iot"
+	DeviceTypePrinter  DeviceType = "printer"
+	DeviceTypeConsole  DeviceType = "console"
+)
+
+// OSFamily is the operating system family a client runs, as guessed by
+// fingerprinting
+type OSFamily string
+
+// OS families
+const (
+	OSUnknown OSFamily = ""
+	OSWindows OSFamily = "windows"
+	OSApple   OSFamily = "apple"
+	OSAndroid OSFamily = "android"
+	OSLinux   OSFamily = "linux"
+)
+
+// Client is a Router client. Fields after Online are optional and only set
+// by drivers that report them, except DeviceType and OS which are filled in
+// by fingerprinting, and RouterOnline and Reachable which are filled in when
+// clients are verified.
 type Client struct {
-	Name   string `json:"name"`
-	MAC    string `json:"mac"`
-	IP     string `json:"ip"`
-	Vendor string `json:"vendor"`
-	Online bool   `json:"online"`
+	Name           string     `json:"name"`
+	MAC            string     `json:"mac"`
+	IP             string     `json:"ip"`
+	Vendor         string     `json:"vendor"`
+	Online         bool       `json:"online"`
+	Medium         Medium     `json:"medium,omitempty"`
+	Band           Band       `json:"band,omitempty"`
+	SSID           string     `json:"ssid,omitempty"`
+	Guest          bool       `json:"guest,omitempty"`
+	RSSI           *int       `json:"rssi,omitempty"`
+	TxRate         *float64   `json:"tx_rate,omitempty"` // Mbps
+	RxRate         *float64   `json:"rx_rate,omitempty"` // Mbps
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	Node           string     `json:"node,omitempty"`      // MAC of the AP or mesh node
+	ClientID       string     `json:"client_id,omitempty"` // DHCP client identifier
+	// DHCPFingerprint is the DHCP parameter request list (option 55), e.g.
+	// "1,3,6,15,119,252", from drivers that read the DHCP server's leases
+	DHCPFingerprint string     `json:"dhcp_fingerprint,omitempty"`
+	DeviceType      DeviceType `json:"device_type,omitempty"`
+	OS              OSFamily   `json:"os,omitempty"`
+	// RouterOnline is whether the router reported the client online, while
+	// Online may have been overruled by probing it
+	RouterOnline bool  `json:"router_online"`
+	Reachable    *bool `json:"reachable,omitempty"` // nil if it wasn't probed
 }
 
-var routers map[string]Router = make(map[string]Router)
+// Node is the main router or a mesh node that clients connect through
+type Node struct {
+	Name     string `json:"name"`
+	Model    string `json:"model"`
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	Firmware string `json:"firmware"`
+	Online   bool   `json:"online"`
+	Primary  bool   `json:"primary"`
+	Backhaul Medium `json:"backhaul,omitempty"`
+	Band     Band   `json:"backhaul_band,omitempty"`
+	Parent   string `json:"parent,omitempty"` // MAC of the upstream node
+	RSSI     *int   `json:"backhaul_rssi,omitempty"`
+}
+
+var (
+	// ErrAuthFailed is returned when the router rejects the credentials
+	ErrAuthFailed = errors.New("router rejected the credentials")
+	// ErrLockedOut is returned when the router refuses logins after too many
+	// failed attempts
+	ErrLockedOut = errors.New("router is refusing logins")
+	// ErrSchema is returned when a router response doesn't have the expected
+	// shape
+	ErrSchema = errors.New("unexpected router response")
+)
 
-// Router is a router API
+// Router is a router API. Every call is bounded by the context, and
+// cancelling it aborts any request to the router.
 type Router interface {
-	Connect(url string, username string, password string) error
-	Clients() ([]Client, error)
+	Connect(ctx context.Context) error
+	Clients(ctx context.Context) ([]Client, error)
 }
 
-// GetRouter returns a router interface for the given name
-func GetRouter(name string) (Router, bool) {
-	rtr, prs := routers[name]
-	return rtr, prs
+// MeshRouter is a Router made up of several nodes
+type MeshRouter interface {
+	Router
+	Nodes(ctx context.Context) ([]Node, error)
 }
 
-// AddRouter adds a router type instance to the lookup table
-func AddRouter(name string, rtr Router) {
-	routers[name] = rtr
-}
+// requestTimeout bounds a single request when the caller's context has no
+// deadline
+const requestTimeout = 60 * time.Second
@@ -0,0 +1,190 @@
+package routertest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// SampleClients are the clients the conformance suite expects drivers to
+// report back
+var SampleClients = []router.Client{
+	{Name: "phone", MAC: "AA:BB:CC:00:00:01", IP: "192.168.1.10", Online: true},
+	{Name: "laptop", MAC: "AA:BB:CC:00:00:02", IP: "192.168.1.11", Online: true},
+	{Name: "printer", MAC: "AA:BB:CC:00:00:03", IP: "192.168.1.12", Online: false},
+}
+
+// Run the conformance suite for the named driver. newServer is called for
+// every check and must return a fake the driver can be pointed at.
+func Run(t *testing.T, driver string, newServer func() FakeServer) {
+	t.Run("Connect", func(t *testing.T) {
+		ctx := context.Background()
+		f := newServer()
+		defer f.Close()
+		f.SetClients(SampleClients...)
+
+		rtr := newRouter(t, driver, f.Config(true))
+		if err := rtr.Connect(ctx); nil != err {
+			t.Fatalf("Connect() = %v", err)
+		}
+		clients, err := rtr.Clients(ctx)
+		if nil != err {
+			t.Fatalf("Clients() = %v", err)
+		}
+		expectClients(t, clients, SampleClients)
+	})
+
+	t.Run("BadCredentials", func(t *testing.T) {
+		ctx := context.Background()
+		f := newServer()
+		defer f.Close()
+		f.SetClients(SampleClients...)
+
+		rtr := newRouter(t, driver, f.Config(false))
+		err := rtr.Connect(ctx)
+		if nil == err {
+			_, err = rtr.Clients(ctx)
+		}
+		if !errors.Is(err, router.ErrAuthFailed) {
+			t.Fatalf("expected ErrAuthFailed, got %v", err)
+		}
+	})
+
+	t.Run("TokenExpiry", func(t *testing.T) {
+		ctx := context.Background()
+		f := newServer()
+		defer f.Close()
+		f.SetClients(SampleClients...)
+
+		rtr := newRouter(t, driver, f.Config(true))
+		if err := rtr.Connect(ctx); nil != err {
+			t.Fatalf("Connect() = %v", err)
+		}
+		if _, err := rtr.Clients(ctx); nil != err {
+			t.Fatalf("Clients() = %v", err)
+		}
+		f.ExpireTokens()
+		clients, err := rtr.Clients(ctx)
+		if nil != err {
+			t.Fatalf("Clients() after the token expired = %v", err)
+		}
+		expectClients(t, clients, SampleClients)
+	})
+
+	t.Run("EmptyLists", func(t *testing.T) {
+		ctx := context.Background()
+		f := newServer()
+		defer f.Close()
+
+		rtr := newRouter(t, driver, f.Config(true))
+		if err := rtr.Connect(ctx); nil != err {
+			t.Fatalf("Connect() = %v", err)
+		}
+		clients, err := rtr.Clients(ctx)
+		if nil != err {
+			t.Fatalf("Clients() = %v", err)
+		}
+		if 0 != len(clients) {
+			t.Fatalf("expected no clients, got %v", clients)
+		}
+	})
+
+	t.Run("MalformedPayload", func(t *testing.T) {
+		ctx := context.Background()
+		f := newServer()
+		defer f.Close()
+		f.SetClients(SampleClients...)
+		f.SetMalformed(true)
+
+		rtr := newRouter(t, driver, f.Config(true))
+		err := rtr.Connect(ctx)
+		if nil == err {
+			_, err = rtr.Clients(ctx)
+		}
+		if !errors.Is(err, router.ErrSchema) {
+			t.Fatalf("expected ErrSchema, got %v", err)
+		}
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		ctx := context.Background()
+		f := newServer()
+		defer f.Close()
+		f.SetClients(SampleClients...)
+
+		rtr := newRouter(t, driver, f.Config(true))
+		blocker, ok := rtr.(router.Blocker)
+		server, blocks := f.(BlockingServer)
+		if !ok || !blocks {
+			t.Skip("the driver can't block clients")
+		}
+		mac := SampleClients[0].MAC
+		for i := 0; i < 2; i++ {
+			if err := blocker.Block(ctx, mac); nil != err {
+				t.Fatalf("Block() = %v", err)
+			}
+		}
+		if blocked := server.Blocked(); 1 != len(blocked) || mac != blocked[0] {
+			t.Fatalf("expected %s to be blocked, got %v", mac, blocked)
+		}
+		if err := blocker.Unblock(ctx, mac); nil != err {
+			t.Fatalf("Unblock() = %v", err)
+		}
+		if blocked := server.Blocked(); 0 != len(blocked) {
+			t.Fatalf("expected nothing to be blocked, got %v", blocked)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		f := newServer()
+		defer f.Close()
+		f.SetClients(SampleClients...)
+		f.SetDelay(time.Minute)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		rtr := newRouter(t, driver, f.Config(true))
+		err := rtr.Connect(ctx)
+		if nil == err {
+			_, err = rtr.Clients(ctx)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("the driver took %s to give up", elapsed)
+		}
+	})
+}
+
+func newRouter(t *testing.T, driver string, config router.Config) router.Router {
+	t.Helper()
+	rtr, err := router.GetRouter(driver, config)
+	if nil != err {
+		t.Fatalf("GetRouter(%s) = %v", driver, err)
+	}
+	return rtr
+}
+
+// expectClients checks that the same MACs were reported with the same
+// online state
+func expectClients(t *testing.T, got []router.Client, want []router.Client) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d clients, got %d: %v", len(want), len(got), got)
+	}
+	got = append([]router.Client{}, got...)
+	want = append([]router.Client{}, want...)
+	sort.Slice(got, func(i, j int) bool { return got[i].MAC < got[j].MAC })
+	sort.Slice(want, func(i, j int) bool { return want[i].MAC < want[j].MAC })
+	for i := range want {
+		if got[i].MAC != want[i].MAC || got[i].Online != want[i].Online || got[i].IP != want[i].IP {
+			t.Errorf("expected %+v, got %+v", want[i], got[i])
+		}
+	}
+}
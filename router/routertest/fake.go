@@ -0,0 +1,190 @@
+// Package routertest provides fake router servers and a conformance suite
+// for router.Router implementations
+package routertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// FakeServer is a fake router that a driver can be pointed at
+type FakeServer interface {
+	// Config returns the settings for the driver under test, with either
+	// the credentials the fake accepts or ones it rejects
+	Config(validCredentials bool) router.Config
+	SetClients(clients ...router.Client)
+	// ExpireTokens makes the fake forget every session it handed out
+	ExpireTokens()
+	// SetMalformed makes the client list responses unparseable
+	SetMalformed(malformed bool)
+	// SetDelay holds every response for the duration
+	SetDelay(delay time.Duration)
+	Close()
+}
+
+// BlockingServer is a FakeServer for drivers that implement router.Blocker
+type BlockingServer interface {
+	FakeServer
+	// Blocked returns the MACs the router is blocking
+	Blocked() []string
+}
+
+// Fake is the scriptable state shared by the fake router servers. The fake
+// counts client list requests as polls so client joins and leaves can be
+// scripted against the poll they should appear on.
+type Fake struct {
+	mu        sync.Mutex
+	server    *httptest.Server
+	clients   []router.Client
+	script    map[int][]func(*Fake)
+	polls     int
+	delay     time.Duration
+	malformed bool
+	closed    chan struct{}
+}
+
+func newFake(handler func(*Fake) http.Handler) *Fake {
+	f := &Fake{
+		clients: make([]router.Client, 0),
+		script:  make(map[int][]func(*Fake)),
+		closed:  make(chan struct{}),
+	}
+	f.server = httptest.NewServer(handler(f))
+	return f
+}
+
+// URL of the fake router
+func (f *Fake) URL() string {
+	return f.server.URL
+}
+
+// Close the fake router. Delayed responses are released first.
+func (f *Fake) Close() {
+	close(f.closed)
+	f.server.Close()
+}
+
+// SetClients replaces the clients the router reports
+func (f *Fake) SetClients(clients ...router.Client) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clients = append(make([]router.Client, 0, len(clients)), clients...)
+}
+
+// Clients the router currently reports
+func (f *Fake) Clients() []router.Client {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append(make([]router.Client, 0, len(f.clients)), f.clients...)
+}
+
+// Join adds the client, or replaces the client with the same MAC
+func (f *Fake) Join(client router.Client) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.join(client)
+}
+
+func (f *Fake) join(client router.Client) {
+	for i, c := range f.clients {
+		if c.MAC == client.MAC {
+			f.clients[i] = client
+			return
+		}
+	}
+	f.clients = append(f.clients, client)
+}
+
+// Leave marks the client offline, as routers do for clients they've seen
+// recently
+func (f *Fake) Leave(mac string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, c := range f.clients {
+		if c.MAC == mac {
+			f.clients[i].Online = false
+		}
+	}
+}
+
+// Drop removes the client entirely
+func (f *Fake) Drop(mac string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clients := f.clients[:0]
+	for _, c := range f.clients {
+		if c.MAC != mac {
+			clients = append(clients, c)
+		}
+	}
+	f.clients = clients
+}
+
+// At runs the change just before the given poll (counting from 1) is
+// answered
+func (f *Fake) At(poll int, change func(f *Fake)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script[poll] = append(f.script[poll], change)
+}
+
+// Polls is the number of client list requests answered so far
+func (f *Fake) Polls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.polls
+}
+
+// SetMalformed makes the client list responses unparseable
+func (f *Fake) SetMalformed(malformed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.malformed = malformed
+}
+
+// SetDelay holds every response for the duration
+func (f *Fake) SetDelay(delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delay = delay
+}
+
+// wait holds the response for the configured delay
+func (f *Fake) wait(r *http.Request) {
+	f.mu.Lock()
+	delay := f.delay
+	f.mu.Unlock()
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+	case <-f.closed:
+	}
+}
+
+// poll counts a client list request, applies any scripted changes and
+// returns the clients to report sorted by MAC
+func (f *Fake) poll() ([]router.Client, bool) {
+	f.mu.Lock()
+	f.polls++
+	changes := f.script[f.polls]
+	delete(f.script, f.polls)
+	f.mu.Unlock()
+
+	for _, change := range changes {
+		change(f)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clients := append(make([]router.Client, 0, len(f.clients)), f.clients...)
+	sort.Slice(clients, func(i, j int) bool { return clients[i].MAC < clients[j].MAC })
+	return clients, f.malformed
+}
@@ -0,0 +1,256 @@
+package routertest
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// FakeAsus is a fake asuswrt router serving login.cgi, the appGet.cgi
+// client list and nvram hooks, the applyapp.cgi parental control MAC filter
+// and wol_action.cgi
+type FakeAsus struct {
+	*Fake
+	Username string
+	Password string
+
+	tokenMu sync.Mutex
+	tokens  map[string]bool
+	logins  int
+	nodes   []router.Node
+	nvram   map[string]string
+	woken   []string
+}
+
+// NewFakeAsus starts a fake asuswrt router that accepts admin/admin
+func NewFakeAsus() *FakeAsus {
+	a := &FakeAsus{
+		Username: "admin",
+		Password: "admin",
+		tokens:   make(map[string]bool),
+		nvram:    make(map[string]string),
+	}
+	a.Fake = newFake(func(f *Fake) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/login.cgi", a.login)
+		mux.HandleFunc("/appGet.cgi", a.appGet)
+		mux.HandleFunc("/applyapp.cgi", a.applyApp)
+		mux.HandleFunc("/wol_action.cgi", a.wake)
+		return mux
+	})
+	return a
+}
+
+// Config returns asuswrt driver settings for the fake
+func (a *FakeAsus) Config(validCredentials bool) router.Config {
+	password := a.Password
+	if !validCredentials {
+		password = "not-" + password
+	}
+	return router.Config{"url": a.URL(), "username": a.Username, "password": password}
+}
+
+// ExpireTokens makes the fake forget every token it handed out
+func (a *FakeAsus) ExpireTokens() {
+	a.tokenMu.Lock()
+	defer a.tokenMu.Unlock()
+	a.tokens = make(map[string]bool)
+}
+
+// Logins is the number of successful logins
+func (a *FakeAsus) Logins() int {
+	a.tokenMu.Lock()
+	defer a.tokenMu.Unlock()
+	return a.logins
+}
+
+// SetNodes sets the AiMesh nodes, the first being the router itself
+func (a *FakeAsus) SetNodes(nodes ...router.Node) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nodes = append(make([]router.Node, 0, len(nodes)), nodes...)
+}
+
+func (a *FakeAsus) login(w http.ResponseWriter, r *http.Request) {
+	a.wait(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	raw, _ := b64.StdEncoding.DecodeString(r.FormValue("login_authorization"))
+	if string(raw) != fmt.Sprintf("%s:%s", a.Username, a.Password) {
+		fmt.Fprint(w, `{"error_status":"3"}`)
+		return
+	}
+
+	a.tokenMu.Lock()
+	a.logins++
+	token := fmt.Sprintf("token%d", a.logins)
+	a.tokens[token] = true
+	a.tokenMu.Unlock()
+	fmt.Fprintf(w, `{"asus_token":"%s"}`, token)
+}
+
+func (a *FakeAsus) appGet(w http.ResponseWriter, r *http.Request) {
+	a.wait(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	cookie, err := r.Cookie("asus_token")
+	a.tokenMu.Lock()
+	valid := nil == err && a.tokens[cookie.Value]
+	a.tokenMu.Unlock()
+	if !valid {
+		fmt.Fprint(w, `{"error_status":"2"}`)
+		return
+	}
+
+	result := make(map[string]interface{})
+	// The hooks are separated by unescaped semicolons, which url.ParseQuery
+	// rejects, so read the raw query
+	hook := r.URL.RawQuery
+	if strings.Contains(hook, "get_clientlist()") {
+		clients, malformed := a.poll()
+		if malformed {
+			fmt.Fprint(w, `{"get_clientlist":{"maclist":"`)
+			return
+		}
+		result["get_clientlist"] = asusClientList(clients)
+	}
+	if strings.Contains(hook, "get_cfg_clientlist()") {
+		a.mu.Lock()
+		result["get_cfg_clientlist"] = asusNodeList(a.nodes)
+		a.mu.Unlock()
+	}
+	for _, h := range strings.Split(hook, ";") {
+		if strings.HasPrefix(h, "nvram_get(") && strings.HasSuffix(h, ")") {
+			name := strings.TrimSuffix(strings.TrimPrefix(h, "nvram_get("), ")")
+			a.mu.Lock()
+			result[name] = a.nvram[name]
+			a.mu.Unlock()
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (a *FakeAsus) applyApp(w http.ResponseWriter, r *http.Request) {
+	a.wait(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	cookie, err := r.Cookie("asus_token")
+	a.tokenMu.Lock()
+	valid := nil == err && a.tokens[cookie.Value]
+	a.tokenMu.Unlock()
+	if !valid || nil != r.ParseForm() {
+		fmt.Fprint(w, `{"error_status":"2"}`)
+		return
+	}
+
+	a.mu.Lock()
+	for name, values := range r.PostForm {
+		if "action_mode" != name && "rc_service" != name {
+			a.nvram[name] = values[0]
+		}
+	}
+	a.mu.Unlock()
+	fmt.Fprintf(w, `{"modify":"1","run_service":"%s"}`, r.PostForm.Get("rc_service"))
+}
+
+func (a *FakeAsus) wake(w http.ResponseWriter, r *http.Request) {
+	a.wait(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	cookie, err := r.Cookie("asus_token")
+	a.tokenMu.Lock()
+	valid := nil == err && a.tokens[cookie.Value]
+	a.tokenMu.Unlock()
+	if !valid || nil != r.ParseForm() {
+		fmt.Fprint(w, `{"error_status":"2"}`)
+		return
+	}
+
+	a.mu.Lock()
+	a.woken = append(a.woken, r.PostForm.Get("dstmac"))
+	a.mu.Unlock()
+	fmt.Fprint(w, `{}`)
+}
+
+// Woken returns the MACs wol_action.cgi was asked to wake
+func (a *FakeAsus) Woken() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append(make([]string, 0, len(a.woken)), a.woken...)
+}
+
+// Blocked returns the MACs the parental control MAC filter blocks
+func (a *FakeAsus) Blocked() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	blocked := make([]string, 0)
+	if "1" != a.nvram["MULTIFILTER_ALL"] || 0 == len(a.nvram["MULTIFILTER_MAC"]) {
+		return blocked
+	}
+	enabled := strings.Split(a.nvram["MULTIFILTER_ENABLE"], ">")
+	for i, mac := range strings.Split(a.nvram["MULTIFILTER_MAC"], ">") {
+		if i < len(enabled) && "2" == enabled[i] {
+			blocked = append(blocked, mac)
+		}
+	}
+	return blocked
+}
+
+func asusClientList(clients []router.Client) map[string]interface{} {
+	list := make(map[string]interface{})
+	macList := make([]string, 0, len(clients))
+	for _, c := range clients {
+		online := "0"
+		if c.Online {
+			online = "1"
+		}
+		isWL := "0"
+		switch c.Band {
+		case router.Band2GHz:
+			isWL = "1"
+		case router.Band5GHz:
+			isWL = "2"
+		}
+		list[c.MAC] = map[string]string{
+			"name":     c.Name,
+			"mac":      c.MAC,
+			"ip":       c.IP,
+			"vendor":   c.Vendor,
+			"isOnline": online,
+			"isWL":     isWL,
+		}
+		macList = append(macList, c.MAC)
+	}
+	list["maclist"] = macList
+	return list
+}
+
+func asusNodeList(nodes []router.Node) []map[string]string {
+	list := make([]map[string]string, len(nodes))
+	for i, n := range nodes {
+		online := "0"
+		if n.Online {
+			online = "1"
+		}
+		level := "1"
+		if 0 == i {
+			level = "0"
+		}
+		list[i] = map[string]string{
+			"alias":      n.Name,
+			"model_name": n.Model,
+			"mac":        n.MAC,
+			"ip":         n.IP,
+			"fwver":      n.Firmware,
+			"online":     online,
+			"level":      level,
+			"re_path":    "1",
+		}
+	}
+	return list
+}
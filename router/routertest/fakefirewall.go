@@ -0,0 +1,167 @@
+package routertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+// FakeOPNsense is a fake OPNsense firewall serving the DHCP lease and ARP
+// APIs. Online clients have an active ARP entry.
+type FakeOPNsense struct {
+	*Fake
+	Key    string
+	Secret string
+}
+
+// NewFakeOPNsense starts a fake OPNsense firewall
+func NewFakeOPNsense() *FakeOPNsense {
+	o := &FakeOPNsense{Key: "key", Secret: "secret"}
+	o.Fake = newFake(func(f *Fake) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/dhcpv4/leases/searchLease", o.authorized(o.leases))
+		mux.HandleFunc("/api/diagnostics/interface/getArp", o.authorized(o.arp))
+		return mux
+	})
+	return o
+}
+
+// Config returns opnsense driver settings for the fake
+func (o *FakeOPNsense) Config(validCredentials bool) router.Config {
+	secret := o.Secret
+	if !validCredentials {
+		secret = "not-" + secret
+	}
+	return router.Config{"url": o.URL(), "api_key": o.Key, "api_secret": secret}
+}
+
+// ExpireTokens does nothing because OPNsense has no sessions
+func (o *FakeOPNsense) ExpireTokens() {}
+
+func (o *FakeOPNsense) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		o.wait(r)
+		key, secret, ok := r.BasicAuth()
+		if !ok || key != o.Key || secret != o.Secret {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		next(w, r)
+	}
+}
+
+func (o *FakeOPNsense) leases(w http.ResponseWriter, r *http.Request) {
+	clients, malformed := o.poll()
+	if malformed {
+		fmt.Fprint(w, `{"rows":[{"address":`)
+		return
+	}
+	rows := make([]map[string]string, len(clients))
+	for i, c := range clients {
+		rows[i] = map[string]string{
+			"address":  c.IP,
+			"mac":      strings.ToLower(c.MAC),
+			"hostname": c.Name,
+			"man":      c.Vendor,
+			"state":    "active",
+
+			"parameter-request-list": c.DHCPFingerprint,
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"total": len(rows), "rows": rows})
+}
+
+func (o *FakeOPNsense) arp(w http.ResponseWriter, r *http.Request) {
+	entries := make([]map[string]interface{}, 0)
+	for _, c := range o.Clients() {
+		if c.Online {
+			entries = append(entries, map[string]interface{}{
+				"ip":      c.IP,
+				"mac":     strings.ToLower(c.MAC),
+				"expired": false,
+			})
+		}
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// FakePfSense is a fake pfSense firewall serving the REST API package's DHCP
+// lease and ARP endpoints. Online clients have an ARP entry.
+type FakePfSense struct {
+	*Fake
+	ClientID string
+	Token    string
+}
+
+// NewFakePfSense starts a fake pfSense firewall
+func NewFakePfSense() *FakePfSense {
+	p := &FakePfSense{ClientID: "client", Token: "token"}
+	p.Fake = newFake(func(f *Fake) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v1/services/dhcpd/lease", p.authorized(p.leases))
+		mux.HandleFunc("/api/v1/diagnostics/arp", p.authorized(p.arp))
+		return mux
+	})
+	return p
+}
+
+// Config returns pfsense driver settings for the fake
+func (p *FakePfSense) Config(validCredentials bool) router.Config {
+	token := p.Token
+	if !validCredentials {
+		token = "not-" + token
+	}
+	return router.Config{"url": p.URL(), "client_id": p.ClientID, "client_token": token}
+}
+
+// ExpireTokens does nothing because the pfSense API has no sessions
+func (p *FakePfSense) ExpireTokens() {}
+
+func (p *FakePfSense) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.wait(r)
+		if r.Header.Get("Authorization") != fmt.Sprintf("%s %s", p.ClientID, p.Token) {
+			http.Error(w, `{"status":"unauthorized","code":401}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		next(w, r)
+	}
+}
+
+func (p *FakePfSense) leases(w http.ResponseWriter, r *http.Request) {
+	clients, malformed := p.poll()
+	if malformed {
+		fmt.Fprint(w, `{"status":"ok","data":[{"ip":`)
+		return
+	}
+	data := make([]map[string]string, len(clients))
+	for i, c := range clients {
+		data[i] = map[string]string{
+			"ip":       c.IP,
+			"mac":      strings.ToLower(c.MAC),
+			"hostname": c.Name,
+			"state":    "active",
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "code": 200, "data": data})
+}
+
+func (p *FakePfSense) arp(w http.ResponseWriter, r *http.Request) {
+	data := make([]map[string]string, 0)
+	for _, c := range p.Clients() {
+		if c.Online {
+			data = append(data, map[string]string{
+				"ip":         c.IP,
+				"mac":        strings.ToLower(c.MAC),
+				"dnsresolve": "?",
+				"status":     "expires in 1200 seconds",
+			})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "code": 200, "data": data})
+}
@@ -0,0 +1,130 @@
+package router
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// TLS modes for the tls_mode setting
+const (
+	// TLSModeSystem verifies certificates against the system roots
+	TLSModeSystem = "system"
+	// TLSModePin accepts only the certificate with the tls_fingerprint
+	// SHA-256 fingerprint. With no fingerprint the first certificate seen is
+	// trusted and should be saved as the fingerprint.
+	TLSModePin = "pin"
+	// TLSModeCA verifies certificates against the tls_ca_file bundle
+	TLSModeCA = "ca"
+	// TLSModeInsecure accepts any certificate
+	TLSModeInsecure = "insecure"
+)
+
+// ErrCertificateMismatch is returned when a pinned router presents a
+// different certificate
+var ErrCertificateMismatch = errors.New("router certificate doesn't match the pinned fingerprint")
+
+// CertificateReporter is a Router that reports the certificate presented on
+// its last HTTPS connection
+type CertificateReporter interface {
+	// PeerFingerprint is the SHA-256 fingerprint of the certificate, or ""
+	// if there hasn't been an HTTPS connection
+	PeerFingerprint() string
+}
+
+// tlsConfigFields are the settings every HTTP based driver accepts
+var tlsConfigFields = []ConfigField{
+	{Name: "tls_mode", Description: "How HTTPS certificates are checked: system, pin, ca or insecure", Default: TLSModeSystem},
+	{Name: "tls_fingerprint", Description: "SHA-256 fingerprint of the pinned certificate, saved on first use when empty"},
+	{Name: "tls_ca_file", Description: "PEM file of the CAs to trust in ca mode"},
+}
+
+// httpClient is the HTTP client drivers talk to routers with. It remembers
+// the certificate presented on the last HTTPS connection.
+type httpClient struct {
+	*http.Client
+	mu   sync.Mutex
+	seen string
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER certificate as colon
+// separated hex
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// SameFingerprint compares fingerprints ignoring case and separators
+func SameFingerprint(a string, b string) bool {
+	normalize := func(s string) string {
+		return strings.ToUpper(strings.NewReplacer(":", "", " ", "", "-", "").Replace(s))
+	}
+	return normalize(a) == normalize(b)
+}
+
+// newHTTPClient returns a client using the driver's TLS settings
+func newHTTPClient(config Config) (*httpClient, error) {
+	c := &httpClient{}
+	tlsConfig := &tls.Config{}
+	pinned := ""
+
+	switch mode := config.Get("tls_mode"); mode {
+	case "", TLSModeSystem:
+	case TLSModeInsecure:
+		tlsConfig.InsecureSkipVerify = true
+	case TLSModePin:
+		// Verification is replaced by the fingerprint check
+		tlsConfig.InsecureSkipVerify = true
+		pinned = config.Get("tls_fingerprint")
+	case TLSModeCA:
+		pem, err := ioutil.ReadFile(config.Get("tls_ca_file"))
+		if nil != err {
+			return nil, fmt.Errorf("reading tls_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.Get("tls_ca_file"))
+		}
+		tlsConfig.RootCAs = pool
+	default:
+		return nil, fmt.Errorf("unknown tls_mode %s", mode)
+	}
+
+	// Called after any normal verification passes
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if 0 == len(rawCerts) {
+			return nil
+		}
+		seen := Fingerprint(rawCerts[0])
+		c.mu.Lock()
+		c.seen = seen
+		c.mu.Unlock()
+		if 0 != len(pinned) && !SameFingerprint(seen, pinned) {
+			return fmt.Errorf("%w: got %s", ErrCertificateMismatch, seen)
+		}
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c.Client = &http.Client{Timeout: requestTimeout, Transport: transport}
+	return c, nil
+}
+
+// PeerFingerprint is the fingerprint of the certificate presented on the
+// last HTTPS connection
+func (c *httpClient) PeerFingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seen
+}
@@ -0,0 +1,335 @@
+// Package scheduler runs named jobs on an interval
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job is work run every Interval, plus up to Jitter so jobs added together
+// don't all run at once. A job never overlaps itself.
+//
+// When MaxBackoff is set the interval doubles with every consecutive failed
+// run, up to MaxBackoff, and resets after a run succeeds. Override, when
+// set, can return a different interval for the next run, or 0 to use
+// Interval.
+type Job struct {
+	Name       string
+	Interval   time.Duration
+	Jitter     time.Duration
+	MaxBackoff time.Duration
+	Override   func() time.Duration
+	Run        func(ctx context.Context) error
+}
+
+// Status of a job
+type Status struct {
+	Name      string     `json:"name"`
+	Interval  string     `json:"interval"`
+	Running   bool       `json:"running"`
+	Runs      int        `json:"runs"`
+	Failures  int        `json:"failures"` // consecutive
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastTook  string     `json:"last_took,omitempty"`
+	NextRun   *time.Time `json:"next_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+var (
+	// ErrUnknownJob is returned for a job name that isn't scheduled
+	ErrUnknownJob = errors.New("unknown job")
+	// ErrRunning is returned when triggering a job that is already running
+	ErrRunning = errors.New("job is already running")
+)
+
+// Scheduler runs jobs until it's stopped
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started bool
+}
+
+// job is a scheduled Job and its state
+type job struct {
+	Job
+	mu      sync.Mutex // guards status
+	status  Status
+	trigger chan struct{}
+	cancel  context.CancelFunc
+	stop    chan struct{} // closed to stop after the current run
+	done    chan struct{}
+}
+
+// New returns a scheduler with no jobs
+func New() *Scheduler {
+	return &Scheduler{jobs: make(map[string]*job)}
+}
+
+// Start running jobs. Jobs stop when the context is cancelled or Stop is
+// called.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.started = true
+	for _, j := range s.jobs {
+		s.start(j)
+	}
+}
+
+// Stop every job, cancelling any runs in progress, and wait for them to
+// return
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return
+	}
+	s.started = false
+	s.cancel()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+
+	for _, j := range jobs {
+		<-j.done
+	}
+}
+
+// Shutdown stops scheduling runs and waits for the runs in progress to
+// finish. If the context ends first the runs are cancelled and its error is
+// returned once they return.
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return nil
+	}
+	s.started = false
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		close(j.stop)
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		for _, j := range jobs {
+			<-j.done
+		}
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-finished
+		return ctx.Err()
+	}
+}
+
+// Add a job, replacing any job with the same name. The replaced job is
+// stopped first, cancelling a run in progress.
+func (s *Scheduler) Add(newJob Job) error {
+	if newJob.Interval <= 0 {
+		return fmt.Errorf("job %s needs a positive interval", newJob.Name)
+	}
+	s.Remove(newJob.Name)
+
+	j := &job{
+		Job:     newJob,
+		status:  Status{Name: newJob.Name, Interval: newJob.Interval.String()},
+		trigger: make(chan struct{}, 1),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.Name] = j
+	if s.started {
+		s.start(j)
+	}
+	return nil
+}
+
+// Remove the named job, cancelling a run in progress and waiting for it to
+// return
+func (s *Scheduler) Remove(name string) {
+	s.mu.Lock()
+	j, prs := s.jobs[name]
+	delete(s.jobs, name)
+	s.mu.Unlock()
+
+	if prs && nil != j.cancel {
+		j.cancel()
+		<-j.done
+	}
+}
+
+// RunNow runs the named job as soon as possible instead of waiting for its
+// next run
+func (s *Scheduler) RunNow(name string) error {
+	s.mu.Lock()
+	j, prs := s.jobs[name]
+	s.mu.Unlock()
+	if !prs {
+		return fmt.Errorf("%w: %s", ErrUnknownJob, name)
+	}
+
+	j.mu.Lock()
+	running := j.status.Running
+	j.mu.Unlock()
+	if running {
+		return fmt.Errorf("%w: %s", ErrRunning, name)
+	}
+
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+		// A run is already pending
+	}
+	return nil
+}
+
+// Jobs returns the status of every job sorted by name
+func (s *Scheduler) Jobs() []Status {
+	s.mu.Lock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+
+	statuses := make([]Status, len(jobs))
+	for i, j := range jobs {
+		j.mu.Lock()
+		statuses[i] = j.status
+		j.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
+
+// start the job's loop. Must hold s.mu.
+func (s *Scheduler) start(j *job) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	j.cancel = cancel
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	go j.loop(ctx)
+}
+
+func (j *job) loop(ctx context.Context) {
+	defer close(j.done)
+	log.Printf("Starting job %s, running every %s", j.Name, j.Interval)
+
+	for {
+		next := j.nextInterval()
+		if j.Jitter > 0 {
+			next += time.Duration(rand.Int63n(int64(j.Jitter)))
+		}
+		nextRun := time.Now().Add(next)
+		j.mu.Lock()
+		j.status.NextRun = &nextRun
+		j.mu.Unlock()
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			j.stopped()
+			return
+		case <-j.stop:
+			timer.Stop()
+			j.stopped()
+			return
+		case <-timer.C:
+		case <-j.trigger:
+			timer.Stop()
+		}
+
+		select {
+		case <-j.stop:
+			// Shutdown raced the timer or a trigger
+			j.stopped()
+			return
+		default:
+		}
+		j.run(ctx)
+	}
+}
+
+func (j *job) stopped() {
+	j.mu.Lock()
+	j.status.NextRun = nil
+	j.mu.Unlock()
+	log.Printf("Stopped job %s", j.Name)
+}
+
+func (j *job) run(ctx context.Context) {
+	start := time.Now()
+	j.mu.Lock()
+	j.status.Running = true
+	j.status.NextRun = nil
+	failures := j.status.Failures
+	j.mu.Unlock()
+
+	err := j.Run(ctx)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRun = &start
+	j.status.LastTook = time.Since(start).String()
+	j.status.LastError = ""
+	j.status.Failures = 0
+	if nil != err {
+		j.status.LastError = err.Error()
+		j.status.Failures = failures + 1
+		log.Printf("Job %s failed: %v", j.Name, err)
+	}
+}
+
+// nextInterval is the time to wait before the next run
+func (j *job) nextInterval() time.Duration {
+	next := j.Interval
+	if nil != j.Override {
+		if override := j.Override(); override > 0 {
+			next = override
+		}
+	}
+
+	j.mu.Lock()
+	failures := j.status.Failures
+	j.mu.Unlock()
+	if j.MaxBackoff <= 0 || 0 == failures {
+		return next
+	}
+	backoff := j.Interval
+	for i := 0; i < failures && backoff < j.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > j.MaxBackoff {
+		backoff = j.MaxBackoff
+	}
+	if backoff > next {
+		next = backoff
+	}
+	return next
+}
@@ -0,0 +1,251 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls until done returns true or fails the test after a second
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func status(s *Scheduler, name string) Status {
+	for _, st := range s.Jobs() {
+		if name == st.Name {
+			return st
+		}
+	}
+	return Status{}
+}
+
+func TestJitter(t *testing.T) {
+	s := New()
+	s.Start(context.Background())
+	defer s.Stop()
+
+	for i := 0; i < 20; i++ {
+		before := time.Now()
+		err := s.Add(Job{Name: "job", Interval: time.Hour, Jitter: time.Minute, Run: func(ctx context.Context) error { return nil }})
+		if nil != err {
+			t.Fatal(err)
+		}
+		waitFor(t, "the next run", func() bool { return nil != status(s, "job").NextRun })
+		after := time.Now()
+
+		next := *status(s, "job").NextRun
+		if next.Before(before.Add(time.Hour)) || !next.Before(after.Add(time.Hour+time.Minute)) {
+			t.Fatalf("next run in %s, want between 1h and 1h1m", next.Sub(before))
+		}
+	}
+}
+
+func TestNoOverlap(t *testing.T) {
+	var running, overlaps, runs int32
+	s := New()
+	s.Add(Job{Name: "job", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}})
+	s.Start(context.Background())
+
+	// Triggering a running job must not start a second run
+	for 5 > atomic.LoadInt32(&runs) {
+		s.RunNow("job")
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+
+	if 0 != overlaps {
+		t.Errorf("%d runs overlapped", overlaps)
+	}
+}
+
+func TestRunNow(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := New()
+	s.Add(Job{Name: "job", Interval: time.Hour, Run: func(ctx context.Context) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}})
+	s.Start(context.Background())
+	defer s.Stop()
+
+	if err := s.RunNow("missing"); !errors.Is(err, ErrUnknownJob) {
+		t.Errorf("got %v for an unknown job, want ErrUnknownJob", err)
+	}
+
+	if err := s.RunNow("job"); nil != err {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("RunNow didn't run the job")
+	}
+	if err := s.RunNow("job"); !errors.Is(err, ErrRunning) {
+		t.Errorf("got %v while running, want ErrRunning", err)
+	}
+	close(release)
+
+	waitFor(t, "the run to finish", func() bool { return 1 == status(s, "job").Runs })
+	if err := s.RunNow("job"); nil != err {
+		t.Errorf("got %v after the run finished", err)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	var override int64
+	var runs int32
+	s := New()
+	s.Add(Job{
+		Name:     "job",
+		Interval: time.Hour,
+		Override: func() time.Duration { return time.Duration(atomic.LoadInt64(&override)) },
+		Run: func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		},
+	})
+	atomic.StoreInt64(&override, int64(time.Millisecond))
+	s.Start(context.Background())
+	defer s.Stop()
+
+	waitFor(t, "overridden runs", func() bool { return 3 <= atomic.LoadInt32(&runs) })
+
+	// Without an override the job is back to its hourly interval
+	atomic.StoreInt64(&override, 0)
+	before := time.Now()
+	waitFor(t, "an hourly run", func() bool {
+		next := status(s, "job").NextRun
+		return nil != next && next.After(before.Add(59*time.Minute))
+	})
+}
+
+func TestRemoveCancels(t *testing.T) {
+	started := make(chan struct{})
+	var returned int32
+	s := New()
+	s.Add(Job{Name: "job", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&returned, 1)
+		return ctx.Err()
+	}})
+	s.Start(context.Background())
+	defer s.Stop()
+	<-started
+
+	s.Remove("job")
+	if 0 == atomic.LoadInt32(&returned) {
+		t.Error("Remove returned before the run did")
+	}
+	if 0 != len(s.Jobs()) {
+		t.Errorf("got jobs %+v after removing the only one", s.Jobs())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	var cancelled, finished int32
+	s := New()
+	s.Add(Job{Name: "job", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+		close(started)
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&cancelled, 1)
+		case <-time.After(20 * time.Millisecond):
+		}
+		atomic.StoreInt32(&finished, 1)
+		return nil
+	}})
+	s.Start(context.Background())
+	<-started
+
+	// The run in progress finishes without being cancelled
+	if err := s.Shutdown(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if 0 == atomic.LoadInt32(&finished) || 0 != atomic.LoadInt32(&cancelled) {
+		t.Errorf("finished %d, cancelled %d, want the run to finish uncancelled", finished, cancelled)
+	}
+	if st := status(s, "job"); 1 != st.Runs || nil != st.NextRun {
+		t.Errorf("got %+v, want one run and none scheduled", st)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	var cancelled int32
+	s := New()
+	s.Add(Job{Name: "job", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		atomic.StoreInt32(&cancelled, 1)
+		return ctx.Err()
+	}})
+	s.Start(context.Background())
+	<-started
+
+	// A run outlasting the shutdown's context is cancelled and waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context's deadline", err)
+	}
+	if 0 == atomic.LoadInt32(&cancelled) {
+		t.Error("Shutdown returned before the run was cancelled")
+	}
+}
+
+func TestNextInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackoff time.Duration
+		override   time.Duration
+		failures   int
+		want       time.Duration
+	}{
+		{"no failures", time.Hour, 0, 0, time.Minute},
+		{"no backoff", 0, 0, 5, time.Minute},
+		{"one failure", time.Hour, 0, 1, 2 * time.Minute},
+		{"doubles", time.Hour, 0, 3, 8 * time.Minute},
+		{"capped", 10 * time.Minute, 0, 4, 10 * time.Minute},
+		{"capped after many failures", 10 * time.Minute, 0, 100, 10 * time.Minute},
+		{"override", time.Hour, 10 * time.Second, 0, 10 * time.Second},
+		{"backoff beats a shorter override", time.Hour, 10 * time.Second, 2, 4 * time.Minute},
+		{"longer override beats backoff", time.Hour, 30 * time.Minute, 2, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			override := test.override
+			j := &job{Job: Job{
+				Interval:   time.Minute,
+				MaxBackoff: test.maxBackoff,
+				Override:   func() time.Duration { return override },
+			}}
+			j.status.Failures = test.failures
+			if got := j.nextInterval(); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
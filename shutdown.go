@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// handleSignals reloads the configuration on SIGHUP and shuts down on SIGINT
+// or SIGTERM
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if syscall.SIGHUP == sig {
+			reloadConfig()
+			continue
+		}
+		log.Printf("Received %s, shutting down", sig)
+		signal.Stop(signals)
+		shutdown()
+		return
+	}
+}
+
+// reloadConfig re-reads the preferences, letting their watchers reload sites
+// and reschedule polling, and reloads the notification method
+func reloadConfig() {
+	log.Println("Reloading configuration")
+	application.preferences.Reload()
+	loadNotification()
+}
+
+// shutdown stops serving and polling, letting polls in progress finish,
+// sends the queued notifications and closes the DB, all within
+// shutdown_timeout seconds
+func shutdown() {
+	timeout := 10
+	if raw, prs := application.preferences.Get("shutdown_timeout"); prs {
+		if value, err := strconv.Atoi(*raw); nil == err && value > 0 {
+			timeout = value
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	// Stop the API first so no request touches the DB after it's closed,
+	// ending the event streams that would otherwise keep it open
+	application.events.Close()
+	if err := application.server.Shutdown(ctx); nil != err {
+		log.Printf("Cannot shut down the server cleanly: %v", err)
+	}
+	if err := application.scheduler.Shutdown(ctx); nil != err {
+		log.Printf("Cancelled polls still in progress: %v", err)
+	}
+	if err := application.outbox.Flush(ctx); nil != err {
+		log.Printf("Cannot send every notification: %v", err)
+	}
+	if err := application.db.Close(); nil != err {
+		log.Printf("Cannot close the DB: %v", err)
+	}
+	log.Println("Shut down")
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disrvptor/wifi_client_watch/router"
+)
+
+const defaultSite = "default"
+
+// site is a router being watched along with the clients last seen on it
+type site struct {
+	Name        string
+	driver      string
+	config      router.Config
+	myRouter    router.Router
+	mu          sync.Mutex // guards clients, nodes, peerCert, capabilities, actionRouter and probeFailures
+	clients     []router.Client
+	nodes       []router.Node
+	peerCert    string // fingerprint presented on the last HTTPS connection
+	certAlert   string // fingerprint we last alerted about
+	failures    int    // consecutive failed polls
+	unreachable bool
+	fastUntil   time.Time       // poll at fast_poll_time until then
+	anomalies   map[string]bool // keys of the anomalies already raised
+	// routerMu serialises use of myRouter between polls and API requests
+	routerMu     sync.Mutex
+	capabilities []router.Capability
+	// actionRouter is myRouter, for listing its client actions without
+	// waiting for routerMu
+	actionRouter router.Router
+	// probeFailures counts the unanswered probes in a row of clients the
+	// router reports online
+	probeFailures map[string]int
+}
+
+// siteInfo is what the API reports about a site
+type siteInfo struct {
+	Name                string `json:"name"`
+	Driver              string `json:"driver"`
+	TLSMode             string `json:"tls_mode,omitempty"`
+	PinnedFingerprint   string `json:"tls_fingerprint,omitempty"`
+	PeerFingerprint     string `json:"tls_peer_fingerprint,omitempty"`
+	CertificateMismatch bool   `json:"tls_mismatch"`
+	// Capabilities are what the site's router can do, once it's been polled
+	Capabilities []router.Capability `json:"capabilities"`
+}
+
+// siteClient is a client along with the site it was seen on
+type siteClient struct {
+	Site    string   `json:"site"`
+	Status  string   `json:"status"`
+	Random  bool     `json:"random"`
+	AliasOf string   `json:"alias_of,omitempty"` // device a random MAC was correlated with
+	Groups  []string `json:"groups"`
+	Tags    []string `json:"tags"`
+	router.Client
+}
+
+// driverInfo is what the API reports about a router driver
+type driverInfo struct {
+	router.Driver
+	Capabilities []router.Capability `json:"capabilities"`
+}
+
+// siteNode is a mesh node along with the site it belongs to
+type siteNode struct {
+	Site string `json:"site"`
+	router.Node
+}
+
+// sitePreferenceName is the name of the preference that overrides the named
+// preference for a single site, e.g. site.lab.url
+func sitePreferenceName(siteName string, name string) string {
+	return fmt.Sprintf("site.%s.%s", siteName, name)
+}
+
+// preference returns the site's value for the named preference, falling back
+// to the global preference when the site doesn't override it
+func (s *site) preference(name string) (*string, bool) {
+	value, prs := application.preferences.Get(sitePreferenceName(s.Name, name))
+	if prs {
+		return value, true
+	}
+	return application.preferences.Get(name)
+}
+
+// siteNames returns the names in the comma separated sites preference
+func siteNames() []string {
+	names := make([]string, 0)
+	raw, prs := application.preferences.Get("sites")
+	if !prs {
+		return names
+	}
+	for _, name := range strings.Split(*raw, ",") {
+		name = strings.TrimSpace(name)
+		if 0 != len(name) && !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// allSites returns a copy of the site list, which a reload can replace at
+// any time
+func (app *wifiClientWatchApp) allSites() []*site {
+	app.sitesMu.RLock()
+	defer app.sitesMu.RUnlock()
+	return append([]*site{}, app.sites...)
+}
+
+func findSite(name string) *site {
+	for _, s := range application.allSites() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// loadSites builds the site list from the preferences. Sites that already
+// exist keep their clients and router.
+func loadSites() {
+	application.sitesMu.Lock()
+	defer application.sitesMu.Unlock()
+	existing := make(map[string]*site)
+	for _, s := range application.sites {
+		existing[s.Name] = s
+	}
+	sites := make([]*site, 0)
+	for _, name := range siteNames() {
+		s := existing[name]
+		if nil == s {
+			s = &site{Name: name}
+		}
+		watchSitePreferences(name)
+		sites = append(sites, s)
+	}
+	application.sites = sites
+}
+
+// lastClients returns a copy of the clients seen on the site's last poll,
+// which a reload can replace at any time
+func (s *site) lastClients() []router.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]router.Client{}, s.clients...)
+}
+
+// lastNodes returns a copy of the mesh nodes seen on the site's last poll
+func (s *site) lastNodes() []router.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]router.Node{}, s.nodes...)
+}
+
+// currentRouter returns the site's router, creating a new one when the
+// driver or its settings changed since the last poll
+func (s *site) currentRouter() (router.Router, error) {
+	driverName, prs := s.preference("router")
+	if !prs {
+		return nil, fmt.Errorf("No router defined for site %s", s.Name)
+	}
+	driver, prs := router.GetDriver(*driverName)
+	if !prs {
+		return nil, fmt.Errorf("%w: %s", router.ErrUnknownDriver, *driverName)
+	}
+
+	config := make(router.Config)
+	for _, field := range driver.Config {
+		if value, prs := s.preference(field.Name); prs {
+			config[field.Name] = *value
+		}
+	}
+
+	if nil != s.myRouter && s.driver == driver.Name && reflect.DeepEqual(s.config, config) {
+		return s.myRouter, nil
+	}
+
+	log.Printf("Creating %s router for site %s", driver.Name, s.Name)
+	rtr, err := router.GetRouter(driver.Name, config)
+	if nil != err {
+		return nil, err
+	}
+	s.driver = driver.Name
+	s.config = config
+	s.myRouter = rtr
+	s.mu.Lock()
+	s.capabilities = router.Capabilities(rtr)
+	s.actionRouter = rtr
+	s.mu.Unlock()
+	return rtr, nil
+}
+
+// info returns what the API reports about the site
+func (s *site) info() siteInfo {
+	info := siteInfo{Name: s.Name}
+	if driver, prs := s.preference("router"); prs {
+		info.Driver = *driver
+	}
+	if mode, prs := s.preference("tls_mode"); prs {
+		info.TLSMode = *mode
+	}
+	if fingerprint, prs := s.preference("tls_fingerprint"); prs {
+		info.PinnedFingerprint = *fingerprint
+	}
+	s.mu.Lock()
+	info.PeerFingerprint = s.peerCert
+	info.Capabilities = append([]router.Capability{}, s.capabilities...)
+	s.mu.Unlock()
+	info.CertificateMismatch = router.TLSModePin == info.TLSMode && 0 != len(info.PinnedFingerprint) &&
+		0 != len(info.PeerFingerprint) && !router.SameFingerprint(info.PinnedFingerprint, info.PeerFingerprint)
+	return info
+}
+
+// checkCertificate records the certificate the router presented, trusts it
+// on first use when pinning, and alerts when a pinned router presents a
+// different one. err is the error from the poll, if any.
+func (s *site) checkCertificate(rtr router.Router, err error) {
+	reporter, ok := rtr.(router.CertificateReporter)
+	if !ok {
+		return
+	}
+	seen := reporter.PeerFingerprint()
+	if 0 == len(seen) {
+		return
+	}
+	s.mu.Lock()
+	s.peerCert = seen
+	s.mu.Unlock()
+
+	mode, _ := s.preference("tls_mode")
+	if nil == mode || router.TLSModePin != *mode {
+		return
+	}
+
+	pinned, prs := s.preference("tls_fingerprint")
+	if !prs || 0 == len(*pinned) {
+		log.Printf("Trusting certificate %s for site %s on first use", seen, s.Name)
+		application.preferences.Set(sitePreferenceName(s.Name, "tls_fingerprint"), seen)
+		return
+	}
+
+	if errors.Is(err, router.ErrCertificateMismatch) && s.certAlert != seen {
+		s.certAlert = seen
+		sendNotification(s, fmt.Sprintf("Router certificate changed from %s to %s", *pinned, seen))
+	}
+}
+
+// isSecretPreference is true if the preference (or site override) holds a
+// router setting that a driver marks as secret
+func isSecretPreference(name string) bool {
+	if strings.HasPrefix(name, "site.") {
+		parts := strings.SplitN(name, ".", 3)
+		if len(parts) == 3 {
+			name = parts[2]
+		}
+	}
+	for _, driver := range router.Drivers() {
+		for _, field := range driver.Config {
+			if field.Name == name && field.Secret {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reloadSites stops polling, rebuilds the site list and starts polling again
+func reloadSites(oldValue *string, newValue *string) {
+	log.Println("Reloading sites")
+	for _, s := range application.allSites() {
+		unscheduleSite(s)
+	}
+	loadSites()
+	readClients(application)
+	for _, s := range application.allSites() {
+		scheduleSite(s)
+	}
+}
+
+var watchedSites = make(map[string]bool)
+
+// watchSitePreferences adds the watchers for a site's preferences once. The
+// caller must hold sitesMu, which also guards watchedSites.
+func watchSitePreferences(name string) {
+	if watchedSites[name] {
+		return
+	}
+	watchedSites[name] = true
+	reschedule := func(oldValue *string, newValue *string) {
+		s := findSite(name)
+		if nil != s {
+			scheduleSite(s)
+		}
+	}
+	application.preferences.AddWatcher(sitePreferenceName(name, "poll_time"), reschedule)
+	application.preferences.AddWatcher(sitePreferenceName(name, "max_backoff"), reschedule)
+}
@@ -0,0 +1,287 @@
+// Package websocket is a minimal RFC 6455 server, enough to push messages to
+// browsers and answer their pings and closes
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptGUID is appended to the client's key to prove the server understood
+// the handshake
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes
+const (
+	opContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseTooBig        = 1009
+)
+
+// MaxMessage is the largest message read from a client
+const MaxMessage = 64 * 1024
+
+// writeTimeout bounds writing a frame to a client that stopped reading
+const writeTimeout = 10 * time.Second
+
+var (
+	// ErrHandshake is returned when a request isn't a websocket handshake
+	ErrHandshake = errors.New("not a websocket handshake")
+	// ErrClosed is returned once the connection has been closed
+	ErrClosed = errors.New("websocket closed")
+)
+
+// Conn is a server side websocket connection. Writes can come from any
+// goroutine, but only one may read.
+type Conn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	mu     sync.Mutex // guards writes and closed
+	closed bool
+}
+
+// Upgrade completes the handshake and takes over the request's connection.
+// Requests that aren't a handshake are answered with 400.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if http.MethodGet != r.Method || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || nil != err || 16 != len(decoded) {
+		http.Error(w, "Expected a websocket handshake", http.StatusBadRequest)
+		return nil, ErrHandshake
+	}
+	if "13" != r.Header.Get("Sec-WebSocket-Version") {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: version %s", ErrHandshake, r.Header.Get("Sec-WebSocket-Version"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Cannot upgrade the connection", http.StatusInternalServerError)
+		return nil, errors.New("the connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if nil != err {
+		return nil, err
+	}
+
+	c := &Conn{conn: conn, rw: rw}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", accept(key))
+	if err = rw.Flush(); nil != err {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// accept is the Sec-WebSocket-Accept answer to the client's key
+func accept(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains is whether the comma separated header has the token
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteText sends a text message
+func (c *Conn) WriteText(p []byte) error {
+	return c.writeFrame(OpText, p)
+}
+
+// Ping sends a ping, which the client answers with a pong
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// writeFrame sends a single unmasked frame, as servers do
+func (c *Conn) writeFrame(op byte, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.writeFrameLocked(op, p)
+}
+
+func (c *Conn) writeFrameLocked(op byte, p []byte) error {
+	header := []byte{0x80 | op, 0}
+	switch {
+	case len(p) < 126:
+		header[1] = byte(len(p))
+	case len(p) <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(p)))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(p)))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.rw.Write(header); nil != err {
+		return err
+	}
+	if _, err := c.rw.Write(p); nil != err {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// closes on the way. It returns io.EOF once the client has closed the
+// connection.
+func (c *Conn) ReadMessage() (byte, []byte, error) {
+	var op byte
+	message := make([]byte, 0)
+	for {
+		fin, frameOp, payload, err := c.readFrame()
+		if nil != err {
+			return 0, nil, err
+		}
+		switch frameOp {
+		case opPing:
+			if err = c.writeFrame(opPong, payload); nil != err {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code := []byte{0x03, 0xE8} // CloseNormal
+			if len(payload) >= 2 {
+				code = payload[:2]
+			}
+			c.close(code)
+			return 0, nil, io.EOF
+		case OpText, OpBinary:
+			if 0 != op {
+				return 0, nil, c.fail(CloseProtocolError, "expected a continuation frame")
+			}
+			op = frameOp
+		case opContinuation:
+			if 0 == op {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", frameOp))
+		}
+		if len(message)+len(payload) > MaxMessage {
+			return 0, nil, c.fail(CloseTooBig, "message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			return op, message, nil
+		}
+	}
+}
+
+// readFrame reads a frame and unmasks its payload. Clients must mask every
+// frame, and control frames can't be fragmented or longer than 125 bytes.
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.rw, header[:]); nil != err {
+		return false, 0, nil, err
+	}
+	fin, op := 0 != header[0]&0x80, header[0]&0x0F
+	if 0 != header[0]&0x70 {
+		return false, 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if 0 == header[1]&0x80 {
+		return false, 0, nil, c.fail(CloseProtocolError, "unmasked frame")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.rw, b[:]); nil != err {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.rw, b[:]); nil != err {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if 0 != op&0x8 && (!fin || length > 125) {
+		return false, 0, nil, c.fail(CloseProtocolError, "invalid control frame")
+	}
+	if length > MaxMessage {
+		return false, 0, nil, c.fail(CloseTooBig, "message too big")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); nil != err {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.rw, payload); nil != err {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// fail closes the connection with the status code, returning the reason as
+// an error
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return fmt.Errorf("websocket: %s", reason)
+}
+
+// Close sends a close frame with the status code and reason and closes the
+// connection. Closing again does nothing.
+func (c *Conn) Close(code int, reason string) error {
+	// Control frames carry at most 125 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.close(append(payload, reason...))
+}
+
+func (c *Conn) close(payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.writeFrameLocked(opClose, payload)
+	return c.conn.Close()
+}
@@ -0,0 +1,264 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccept(t *testing.T) {
+	// The example from RFC 6455 section 1.3
+	if got := accept("dGhlIHNhbXBsZSBub25jZQ=="); "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" != got {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"not a handshake", map[string]string{}, http.StatusBadRequest},
+		{"bad key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Key": "short",
+			"Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+		{"old version", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket",
+			"Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, value := range test.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			if _, err := Upgrade(w, r); nil == err || w.Code != test.want {
+				t.Errorf("got %d, %v, want %d", w.Code, err, test.want)
+			}
+		})
+	}
+}
+
+// client is the browser end of a connection to a test server
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial starts a server that runs serve on each connection and connects to it
+func dial(t *testing.T, serve func(c *Conn)) (*client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if nil != err {
+			return
+		}
+		serve(c)
+	}))
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if nil != err {
+		server.Close()
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if nil != err {
+		conn.Close()
+		server.Close()
+		t.Fatal(err)
+	}
+	if http.StatusSwitchingProtocols != resp.StatusCode ||
+		"s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" != resp.Header.Get("Sec-WebSocket-Accept") {
+		t.Errorf("got handshake %d %v", resp.StatusCode, resp.Header)
+	}
+	return &client{conn: conn, r: r}, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+// frame encodes a client frame, masked unless told not to
+func frame(fin bool, op byte, payload []byte, masked bool) []byte {
+	first := op
+	if fin {
+		first |= 0x80
+	}
+	b := []byte{first, 0}
+	switch {
+	case len(payload) < 126:
+		b[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		b[1] = 126
+		b = append(b, 0, 0)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(payload)))
+	default:
+		b[1] = 127
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[2:], uint64(len(payload)))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func (c *client) send(frames ...[]byte) {
+	for _, f := range frames {
+		c.conn.Write(f)
+	}
+}
+
+// read returns the next frame from the server, which mustn't be masked
+func (c *client) read(t *testing.T) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); nil != err {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	if 0 == header[0]&0x80 || 0 != header[1]&0x80 {
+		t.Fatalf("got frame header % x, want a final unmasked frame", header)
+	}
+	length := int(header[1])
+	if 126 == length {
+		var b [2]byte
+		io.ReadFull(c.r, b[:])
+		length = int(binary.BigEndian.Uint16(b[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); nil != err {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+// expectClose reads a close frame with the status code
+func (c *client) expectClose(t *testing.T, code int) {
+	op, payload := c.read(t)
+	if opClose != op || len(payload) < 2 || code != int(binary.BigEndian.Uint16(payload)) {
+		t.Fatalf("got frame %d % x, want a close with %d", op, payload, code)
+	}
+}
+
+// echo serves by sending back each message until the read fails
+func echo(errs chan error) func(c *Conn) {
+	return func(c *Conn) {
+		for {
+			_, message, err := c.ReadMessage()
+			if nil != err {
+				errs <- err
+				return
+			}
+			c.WriteText(message)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	errs := make(chan error, 1)
+	c, stop := dial(t, echo(errs))
+	defer stop()
+
+	c.send(frame(true, OpText, []byte("hello"), true))
+	if op, payload := c.read(t); OpText != op || "hello" != string(payload) {
+		t.Errorf("got %d %q, want hello", op, payload)
+	}
+
+	long := strings.Repeat("x", 300)
+	c.send(frame(true, OpText, []byte(long), true))
+	if _, payload := c.read(t); long != string(payload) {
+		t.Errorf("got %d bytes back, want %d", len(payload), len(long))
+	}
+
+	// Fragments are joined, with a ping answered in between
+	c.send(frame(false, OpText, []byte("frag"), true), frame(true, opPing, []byte("p"), true),
+		frame(false, opContinuation, []byte("men"), true), frame(true, opContinuation, []byte("ted"), true))
+	if op, payload := c.read(t); opPong != op || "p" != string(payload) {
+		t.Errorf("got %d %q, want the pong", op, payload)
+	}
+	if _, payload := c.read(t); "fragmented" != string(payload) {
+		t.Errorf("got %q, want fragmented", payload)
+	}
+
+	// Closing is echoed with the client's code
+	c.send(frame(true, opClose, []byte{0x03, 0xE9}, true))
+	c.expectClose(t, CloseGoingAway)
+	if err := <-errs; io.EOF != err {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+}
+
+func TestReadMessageProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   int
+	}{
+		{"unmasked", [][]byte{frame(true, OpText, []byte("hi"), false)}, CloseProtocolError},
+		{"reserved bits", [][]byte{func() []byte {
+			f := frame(true, OpText, []byte("hi"), true)
+			f[0] |= 0x40
+			return f
+		}()}, CloseProtocolError},
+		{"unknown opcode", [][]byte{frame(true, 0x3, []byte("hi"), true)}, CloseProtocolError},
+		{"continuation first", [][]byte{frame(true, opContinuation, []byte("hi"), true)}, CloseProtocolError},
+		{"new message mid fragment", [][]byte{frame(false, OpText, []byte("a"), true),
+			frame(true, OpText, []byte("b"), true)}, CloseProtocolError},
+		{"fragmented control", [][]byte{frame(false, opPing, []byte("p"), true)}, CloseProtocolError},
+		{"long control", [][]byte{frame(true, opPing, make([]byte, 126), true)}, CloseProtocolError},
+		{"frame too big", [][]byte{frame(true, OpBinary, make([]byte, MaxMessage+1), true)}, CloseTooBig},
+		{"fragments too big", [][]byte{frame(false, OpBinary, make([]byte, MaxMessage), true),
+			frame(true, opContinuation, []byte("x"), true)}, CloseTooBig},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			c, stop := dial(t, echo(errs))
+			defer stop()
+			c.send(test.frames...)
+			c.expectClose(t, test.code)
+			if err := <-errs; nil == err || io.EOF == err {
+				t.Errorf("got %v, want a protocol error", err)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	closed := make(chan error, 1)
+	c, stop := dial(t, func(conn *Conn) {
+		conn.WriteText([]byte("bye"))
+		conn.Close(CloseNormal, strings.Repeat("r", 200))
+		// Closing again does nothing, and writes fail
+		conn.Close(CloseNormal, "")
+		closed <- conn.WriteText([]byte("late"))
+	})
+	defer stop()
+
+	if _, payload := c.read(t); "bye" != string(payload) {
+		t.Errorf("got %q, want bye", payload)
+	}
+	op, payload := c.read(t)
+	if opClose != op || 125 != len(payload) || CloseNormal != int(binary.BigEndian.Uint16(payload)) {
+		t.Errorf("got frame %d with %d bytes, want a close with the reason cut to 125 bytes", op, len(payload))
+	}
+	if err := <-closed; ErrClosed != err {
+		t.Errorf("got %v writing after closing, want ErrClosed", err)
+	}
+	if _, err := c.r.ReadByte(); io.EOF != err {
+		t.Errorf("got %v, want the connection closed", err)
+	}
+}